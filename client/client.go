@@ -5,10 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Get server env var and do some validation
@@ -25,6 +31,61 @@ func getServerURL() (string, error) {
 	return val, nil
 }
 
+// where the client config file lives, RAINBOW_ROAD_CLIENT_CONFIG or
+// ~/.config/rainbow-road/config.yaml on linux
+func clientConfigPath() string {
+	if path, ok := os.LookupEnv("RAINBOW_ROAD_CLIENT_CONFIG"); ok {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "rainbow-road", "config.yaml")
+}
+
+// Get the api key from RAINBOW_ROAD_API_KEY or the client config file.
+// No key is fine, servers without auth don't need one
+func getAPIKey() (string, error) {
+	if val, ok := os.LookupEnv("RAINBOW_ROAD_API_KEY"); ok {
+		return strings.TrimSpace(val), nil
+	}
+
+	path := clientConfigPath()
+	if path == "" {
+		return "", nil
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.New("Could not read client config: " + err.Error())
+	}
+
+	var config struct {
+		APIKey string `yaml:"api_key"`
+	}
+	err = yaml.Unmarshal(body, &config)
+	if err != nil {
+		return "", errors.New("Could not read client config " + path + ": " + err.Error())
+	}
+
+	return strings.TrimSpace(config.APIKey), nil
+}
+
+// sent with every request when set
+var apiKey string = ""
+
+// send a request to the server with the api key if we have one
+func doRequest(req *http.Request) (*http.Response, error) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	return http.DefaultClient.Do(req)
+}
+
 // validate repo names
 func validateRepo(repo string) bool {
 	match, _ := regexp.MatchString("(.*)/(.*)", repo)
@@ -70,10 +131,26 @@ func createRequestBody(repos []string) []byte {
 	return bodyByte
 }
 
+// build the query string for the /stars api
+func createQuery(filter string) string {
+	query := url.Values{"aggregates": {"true"}}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	return query.Encode()
+}
+
 // make the request to the /stars api
-func callServer(repos []string, url string) map[string]interface{} {
+func callServer(repos []string, server string, filter string) (map[string]interface{}, error) {
 	body := createRequestBody(repos)
-	resp, err := http.Post(url+"/stars", "application/json", bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", server+"/stars?"+createQuery(filter), bytes.NewBuffer(body))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doRequest(req)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -89,17 +166,89 @@ func callServer(repos []string, url string) map[string]interface{} {
 		os.Exit(1)
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		json.NewDecoder(resp.Body).Decode(&res)
+	// pass along whatever the server didn't like, ie a bad filter
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("Error: " + strings.TrimSpace(string(msg)))
 	}
 
-	return res
+	json.NewDecoder(resp.Body).Decode(&res)
+
+	return res, nil
 
 }
 
+// pull flags out of the command line, everything else is a repo
+func parseArgs(args []string) ([]string, string, error) {
+	var repos []string
+	filter := ""
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case arg == "--filter":
+			if i+1 >= len(args) {
+				return nil, "", errors.New("Error: --filter needs an expression. Hint: --filter 'stars > 1000'")
+			}
+			i++
+			filter = args[i]
+		case strings.HasPrefix(arg, "--filter="):
+			filter = strings.TrimPrefix(arg, "--filter=")
+		default:
+			repos = append(repos, arg)
+		}
+	}
+
+	return repos, filter, nil
+}
+
+// print whole numbers without a decimal point
+func formatNumber(num float64) string {
+	if num == float64(int64(num)) {
+		return fmt.Sprint(int64(num))
+	}
+	return fmt.Sprintf("%.1f", num)
+}
+
+// summary lines printed under the table from the server's aggregates
+func summaryFooter(aggregates map[string]interface{}) string {
+	str := ""
+
+	for _, field := range []string{"sum", "mean", "median", "min", "max"} {
+		// null when none of the lookups worked
+		num, ok := aggregates[field].(float64)
+		if !ok {
+			continue
+		}
+
+		label := strings.ToUpper(field)
+		if field == "sum" {
+			label = "TOTAL"
+		}
+		str += fmt.Sprintf("%-50s%s\n", label, formatNumber(num))
+	}
+
+	// only mention errors if there were some
+	errs, _ := aggregates["errors"].(map[string]interface{})
+	codes := make([]string, 0, len(errs))
+	for code, count := range errs {
+		if count.(float64) > 0 {
+			codes = append(codes, code+": "+formatNumber(count.(float64)))
+		}
+	}
+
+	if len(codes) > 0 {
+		sort.Strings(codes)
+		str += fmt.Sprintf("%-50s%s\n", "ERRORS", strings.Join(codes, ", "))
+	}
+
+	return str
+}
+
 var serverURLOverride string = ""
 
-func run(repos []string) (string, error) {
+func run(args []string) (string, error) {
 
 	// get and validate server url
 	url, err := getServerURL()
@@ -107,15 +256,33 @@ func run(repos []string) (string, error) {
 	// this is for testing so we can setup a mock http server
 	if serverURLOverride != "" {
 		url = serverURLOverride
+		err = nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	apiKey, err = getAPIKey()
+
+	if err != nil {
+		return "", err
+	}
+
+	// side by side comparison
+	if len(args) > 0 && args[0] == "compare" {
+		return runCompare(args[1:], url)
 	}
 
+	repos, filter, err := parseArgs(args)
+
 	if err != nil {
 		return "", err
 	}
 
 	// if there is no repos return a help string
 	if len(repos) == 0 {
-		str := "Usage: stars <git-repo-1> <git-repo-2> ...\n"
+		str := "Usage: stars [--filter <expression>] <git-repo-1> <git-repo-2> ...\n       stars compare <git-repo-1> <git-repo-2> ...\n"
 		return str, nil
 	}
 
@@ -129,7 +296,11 @@ func run(repos []string) (string, error) {
 	}
 
 	// call the stars api
-	res := callServer(repos, url)
+	res, err := callServer(repos, url, filter)
+
+	if err != nil {
+		return "", err
+	}
 
 	str := "REPO                                              STARS\n"
 
@@ -147,6 +318,11 @@ func run(repos []string) (string, error) {
 
 	}
 
+	// older servers don't send aggregates
+	if aggregates, ok := res["aggregates"].(map[string]interface{}); ok {
+		str += "\n" + summaryFooter(aggregates)
+	}
+
 	str = strings.TrimSuffix(str, "\n")
 
 	return str, nil
@@ -154,11 +330,8 @@ func run(repos []string) (string, error) {
 
 func main() {
 
-	// get all the repos
-	repos := os.Args[1:]
-
 	// run command and handle errors
-	str, err := run(repos)
+	str, err := run(os.Args[1:])
 
 	if err != nil {
 		// print errors
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -56,6 +57,65 @@ func TestGetServerUrl(t *testing.T) {
 
 }
 
+func TestGetAPIKey(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "client")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	os.Setenv("RAINBOW_ROAD_CLIENT_CONFIG", path)
+	defer os.Unsetenv("RAINBOW_ROAD_CLIENT_CONFIG")
+
+	// no env and no file is fine
+	key, err := getAPIKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "", key)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("api_key: rr_file\n"), 0600))
+	key, err = getAPIKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "rr_file", key)
+
+	// env wins over the file
+	os.Setenv("RAINBOW_ROAD_API_KEY", "rr_env")
+	key, err = getAPIKey()
+	os.Unsetenv("RAINBOW_ROAD_API_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "rr_env", key)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("api_key: [nope"), 0600))
+	_, err = getAPIKey()
+	assert.Contains(t, err.Error(), "Could not read client config "+path+": ")
+}
+
+func TestRunSendsAPIKey(t *testing.T) {
+
+	os.Setenv("RAINBOW_ROAD_API_KEY", "rr_test")
+	defer os.Unsetenv("RAINBOW_ROAD_API_KEY")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rr_test" {
+			http.Error(w, "Missing or invalid API key. Hint: send one as Authorization: Bearer <key>", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, `{"repos":[{"name":"kubernetes/kubernetes","Stars":77634,"Error":"\u003cnil\u003e"}]}`)
+	}))
+	defer ts.Close()
+	serverURLOverride = ts.URL
+	defer func() { serverURLOverride = "" }()
+
+	_, err := run([]string{"kubernetes/kubernetes"})
+	assert.Nil(t, err)
+
+	_, err = run([]string{"compare", "kubernetes/kubernetes", "istio/istio"})
+	assert.NotContains(t, fmt.Sprint(err), "API key")
+
+	os.Setenv("RAINBOW_ROAD_API_KEY", "rr_wrong")
+	_, err = run([]string{"kubernetes/kubernetes"})
+	assert.EqualError(t, err, "Error: Missing or invalid API key. Hint: send one as Authorization: Bearer <key>")
+}
+
 func TestValidateRepoName(t *testing.T) {
 	assert.False(t, validateRepo("foo"))
 	assert.True(t, validateRepo("fizz/buzz"))
@@ -96,10 +156,21 @@ func TestCallServer(t *testing.T) {
 
 	repos := []string{"kubernetes/kubernetes", "istio/istio"}
 
-	res := callServer(repos, ts.URL)
+	res, err := callServer(repos, ts.URL, "")
+	assert.Nil(t, err)
 	expected := map[string]interface{}(map[string]interface{}{"repos": []interface{}{map[string]interface{}{"Error": "<nil>", "Stars": float64(77634), "name": "kubernetes/kubernetes"}}})
 	assert.Equal(t, expected, res)
 
+	// errors from the server are passed along
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "stars >", r.URL.Query().Get("filter"))
+		http.Error(w, "Recieved invalid filter: unexpected end of filter at position 8", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	_, err = callServer(repos, ts.URL, "stars >")
+	assert.EqualError(t, err, "Error: Recieved invalid filter: unexpected end of filter at position 8")
+
 }
 
 func TestRun(t *testing.T) {
@@ -115,6 +186,29 @@ func TestRun(t *testing.T) {
 	expected := "REPO                                              STARS\nkubernetes/kubernetes                             77634"
 	assert.Equal(t, expected, str)
 
+	// summary footer from the server's aggregates
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("aggregates"))
+		fmt.Fprintln(w, `{"repos":[{"name":"kubernetes/kubernetes","Stars":77634,"Error":"\u003cnil\u003e"},{"name":"istio/itio","Stars":-1,"Error":"Repo Not found: istio/itio"},{"name":"istio/istio","Stars":28001,"Error":"\u003cnil\u003e"}],`+
+			`"aggregates":{"count":2,"sum":105635,"mean":52817.5,"median":52817.5,"min":28001,"max":77634,"percentiles":{},"errors":{"invalid":0,"not_found":1,"upstream_error":0}}}`)
+	}))
+	defer ts.Close()
+	serverURLOverride = ts.URL
+	str, err = run([]string{"kubernetes/kubernetes", "istio/itio", "istio/istio"})
+	assert.Nil(t, err)
+	expected = "REPO                                              STARS\n" +
+		"kubernetes/kubernetes                             77634\n" +
+		"istio/itio                                        Repo Not found: istio/itio\n" +
+		"istio/istio                                       28001\n" +
+		"\n" +
+		"TOTAL                                             105635\n" +
+		"MEAN                                              52817.5\n" +
+		"MEDIAN                                            52817.5\n" +
+		"MIN                                               28001\n" +
+		"MAX                                               77634\n" +
+		"ERRORS                                            not_found: 1"
+	assert.Equal(t, expected, str)
+
 	repos = []string{"kuberneteskubernetes", "istio/istio"}
 	_, err = run(repos)
 	assert.NotNil(t, err)
@@ -123,8 +217,39 @@ func TestRun(t *testing.T) {
 	repos = []string{}
 	str, err = run(repos)
 	assert.Nil(t, err)
-	assert.Equal(t, "Usage: stars <git-repo-1> <git-repo-2> ...\n", str)
+	assert.Equal(t, "Usage: stars [--filter <expression>] <git-repo-1> <git-repo-2> ...\n       stars compare <git-repo-1> <git-repo-2> ...\n", str)
 
 	serverURLOverride = ""
 
 }
+
+func TestSummaryFooter(t *testing.T) {
+	// nothing worked, so only the total and errors are printed
+	aggregates := map[string]interface{}{
+		"sum": float64(0), "mean": nil, "median": nil, "min": nil, "max": nil,
+		"errors": map[string]interface{}{"invalid": float64(0), "not_found": float64(2), "upstream_error": float64(1)},
+	}
+	expected := "TOTAL                                             0\n" +
+		"ERRORS                                            not_found: 2, upstream_error: 1\n"
+	assert.Equal(t, expected, summaryFooter(aggregates))
+}
+
+func TestCreateQuery(t *testing.T) {
+	assert.Equal(t, "aggregates=true", createQuery(""))
+	assert.Equal(t, "aggregates=true&filter=stars+%3E+1000+%26%26+language+%3D%3D+%22Go%22", createQuery(`stars > 1000 && language == "Go"`))
+}
+
+func TestParseArgs(t *testing.T) {
+	repos, filter, err := parseArgs([]string{"kubernetes/kubernetes", "--filter", "stars > 1000", "istio/istio"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kubernetes/kubernetes", "istio/istio"}, repos)
+	assert.Equal(t, "stars > 1000", filter)
+
+	repos, filter, err = parseArgs([]string{"--filter=!archived", "kubernetes/kubernetes"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kubernetes/kubernetes"}, repos)
+	assert.Equal(t, "!archived", filter)
+
+	_, _, err = parseArgs([]string{"kubernetes/kubernetes", "--filter"})
+	assert.EqualError(t, err, "Error: --filter needs an expression. Hint: --filter 'stars > 1000'")
+}
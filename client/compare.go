@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// a row in the compare table, pulling one metric out of each repo
+type compareRow struct {
+	label string
+	// key in the server's winners, empty if the metric doesn't have one
+	winner string
+	value  func(repo map[string]interface{}) interface{}
+}
+
+// helper to dig a value out of nested maps, nil if any step is missing
+func lookupPath(obj map[string]interface{}, path ...string) interface{} {
+	var val interface{} = obj
+	for _, key := range path {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = m[key]
+	}
+	return val
+}
+
+var compareRows = []compareRow{
+	{"STARS", "stars", func(repo map[string]interface{}) interface{} {
+		// show the error in place of the stars like the main table does
+		if repo["error"] != nil {
+			return repo["error"]
+		}
+		return repo["stars"]
+	}},
+	{"FORKS", "forks", func(repo map[string]interface{}) interface{} { return repo["forks"] }},
+	{"OPEN ISSUES", "open_issues", func(repo map[string]interface{}) interface{} { return repo["open_issues"] }},
+	{"LAST PUSH", "last_push", func(repo map[string]interface{}) interface{} { return formatDate(repo["last_push"]) }},
+	{"30 DAY STAR GROWTH", "star_growth_30d", func(repo map[string]interface{}) interface{} { return repo["star_growth_30d"] }},
+	{"LAST RELEASE", "", func(repo map[string]interface{}) interface{} {
+		return formatDate(lookupPath(repo, "releases", "last_release"))
+	}},
+	{"DAYS BETWEEN RELEASES", "release_cadence", func(repo map[string]interface{}) interface{} {
+		return lookupPath(repo, "releases", "days_between_releases")
+	}},
+	{"FORKS PER STAR", "", func(repo map[string]interface{}) interface{} { return lookupPath(repo, "ratios", "forks_per_star") }},
+	{"OPEN ISSUES PER STAR", "", func(repo map[string]interface{}) interface{} {
+		return lookupPath(repo, "ratios", "open_issues_per_star")
+	}},
+}
+
+// just the day from a timestamp
+func formatDate(val interface{}) interface{} {
+	str, ok := val.(string)
+	if !ok || len(str) < 10 {
+		return val
+	}
+	return str[:10]
+}
+
+// print a table cell, "-" for anything we don't know
+func formatCell(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "-"
+	case float64:
+		if v == float64(int64(v)) {
+			return fmt.Sprint(int64(v))
+		}
+		return fmt.Sprintf("%.2f", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// make the request to the /compare api
+func callCompare(repos []string, server string) (map[string]interface{}, error) {
+	query := url.Values{"repos": {strings.Join(repos, ",")}}
+	req, err := http.NewRequest("GET", server+"/compare?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("Error: " + strings.TrimSpace(string(msg)))
+	}
+
+	var res map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// render a comparison as a table with a column per repo and the winner at the end
+func renderComparison(res map[string]interface{}) string {
+	repos := res["repos"].([]interface{})
+	winners, _ := res["winners"].(map[string]interface{})
+
+	// header and metric rows, one cell per repo
+	table := [][]string{{"METRIC"}}
+	for _, repo := range repos {
+		table[0] = append(table[0], fmt.Sprint(repo.(map[string]interface{})["name"]))
+	}
+	table[0] = append(table[0], "WINNER")
+
+	for _, row := range compareRows {
+		line := []string{row.label}
+		for _, repo := range repos {
+			line = append(line, formatCell(row.value(repo.(map[string]interface{}))))
+		}
+
+		winner := "-"
+		if row.winner != "" && winners[row.winner] != nil {
+			winner = fmt.Sprint(winners[row.winner])
+		}
+		table = append(table, append(line, winner))
+	}
+
+	// every column is as wide as its longest cell
+	widths := make([]int, len(table[0]))
+	for _, line := range table {
+		for i, cell := range line {
+			if len(cell)+2 > widths[i] {
+				widths[i] = len(cell) + 2
+			}
+		}
+	}
+
+	str := ""
+	for _, line := range table {
+		for i, cell := range line[:len(line)-1] {
+			str += fmt.Sprintf("%-*s", widths[i], cell)
+		}
+		str += line[len(line)-1] + "\n"
+	}
+
+	return strings.TrimSuffix(str, "\n")
+}
+
+// stars compare <repo> <repo> ...
+func runCompare(repos []string, server string) (string, error) {
+	if len(repos) < 2 {
+		return "Usage: stars compare <git-repo-1> <git-repo-2> ...\n", nil
+	}
+
+	err := validateRepos(repos)
+
+	if err != nil {
+		return "", err
+	}
+
+	res, err := callCompare(repos, server)
+
+	if err != nil {
+		return "", err
+	}
+
+	return renderComparison(res), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const compareResponse = `{"repos":[` +
+	`{"name":"kubernetes/kubernetes","stars":77634,"status":"ok","error":null,"forks":28000,"open_issues":2200,"last_push":"2021-06-01T10:00:00Z",` +
+	`"star_growth_30d":150,"star_growth_since":"2021-05-02T10:00:00Z","releases":{"recent_releases":100,"last_release":"2021-05-20T10:00:00Z","days_between_releases":6.5},` +
+	`"ratios":{"forks_per_star":0.3606,"open_issues_per_star":0.0283}},` +
+	`{"name":"istio/itio","stars":null,"status":"not_found","error":"Repo Not found: istio/itio","forks":null,"open_issues":null,"last_push":null,` +
+	`"star_growth_30d":null,"star_growth_since":null,"releases":null,"ratios":{"forks_per_star":null,"open_issues_per_star":null}}],` +
+	`"winners":{"stars":"kubernetes/kubernetes","forks":"kubernetes/kubernetes","open_issues":"kubernetes/kubernetes","last_push":"kubernetes/kubernetes","star_growth_30d":"kubernetes/kubernetes","release_cadence":null}}`
+
+func TestFormatCell(t *testing.T) {
+	assert.Equal(t, "-", formatCell(nil))
+	assert.Equal(t, "12", formatCell(float64(12)))
+	assert.Equal(t, "0.36", formatCell(0.3606))
+	assert.Equal(t, "2021-06-01", formatCell(formatDate("2021-06-01T10:00:00Z")))
+}
+
+func TestRunCompare(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/compare", r.URL.Path)
+		assert.Equal(t, "kubernetes/kubernetes,istio/itio", r.URL.Query().Get("repos"))
+		fmt.Fprintln(w, compareResponse)
+	}))
+	defer ts.Close()
+	serverURLOverride = ts.URL
+	defer func() { serverURLOverride = "" }()
+
+	str, err := run([]string{"compare", "kubernetes/kubernetes", "istio/itio"})
+	assert.Nil(t, err)
+	expected := "METRIC                 kubernetes/kubernetes  istio/itio                  WINNER\n" +
+		"STARS                  77634                  Repo Not found: istio/itio  kubernetes/kubernetes\n" +
+		"FORKS                  28000                  -                           kubernetes/kubernetes\n" +
+		"OPEN ISSUES            2200                   -                           kubernetes/kubernetes\n" +
+		"LAST PUSH              2021-06-01             -                           kubernetes/kubernetes\n" +
+		"30 DAY STAR GROWTH     150                    -                           kubernetes/kubernetes\n" +
+		"LAST RELEASE           2021-05-20             -                           -\n" +
+		"DAYS BETWEEN RELEASES  6.50                   -                           -\n" +
+		"FORKS PER STAR         0.36                   -                           -\n" +
+		"OPEN ISSUES PER STAR   0.03                   -                           -"
+	assert.Equal(t, expected, str)
+
+	// needs at least two repos
+	str, err = run([]string{"compare", "kubernetes/kubernetes"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Usage: stars compare <git-repo-1> <git-repo-2> ...\n", str)
+
+	_, err = run([]string{"compare", "kubernetes/kubernetes", "istio"})
+	assert.EqualError(t, err, "Error: Invalid repo name istio. Hint: <org>/<repo-name>")
+}
+
+func TestCallCompareError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Compare takes 2 to 10 repos.", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	_, err := callCompare([]string{"a/b"}, ts.URL)
+	assert.EqualError(t, err, "Error: Compare takes 2 to 10 repos.")
+}
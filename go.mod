@@ -5,6 +5,10 @@ go 1.15
 require (
 	github.com/TylerBrock/colorjson v0.0.0-20200706003622-8a50f05110d2
 	github.com/fatih/color v1.11.0 // indirect
+	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/client_golang v1.10.0
 	github.com/stretchr/testify v1.7.0
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// ---------------------------- AGGREGATES ----------------------------
+
+// percentiles reported in an aggregates block
+var aggregatePercentiles = []int{25, 50, 75, 90, 95, 99}
+
+// Statistics across every repo in a request, sent back with
+// ?aggregates=true. Star figures only count lookups that worked and
+// are null if none did
+type Aggregates struct {
+	// lookups that worked
+	Count  int      `json:"count"`
+	Sum    int      `json:"sum"`
+	Mean   *float64 `json:"mean"`
+	Median *float64 `json:"median"`
+	Min    *int     `json:"min"`
+	Max    *int     `json:"max"`
+	// ie p90, interpolated between the closest counts
+	Percentiles map[string]float64 `json:"percentiles"`
+	// failed lookups by status, ie not_found
+	Errors map[string]int `json:"errors"`
+}
+
+// helper function to check if the client asked for aggregates
+func wantAggregates(values url.Values) (bool, error) {
+	val := values.Get("aggregates")
+	if val == "" {
+		return false, nil
+	}
+
+	want, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.New("Recieved invalid aggregates: " + val + ". Hint: true or false")
+	}
+
+	return want, nil
+}
+
+// Percentile of sorted counts, interpolating linearly between the two
+// closest ranks the same way spreadsheets do
+func percentile(sorted []int, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+	return float64(sorted[lower]) + weight*float64(sorted[upper]-sorted[lower])
+}
+
+// work out the aggregates for a set of lookups
+func aggregate(results []repoResult) *Aggregates {
+	agg := &Aggregates{
+		Percentiles: make(map[string]float64),
+		Errors: map[string]int{
+			StatusInvalid:       0,
+			StatusNotFound:      0,
+			StatusUpstreamError: 0,
+		},
+	}
+
+	stars := make([]int, 0, len(results))
+	for _, res := range results {
+		if res.Err != nil {
+			agg.Errors[lookupStatus(res.Err)]++
+			continue
+		}
+		stars = append(stars, res.Stars)
+		agg.Sum += res.Stars
+	}
+
+	agg.Count = len(stars)
+	if agg.Count == 0 {
+		return agg
+	}
+
+	sort.Ints(stars)
+
+	mean := float64(agg.Sum) / float64(agg.Count)
+	median := percentile(stars, 50)
+	min := stars[0]
+	max := stars[len(stars)-1]
+
+	agg.Mean = &mean
+	agg.Median = &median
+	agg.Min = &min
+	agg.Max = &max
+
+	for _, p := range aggregatePercentiles {
+		agg.Percentiles["p"+strconv.Itoa(p)] = percentile(stars, float64(p))
+	}
+
+	return agg
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWantAggregates(t *testing.T) {
+	want, err := wantAggregates(url.Values{})
+	assert.Nil(t, err)
+	assert.False(t, want)
+
+	want, err = wantAggregates(url.Values{"aggregates": {"true"}})
+	assert.Nil(t, err)
+	assert.True(t, want)
+
+	_, err = wantAggregates(url.Values{"aggregates": {"please"}})
+	assert.EqualError(t, err, "Recieved invalid aggregates: please. Hint: true or false")
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []int{10, 20, 30, 40}
+	assert.Equal(t, 10.0, percentile(sorted, 0))
+	assert.Equal(t, 25.0, percentile(sorted, 50))
+	assert.Equal(t, 37.0, percentile(sorted, 90))
+	assert.Equal(t, 40.0, percentile(sorted, 100))
+	assert.Equal(t, 5.0, percentile([]int{5}, 99))
+}
+
+func TestAggregate(t *testing.T) {
+	agg := aggregate([]repoResult{
+		{Name: "a/a", Stars: 30},
+		{Name: "b/b", Stars: 10},
+		{Name: "c/c", Stars: -1, Err: &lookupError{StatusNotFound, errors.New("Repo Not found: c/c")}},
+		{Name: "d/d", Stars: 20},
+		{Name: "e/e", Stars: -1, Err: errors.New("connection refused")},
+	})
+
+	assert.Equal(t, 3, agg.Count)
+	assert.Equal(t, 60, agg.Sum)
+	assert.Equal(t, 20.0, *agg.Mean)
+	assert.Equal(t, 20.0, *agg.Median)
+	assert.Equal(t, 10, *agg.Min)
+	assert.Equal(t, 30, *agg.Max)
+	assert.Equal(t, map[string]float64{"p25": 15, "p50": 20, "p75": 25, "p90": 28, "p95": 29, "p99": 29.8}, agg.Percentiles)
+	assert.Equal(t, map[string]int{StatusInvalid: 0, StatusNotFound: 1, StatusUpstreamError: 1}, agg.Errors)
+
+	// nothing worked, nothing to average
+	agg = aggregate([]repoResult{{Name: "c/c", Stars: -1, Err: &lookupError{StatusNotFound, errors.New("Repo Not found: c/c")}}})
+	assert.Equal(t, 0, agg.Count)
+	assert.Nil(t, agg.Mean)
+	assert.Nil(t, agg.Median)
+	assert.Nil(t, agg.Min)
+	assert.Nil(t, agg.Max)
+	assert.Empty(t, agg.Percentiles)
+}
+
+func TestStarsHandlerAggregates(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 5}`, 200)
+	defer close()
+
+	body := []byte(`{"repos": [{"name": "rdelpret/kfx"}, {"name": "rdelpret/cartographer"}]}`)
+
+	// aggregates cover the whole request even when paging
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/stars?aggregates=true&limit=1", bytes.NewBuffer(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assertMatchesSpec(t, "POST", "/stars", recorder)
+
+	var repos Repos
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &repos))
+	assert.Len(t, repos.Repos, 1)
+	assert.Equal(t, 2, repos.Aggregates.Count)
+	assert.Equal(t, 10, repos.Aggregates.Sum)
+
+	// but only the repos that made it through the filters
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/stars?aggregates=true&min_stars=6", bytes.NewBuffer(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	repos = Repos{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &repos))
+	assert.Empty(t, repos.Repos)
+	assert.Equal(t, 0, repos.Aggregates.Count)
+	assert.Equal(t, 0, repos.Aggregates.Sum)
+
+	// left out unless asked for
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/stars", bytes.NewBuffer(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	assert.NotContains(t, recorder.Body.String(), "aggregates")
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/stars?aggregates=please", bytes.NewBuffer(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------- STAR ALERTS ----------------------------
+
+const (
+	alertMilestone  = "milestone"
+	alertDailyGains = "daily_gain"
+)
+
+const alertRuleHint = "1k, 10k, 25000 or +100/day"
+
+// A rule on a watchlist entry. A milestone fires once when the repo is
+// at or over stars, a daily gain fires at most once a day when the repo
+// gained more than stars in the last 24 hours
+type alertRule struct {
+	kind  string
+	stars int
+}
+
+// parse a count like 1000, 1k or 1m
+func parseAlertCount(val string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(val, "k"):
+		multiplier, val = 1000, strings.TrimSuffix(val, "k")
+	case strings.HasSuffix(val, "m"):
+		multiplier, val = 1000000, strings.TrimSuffix(val, "m")
+	}
+
+	// unsigned so +5 isn't taken for 5
+	count, err := strconv.ParseUint(val, 10, 31)
+	if err != nil || count == 0 {
+		return 0, errors.New("not a star count")
+	}
+	return int(count) * multiplier, nil
+}
+
+// parse a rule like 10k or +100/day
+func parseAlertRule(val string) (alertRule, error) {
+	rule := alertRule{kind: alertMilestone}
+	count := strings.TrimSpace(val)
+
+	if strings.HasPrefix(count, "+") && strings.HasSuffix(count, "/day") {
+		rule.kind = alertDailyGains
+		count = strings.TrimSuffix(strings.TrimPrefix(count, "+"), "/day")
+	}
+
+	stars, err := parseAlertCount(count)
+	if err != nil {
+		return alertRule{}, errors.New("Recieved invalid alert rule: " + val + ". Hint: " + alertRuleHint)
+	}
+	rule.stars = stars
+
+	return rule, nil
+}
+
+// rules read and write the way they are parsed, ie 10000 or +100/day
+func (r alertRule) String() string {
+	if r.kind == alertDailyGains {
+		return "+" + strconv.Itoa(r.stars) + "/day"
+	}
+	return strconv.Itoa(r.stars)
+}
+
+func (r alertRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *alertRule) UnmarshalJSON(body []byte) error {
+	var val string
+	if err := json.Unmarshal(body, &val); err != nil {
+		return errors.New("Recieved invalid alert rule: " + string(body) + ". Hint: " + alertRuleHint)
+	}
+
+	rule, err := parseAlertRule(val)
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// Payload POSTed to the alert webhook when a rule fires
+type Alert struct {
+	Repo      string `json:"repo"`
+	Rule      string `json:"rule"`
+	Kind      string `json:"kind"`
+	Threshold int    `json:"threshold"`
+	Stars     int    `json:"stars"`
+	// the last count before this poll, -1 on a repo's first poll. For a
+	// daily gain the count a day ago
+	PreviousStars int       `json:"previous_stars"`
+	Time          time.Time `json:"time"`
+}
+
+// Posts alerts to a webhook receiver, signed with a shared secret
+type alertWebhook struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	url    string
+	secret string
+}
+
+func newAlertWebhook(url string, secret string) *alertWebhook {
+	return &alertWebhook{url: url, secret: secret, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// change where alerts go and how they are signed
+func (a *alertWebhook) configure(url string, secret string) {
+	a.mu.Lock()
+	a.url, a.secret = url, secret
+	a.mu.Unlock()
+}
+
+func (a *alertWebhook) target() (string, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.url, a.secret
+}
+
+// sha256=<hex hmac of the body>, the same scheme github uses
+func signAlert(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver an alert. Anything but a 2xx is an error so the caller can
+// leave the alert unfired and try again on the next poll
+func (a *alertWebhook) send(alert Alert) error {
+	url, secret := a.target()
+	if url == "" {
+		return errors.New("watchlist.alert_url not set, alert for " + alert.Repo + " not delivered")
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rainbow-Road-Event", "star.alert")
+	if secret != "" {
+		req.Header.Set("X-Rainbow-Road-Signature-256", signAlert(secret, body))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
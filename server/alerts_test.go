@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAlertRule(t *testing.T) {
+	rule, err := parseAlertRule("1k")
+	assert.Nil(t, err)
+	assert.Equal(t, alertRule{kind: alertMilestone, stars: 1000}, rule)
+	assert.Equal(t, "1000", rule.String())
+
+	rule, err = parseAlertRule("25000")
+	assert.Nil(t, err)
+	assert.Equal(t, alertRule{kind: alertMilestone, stars: 25000}, rule)
+
+	rule, err = parseAlertRule(" +100/day ")
+	assert.Nil(t, err)
+	assert.Equal(t, alertRule{kind: alertDailyGains, stars: 100}, rule)
+	assert.Equal(t, "+100/day", rule.String())
+
+	rule, err = parseAlertRule("2m")
+	assert.Nil(t, err)
+	assert.Equal(t, 2000000, rule.stars)
+
+	for _, val := range []string{"", "0", "-5", "+5", "ten", "100/day", "+k/day"} {
+		_, err := parseAlertRule(val)
+		assert.EqualError(t, err, "Recieved invalid alert rule: "+val+". Hint: 1k, 10k, 25000 or +100/day", val)
+	}
+}
+
+func TestAlertRuleJSON(t *testing.T) {
+	var rules []alertRule
+	err := json.Unmarshal([]byte(`["10k", "+50/day"]`), &rules)
+	assert.Nil(t, err)
+	assert.Equal(t, []alertRule{{kind: alertMilestone, stars: 10000}, {kind: alertDailyGains, stars: 50}}, rules)
+
+	body, err := json.Marshal(rules)
+	assert.Nil(t, err)
+	assert.Equal(t, `["10000","+50/day"]`, string(body))
+
+	err = json.Unmarshal([]byte(`[10]`), &rules)
+	assert.EqualError(t, err, "Recieved invalid alert rule: 10. Hint: 1k, 10k, 25000 or +100/day")
+}
+
+func TestSendAlert(t *testing.T) {
+
+	var received Alert
+	var signature, event string
+	code := http.StatusNoContent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-Rainbow-Road-Signature-256")
+		event = r.Header.Get("X-Rainbow-Road-Event")
+		assert.Equal(t, signAlert("secret", body), signature)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(code)
+	}))
+	defer ts.Close()
+
+	alert := Alert{Repo: "rdelpret/cartographer", Rule: "1000", Kind: alertMilestone, Threshold: 1000, Stars: 1001, PreviousStars: 999}
+
+	err := newAlertWebhook(ts.URL, "secret").send(alert)
+	assert.Nil(t, err)
+	assert.Equal(t, alert, received)
+	assert.Equal(t, "star.alert", event)
+
+	// receivers that fail leave the alert to be sent again
+	code = http.StatusInternalServerError
+	err = newAlertWebhook(ts.URL, "secret").send(alert)
+	assert.EqualError(t, err, "alert webhook returned 500")
+
+	// and so does not having anywhere to send it
+	err = newAlertWebhook("", "").send(alert)
+	assert.EqualError(t, err, "watchlist.alert_url not set, alert for rdelpret/cartographer not delivered")
+}
+
+func TestSignAlert(t *testing.T) {
+	// known value from the github webhook docs
+	assert.Equal(t,
+		"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+		signAlert("It's a Secret to Everybody", []byte("Hello, World!")))
+}
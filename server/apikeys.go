@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------ API KEYS ------------------------------
+
+// What a key is allowed to do
+const (
+	scopeRead  = "read"
+	scopeJobs  = "jobs"
+	scopeAdmin = "admin"
+)
+
+var scopes = []string{scopeRead, scopeJobs, scopeAdmin}
+
+const (
+	apiKeyPrefix   = "apikeys/"
+	apiUsagePrefix = "apikeys-usage/"
+)
+
+// An API key. Only a hash of the key is kept, the key itself is shown
+// once when it is minted
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	DailyQuota int        `json:"daily_quota"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Hash       string     `json:"hash,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	UsedToday  *int       `json:"used_today,omitempty"`
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// copy of a key that is safe to hand to a client
+func (k APIKey) public() APIKey {
+	k.Hash = ""
+	return k
+}
+
+// replaced in main once the config is loaded
+var authConfig = defaultConfig().auth
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Make a new key and keep its hash. Keys look like rr_<id>_<secret> so
+// we can find the stored hash without scanning every key
+func mintAPIKey(name string, keyScopes []string, quota int) (*APIKey, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		Scopes:     keyScopes,
+		DailyQuota: quota,
+		CreatedAt:  time.Now().UTC(),
+	}
+	key.Key = "rr_" + key.ID + "_" + hex.EncodeToString(secret)
+	key.Hash = hashAPIKey(key.Key)
+
+	stored := *key
+	stored.Key = ""
+	body, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Put(apiKeyPrefix+key.ID, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// a stored key by id, nil if there isn't one
+func getAPIKey(id string) (*APIKey, error) {
+	body, ok, err := store.Get(apiKeyPrefix + id)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var key APIKey
+	err = json.Unmarshal(body, &key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// every stored key, oldest first
+func listAPIKeys() ([]APIKey, error) {
+	entries, err := store.List(apiKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, 0, len(entries))
+	for _, body := range entries {
+		var key APIKey
+		err = json.Unmarshal(body, &key)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+// Revoke a key. It stays in the store so it still shows up in the list.
+// Returns nil if there is no such key
+func revokeAPIKey(id string) (*APIKey, error) {
+	key, err := getAPIKey(id)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+
+		body, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+
+		err = store.Put(apiKeyPrefix+id, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// the stored key a client sent, nil if it is unknown, revoked or wrong
+func lookupAPIKey(token string) *APIKey {
+	parts := strings.Split(token, "_")
+	if len(parts) != 3 || parts[0] != "rr" {
+		return nil
+	}
+
+	key, err := getAPIKey(parts[1])
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	if key == nil || key.RevokedAt != nil {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(key.Hash)) != 1 {
+		return nil
+	}
+
+	return key
+}
+
+// -------------------------------- AUTH --------------------------------
+
+// Who is making a request. A nil key means the admin key or an admin
+// client cert, which can do anything and has no quota
+type caller struct {
+	name string
+	key  *APIKey
+}
+
+func (c *caller) can(scope string) bool {
+	return c.key == nil || c.key.hasScope(scope)
+}
+
+type callerKey struct{}
+
+func withCaller(ctx context.Context, c *caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// the caller a request was authenticated as, nil when auth is off
+func callerFrom(ctx context.Context) *caller {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(callerKey{}).(*caller)
+	return c
+}
+
+// Work out who is calling from an Authorization header and the client
+// cert identity. A bearer token wins over the cert, a bad token is never
+// rescued by one. Returns nil if the caller is unknown
+func authenticate(auth authSettings, header string, identity string) *caller {
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		token := strings.TrimSpace(header[7:])
+
+		if auth.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(auth.adminKey)) == 1 {
+			return &caller{name: "admin"}
+		}
+
+		if key := lookupAPIKey(token); key != nil {
+			return &caller{name: key.Name, key: key}
+		}
+
+		return nil
+	}
+
+	if identity != "" {
+		for _, client := range auth.adminClients {
+			if client == identity {
+				return &caller{name: identity}
+			}
+		}
+	}
+
+	return nil
+}
+
+const missingKeyMessage = "Missing or invalid API key. Hint: send one as Authorization: Bearer <key>"
+
+// Only let callers with a scope through to a route. Does nothing when
+// auth is off so the server works out of the box
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := currentAuth()
+		if !auth.enabled {
+			next(w, r)
+			return
+		}
+
+		c := authenticate(auth, r.Header.Get("Authorization"), clientIdentity(r))
+
+		if c == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rainbow-road"`)
+			http.Error(w, missingKeyMessage, http.StatusUnauthorized)
+			return
+		}
+
+		if !c.can(scope) {
+			http.Error(w, "API key is missing the "+scope+" scope.", http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(withCaller(r.Context(), c)))
+	}
+}
+
+// ------------------------------- QUOTAS -------------------------------
+
+// returned when a key has used up its upstream calls for the day
+type quotaExceededError struct {
+	limit int
+	reset time.Time
+}
+
+func (e *quotaExceededError) Error() string {
+	return "Daily quota of " + strconv.Itoa(e.limit) + " upstream calls used up. Resets at " + e.reset.Format(time.RFC3339)
+}
+
+// usage is read, checked and written back in one go
+var quotaMu sync.Mutex
+
+func usageKey(id string, day time.Time) string {
+	return apiUsagePrefix + id + "/" + day.Format("2006-01-02")
+}
+
+// upstream calls a key has made today
+func usedToday(id string) int {
+	body, ok, err := store.Get(usageKey(id, time.Now().UTC()))
+	if err != nil || !ok {
+		return 0
+	}
+	used, _ := strconv.Atoi(string(body))
+	return used
+}
+
+// Count calls against the caller's daily quota, refusing the lot if they
+// don't all fit. Returns what is left of the quota and the quota itself,
+// both -1 when the caller has no quota. Days are UTC
+func chargeQuota(ctx context.Context, calls int) (int, int, error) {
+	c := callerFrom(ctx)
+	if c == nil || c.key == nil {
+		return -1, -1, nil
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	now := time.Now().UTC()
+	key := usageKey(c.key.ID, now)
+	limit := c.key.DailyQuota
+
+	body, ok, err := store.Get(key)
+	if err != nil {
+		// a broken store shouldn't take the api down with it
+		log.Println(err)
+		return -1, -1, nil
+	}
+
+	used := 0
+	if ok {
+		used, _ = strconv.Atoi(string(body))
+	} else {
+		// first call of the day, forget the old days
+		old, _ := store.List(apiUsagePrefix + c.key.ID + "/")
+		for oldKey := range old {
+			store.Delete(oldKey)
+		}
+	}
+
+	if used+calls > limit {
+		reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return limit - used, limit, &quotaExceededError{limit: limit, reset: reset}
+	}
+
+	used += calls
+	err = store.Put(key, []byte(strconv.Itoa(used)))
+	if err != nil {
+		log.Println(err)
+	}
+
+	return limit - used, limit, nil
+}
+
+// Charge a request's upstream calls, answering the client ourselves if
+// the quota is used up. Returns false if the request was rejected
+func chargeRequest(w http.ResponseWriter, r *http.Request, calls int) bool {
+	remaining, limit, err := chargeQuota(r.Context(), calls)
+
+	if limit >= 0 {
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-Quota-Limit", strconv.Itoa(limit))
+		w.Header().Set("X-Quota-Remaining", strconv.Itoa(remaining))
+	}
+
+	if err != nil {
+		writeRequestError(w, err)
+		return false
+	}
+
+	return true
+}
+
+// ---------------------------- ADMIN ROUTES ----------------------------
+
+// body of a POST /keys
+type mintRequest struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	DailyQuota *int     `json:"daily_quota"`
+}
+
+// check a mint request, filling in the defaults
+func (req *mintRequest) validate(defaultQuota int) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.New(`Missing key name. Hint: {"name": "ci", "scopes": ["read"]}`)
+	}
+
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{scopeRead}
+	}
+
+	for _, scope := range req.Scopes {
+		known := false
+		for _, s := range scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return errors.New("Recieved invalid scope: " + scope + ". Hint: " + strings.Join(scopes, ", "))
+		}
+	}
+
+	if req.DailyQuota == nil {
+		req.DailyQuota = &defaultQuota
+	}
+
+	if *req.DailyQuota <= 0 {
+		return errors.New("Recieved invalid daily_quota: " + strconv.Itoa(*req.DailyQuota) + ". Hint: a whole number above 0")
+	}
+
+	return nil
+}
+
+// HTTP route to list or mint API keys
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /keys route
+	if r.URL.Path != "/keys" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		keys, err := listAPIKeys()
+
+		if err != nil {
+			http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		for i := range keys {
+			used := usedToday(keys[i].ID)
+			keys[i] = keys[i].public()
+			keys[i].UsedToday = &used
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]APIKey{"keys": keys})
+	case "POST":
+		var req mintRequest
+		dec := json.NewDecoder(newLimitedBody(r.Body))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&req)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+
+		err = req.validate(currentAuth().defaultQuota)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key, err := mintAPIKey(strings.TrimSpace(req.Name), req.Scopes, *req.DailyQuota)
+
+		if err != nil {
+			http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		log.Printf("Minted API key %s (%s) with scopes %s", key.ID, key.Name, strings.Join(key.Scopes, ","))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/keys/"+key.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(key.public())
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
+
+// HTTP route to look at or revoke a key, ie DELETE /keys/{id}
+func keyHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /keys/ routes
+	if !strings.HasPrefix(r.URL.Path, "/keys/") {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/keys/")
+
+	var key *APIKey
+	var err error
+
+	switch r.Method {
+	case "GET":
+		key, err = getAPIKey(id)
+	case "DELETE":
+		key, err = revokeAPIKey(id)
+		if key != nil {
+			log.Printf("Revoked API key %s (%s)", key.ID, key.Name)
+		}
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if key == nil {
+		http.Error(w, "API key not found.", http.StatusNotFound)
+		return
+	}
+
+	used := usedToday(key.ID)
+	res := key.public()
+	res.UsedToday = &used
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
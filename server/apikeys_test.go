@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"rdelpret/rainbow-road/server/starspb"
+)
+
+// helper to turn auth on for a test, returns a func to turn it back off
+func enableAuth(auth authSettings) func() {
+	settingsMu.Lock()
+	old := authConfig
+	auth.enabled = true
+	authConfig = auth
+	settingsMu.Unlock()
+
+	return func() {
+		settingsMu.Lock()
+		authConfig = old
+		settingsMu.Unlock()
+	}
+}
+
+// helper to make a request with a bearer token
+func authedRequest(method string, target string, body string, key string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return req
+}
+
+func TestAPIKeys(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	key, err := mintAPIKey("ci", []string{scopeRead}, 10)
+	assert.Nil(t, err)
+	assert.Regexp(t, "^rr_[0-9a-f]{12}_[0-9a-f]{64}$", key.Key)
+
+	// only the hash is stored
+	body, ok, _ := store.Get(apiKeyPrefix + key.ID)
+	assert.True(t, ok)
+	assert.NotContains(t, string(body), key.Key)
+	assert.Contains(t, string(body), hashAPIKey(key.Key))
+
+	found := lookupAPIKey(key.Key)
+	assert.NotNil(t, found)
+	assert.Equal(t, "ci", found.Name)
+	assert.Equal(t, "", found.Key)
+
+	// the right id with the wrong secret, or junk
+	assert.Nil(t, lookupAPIKey("rr_"+key.ID+"_"+string(bytes.Repeat([]byte("0"), 64))))
+	assert.Nil(t, lookupAPIKey("nope"))
+	assert.Nil(t, lookupAPIKey("rr_nope_nope"))
+
+	keys, err := listAPIKeys()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	revoked, err := revokeAPIKey(key.ID)
+	assert.Nil(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	assert.Nil(t, lookupAPIKey(key.Key))
+
+	// revoked keys still show up
+	keys, _ = listAPIKeys()
+	assert.Len(t, keys, 1)
+
+	revoked, err = revokeAPIKey("nope")
+	assert.Nil(t, err)
+	assert.Nil(t, revoked)
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	key, _ := mintAPIKey("ci", []string{scopeRead}, 10)
+	auth := authSettings{adminKey: "admin-secret", adminClients: []string{"spiffe://cluster/ops"}}
+
+	c := authenticate(auth, "Bearer admin-secret", "")
+	assert.Equal(t, "admin", c.name)
+	assert.True(t, c.can(scopeAdmin))
+
+	c = authenticate(auth, "bearer "+key.Key, "")
+	assert.Equal(t, "ci", c.name)
+	assert.True(t, c.can(scopeRead))
+	assert.False(t, c.can(scopeJobs))
+
+	c = authenticate(auth, "", "spiffe://cluster/ops")
+	assert.Equal(t, "spiffe://cluster/ops", c.name)
+	assert.True(t, c.can(scopeAdmin))
+
+	// a bad key isn't rescued by a good cert
+	assert.Nil(t, authenticate(auth, "Bearer wrong", "spiffe://cluster/ops"))
+	assert.Nil(t, authenticate(auth, "", "spiffe://cluster/other"))
+	assert.Nil(t, authenticate(auth, "Basic YWRtaW4=", ""))
+	assert.Nil(t, authenticate(authSettings{}, "Bearer ", ""))
+}
+
+func TestRequireScope(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	var seen *caller
+	handler := requireScope(scopeJobs, func(w http.ResponseWriter, r *http.Request) {
+		seen = callerFrom(r.Context())
+	})
+
+	// off by default
+	rr := httptest.NewRecorder()
+	handler(rr, authedRequest("GET", "/jobs", "", ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, seen)
+
+	defer enableAuth(authSettings{adminKey: "admin-secret"})()
+
+	rr = httptest.NewRecorder()
+	handler(rr, authedRequest("GET", "/jobs", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Bearer realm="rainbow-road"`, rr.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, missingKeyMessage+"\n", rr.Body.String())
+
+	reader, _ := mintAPIKey("reader", []string{scopeRead}, 10)
+	rr = httptest.NewRecorder()
+	handler(rr, authedRequest("GET", "/jobs", "", reader.Key))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "API key is missing the jobs scope.\n", rr.Body.String())
+
+	worker, _ := mintAPIKey("worker", []string{scopeRead, scopeJobs}, 10)
+	rr = httptest.NewRecorder()
+	handler(rr, authedRequest("GET", "/jobs", "", worker.Key))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "worker", seen.name)
+}
+
+func TestChargeQuota(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	// no caller, no quota
+	remaining, limit, err := chargeQuota(context.Background(), 100)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, remaining)
+	assert.Equal(t, -1, limit)
+
+	// the admin key has no quota either
+	remaining, _, err = chargeQuota(withCaller(context.Background(), &caller{name: "admin"}), 100)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, remaining)
+
+	key, _ := mintAPIKey("ci", []string{scopeRead}, 5)
+	ctx := withCaller(context.Background(), &caller{name: "ci", key: key})
+
+	// yesterday's usage is cleared out on the first call of the day
+	yesterday := usageKey(key.ID, time.Now().UTC().AddDate(0, 0, -1))
+	store.Put(yesterday, []byte("5"))
+
+	remaining, limit, err = chargeQuota(ctx, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, remaining)
+	assert.Equal(t, 5, limit)
+	assert.Equal(t, 3, usedToday(key.ID))
+	_, ok, _ := store.Get(yesterday)
+	assert.False(t, ok)
+
+	// all or nothing
+	remaining, _, err = chargeQuota(ctx, 3)
+	assert.IsType(t, &quotaExceededError{}, err)
+	assert.Regexp(t, "^Daily quota of 5 upstream calls used up. Resets at .*T00:00:00Z$", err.Error())
+	assert.Equal(t, 2, remaining)
+	assert.Equal(t, 3, usedToday(key.ID))
+
+	remaining, _, err = chargeQuota(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, remaining)
+}
+
+func TestQuotaOnRoutes(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	closeMock := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer closeMock()
+
+	defer enableAuth(authSettings{})()
+
+	key, _ := mintAPIKey("ci", []string{scopeRead}, 3)
+	handler := requireScope(scopeRead, starsV2Handler)
+
+	body := `{"repos": [{"name": "rdelpret/cartographer"}, {"name": "rdelpret/kfx"}]}`
+	rr := httptest.NewRecorder()
+	handler(rr, authedRequest("POST", "/v2/stars", body, key.Key))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "3", rr.Header().Get("X-Quota-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("X-Quota-Remaining"))
+
+	// two more don't fit
+	rr = httptest.NewRecorder()
+	handler(rr, authedRequest("POST", "/v2/stars", body, key.Key))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-Quota-Remaining"))
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), "Daily quota of 3 upstream calls used up")
+
+	// a fresh cached repo doesn't count
+	cache.record("rdelpret/kfx", 1, false)
+	repo := requireScope(scopeRead, repoHandler)
+	rr = httptest.NewRecorder()
+	repo(rr, authedRequest("GET", "/repos/rdelpret/kfx", "", key.Key))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 2, usedToday(key.ID))
+
+	// neither does a name that can't be a repo
+	rr = httptest.NewRecorder()
+	repo(rr, authedRequest("GET", "/repos/invalid", "", key.Key))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, 2, usedToday(key.ID))
+
+	// streams are charged once for the whole body, or not at all
+	stream := func(body string) *httptest.ResponseRecorder {
+		req := authedRequest("POST", "/v2/stars", body, key.Key)
+		req.Header.Set("Accept", "application/x-ndjson")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	rr = stream(body)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-Quota-Remaining"))
+	assert.Equal(t, 2, usedToday(key.ID))
+
+	rr = stream(`{"repos": [{"name": "rdelpret/kfx"}, {"name": ""}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, 2, usedToday(key.ID))
+
+	rr = stream(`{"repos": [{"name": "rdelpret/kfx"}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "0", rr.Header().Get("X-Quota-Remaining"))
+	assert.Contains(t, rr.Body.String(), `"stars":1`)
+	assert.Equal(t, 3, usedToday(key.ID))
+}
+
+func TestGRPCAuth(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	closeMock := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer closeMock()
+
+	defer enableAuth(authSettings{})()
+
+	conn, closeConn := dialGRPC(t)
+	defer closeConn()
+
+	client := starspb.NewStarsClient(conn)
+	req := &starspb.GetStarsRequest{Repos: []string{"rdelpret/cartographer"}}
+
+	_, err := client.GetStars(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	key, _ := mintAPIKey("ci", []string{scopeJobs}, 1)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key.Key)
+	_, err = client.GetStars(ctx, req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	key, _ = mintAPIKey("ci", []string{scopeRead}, 1)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key.Key)
+	res, err := client.GetStars(ctx, req)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Repos[0].Stars)
+
+	_, err = client.GetStars(ctx, req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// streams are checked too
+	stream, err := client.StreamStars(context.Background(), req)
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestKeyHandlers(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	// mint with the defaults
+	rr := httptest.NewRecorder()
+	keysHandler(rr, authedRequest("POST", "/keys", `{"name": "ci"}`, ""))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var minted APIKey
+	json.NewDecoder(rr.Body).Decode(&minted)
+	assert.Equal(t, "/keys/"+minted.ID, rr.Header().Get("Location"))
+	assert.Equal(t, []string{scopeRead}, minted.Scopes)
+	assert.Equal(t, 10000, minted.DailyQuota)
+	assert.NotEmpty(t, minted.Key)
+	assert.Empty(t, minted.Hash)
+
+	for body, msg := range map[string]string{
+		`{"scopes": ["read"]}`:                   `Missing key name. Hint: {"name": "ci", "scopes": ["read"]}`,
+		`{"name": "ci", "scopes": ["write"]}`:    "Recieved invalid scope: write. Hint: read, jobs, admin",
+		`{"name": "ci", "daily_quota": 0}`:       "Recieved invalid daily_quota: 0. Hint: a whole number above 0",
+		`{"name": "ci", "unknown": true}`:        "Malformed Request.",
+		`{"name": "ci", "scopes": "read,admin"}`: "Malformed Request.",
+	} {
+		rr = httptest.NewRecorder()
+		keysHandler(rr, authedRequest("POST", "/keys", body, ""))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Equal(t, msg+"\n", rr.Body.String(), body)
+	}
+
+	// listing never shows the key or its hash
+	rr = httptest.NewRecorder()
+	keysHandler(rr, authedRequest("GET", "/keys", "", ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), minted.Key)
+	assert.NotContains(t, rr.Body.String(), hashAPIKey(minted.Key))
+	assert.Contains(t, rr.Body.String(), `"used_today":0`)
+
+	rr = httptest.NewRecorder()
+	keyHandler(rr, authedRequest("DELETE", "/keys/"+minted.ID, "", ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"revoked_at":"`)
+	assert.NotContains(t, rr.Body.String(), "hash")
+
+	rr = httptest.NewRecorder()
+	keyHandler(rr, authedRequest("GET", "/keys/nope", "", ""))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "API key not found.\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	keyHandler(rr, authedRequest("PUT", "/keys/"+minted.ID, "", ""))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "Method is not supported.\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	keysHandler(rr, authedRequest("GET", "/keys/extra", "", ""))
+	assert.Equal(t, "404 not found.\n", rr.Body.String())
+}
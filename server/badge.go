@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ------------------------------ BADGES ------------------------------
+
+// default badge colour, shields.io's blue
+const defaultBadgeColor = "#007ec6"
+
+// text shown when we couldn't get a count
+const badgeErrorMessage = "unavailable"
+
+// the named colours shields.io supports
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"grey":        "#555",
+	"gray":        "#555",
+	"lightgrey":   "#9f9f9f",
+	"lightgray":   "#9f9f9f",
+}
+
+var hexColor = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Rough widths of Verdana 11px characters, which is what shields.io
+// measures with. Anything not listed is treated as a wide character
+var badgeCharWidths = map[rune]float64{
+	' ': 3.9, '.': 3.9, ',': 3.9, ':': 4.5, '-': 4.9, '_': 7.0, '/': 5.9,
+	'0': 7.0, '1': 7.0, '2': 7.0, '3': 7.0, '4': 7.0, '5': 7.0, '6': 7.0, '7': 7.0, '8': 7.0, '9': 7.0,
+	'a': 6.7, 'b': 7.0, 'c': 5.8, 'd': 7.0, 'e': 6.6, 'f': 3.9, 'g': 7.0, 'h': 7.1, 'i': 3.0,
+	'j': 3.8, 'k': 6.6, 'l': 3.0, 'm': 10.9, 'n': 7.1, 'o': 6.7, 'p': 7.0, 'q': 7.0, 'r': 4.7,
+	's': 5.7, 't': 4.4, 'u': 7.1, 'v': 6.5, 'w': 9.0, 'x': 6.5, 'y': 6.5, 'z': 5.8,
+	'A': 7.5, 'B': 7.5, 'C': 7.7, 'D': 8.5, 'E': 7.0, 'F': 6.3, 'G': 8.5, 'H': 8.3, 'I': 4.6,
+	'J': 5.0, 'K': 7.6, 'L': 6.1, 'M': 9.3, 'N': 8.2, 'O': 8.7, 'P': 6.6, 'Q': 8.7, 'R': 7.7,
+	'S': 7.5, 'T': 6.8, 'U': 8.1, 'V': 7.5, 'W': 10.9, 'X': 7.5, 'Y': 6.8, 'Z': 7.5,
+}
+
+// How a badge should look, read from the query string, ie
+// /badge/kubernetes/kubernetes.svg?style=flat-square&color=green&label=stars
+type badgeOptions struct {
+	// flat, flat-square or for-the-badge
+	style string
+	color string
+	label string
+}
+
+// helper function to read a colour name or hex code
+func parseBadgeColor(val string) (string, error) {
+	if color, ok := badgeColors[strings.ToLower(val)]; ok {
+		return color, nil
+	}
+	if hexColor.MatchString(val) {
+		return "#" + strings.TrimPrefix(val, "#"), nil
+	}
+	return "", errors.New("Recieved invalid color: " + val + ". Hint: a name like brightgreen or a hex code like 4c1")
+}
+
+// Read how the client wants the badge to look. Both spellings of colour work
+func parseBadgeOptions(r *http.Request) (badgeOptions, error) {
+	values := r.URL.Query()
+	opts := badgeOptions{style: "flat", color: defaultBadgeColor, label: "stars"}
+
+	if style := values.Get("style"); style != "" {
+		switch style {
+		case "flat", "flat-square", "for-the-badge":
+			opts.style = style
+		default:
+			return opts, errors.New("Recieved invalid style: " + style + ". Hint: flat, flat-square or for-the-badge")
+		}
+	}
+
+	val := values.Get("color")
+	if val == "" {
+		val = values.Get("colour")
+	}
+	if val != "" {
+		color, err := parseBadgeColor(val)
+		if err != nil {
+			return opts, err
+		}
+		opts.color = color
+	}
+
+	if _, ok := values["label"]; ok {
+		opts.label = values.Get("label")
+	}
+
+	return opts, nil
+}
+
+// Format a count the way shields.io does, ie 77649 is 77.6k
+func compactCount(count int) string {
+	units := []string{"", "k", "M", "B"}
+
+	val := float64(count)
+	unit := 0
+	for val >= 1000 && unit < len(units)-1 {
+		val /= 1000
+		unit++
+	}
+
+	if unit == 0 {
+		return strconv.Itoa(count)
+	}
+
+	formatted := strconv.FormatFloat(val, 'f', 1, 64)
+
+	// 999.95k rounds to 1000.0k, which should be 1M
+	if formatted == "1000.0" && unit < len(units)-1 {
+		formatted = "1.0"
+		unit++
+	}
+
+	return strings.TrimSuffix(formatted, ".0") + units[unit]
+}
+
+// estimate how wide some text is in pixels
+func textWidth(text string) float64 {
+	width := 0.0
+	for _, c := range text {
+		if w, ok := badgeCharWidths[c]; ok {
+			width += w
+		} else {
+			width += 8.0
+		}
+	}
+	return width
+}
+
+// Draw a badge as svg. Each half is padded around its text and the
+// label half is left out when the label is empty
+func renderBadge(label string, message string, color string, style string) []byte {
+	padding, height, fontSize := 10, 20, 11
+	if style == "for-the-badge" {
+		label, message = strings.ToUpper(label), strings.ToUpper(message)
+		padding, height, fontSize = 18, 28, 10
+	}
+
+	labelWidth := 0
+	if label != "" {
+		labelWidth = int(textWidth(label)) + padding
+	}
+	messageWidth := int(textWidth(message)) + padding
+	width := labelWidth + messageWidth
+
+	radius := 3
+	if style != "flat" {
+		radius = 0
+	}
+
+	esc := html.EscapeString
+	textY := height/2 + 4
+
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img" aria-label="%s">`, width, height, esc(strings.TrimSpace(label+": "+message)))
+	fmt.Fprintf(&svg, `<title>%s</title>`, esc(strings.TrimSpace(label+": "+message)))
+
+	if style == "flat" {
+		svg.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	}
+
+	fmt.Fprintf(&svg, `<clipPath id="r"><rect width="%d" height="%d" rx="%d" fill="#fff"/></clipPath>`, width, height, radius)
+	svg.WriteString(`<g clip-path="url(#r)">`)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#555"/>`, labelWidth, height)
+	fmt.Fprintf(&svg, `<rect x="%d" width="%d" height="%d" fill="%s"/>`, labelWidth, messageWidth, height, color)
+	if style == "flat" {
+		fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="url(#s)"/>`, width, height)
+	}
+	svg.WriteString(`</g>`)
+
+	fmt.Fprintf(&svg, `<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="%d">`, fontSize)
+	if label != "" {
+		fmt.Fprintf(&svg, `<text x="%d" y="%d">%s</text>`, labelWidth/2, textY, esc(label))
+	}
+	fmt.Fprintf(&svg, `<text x="%d" y="%d">%s</text>`, labelWidth+messageWidth/2, textY, esc(message))
+	svg.WriteString(`</g></svg>`)
+
+	return svg.Bytes()
+}
+
+// HTTP route to get a star count badge, ie GET /badge/kubernetes/kubernetes.svg
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /badge/ routes
+	if !strings.HasPrefix(r.URL.Path, "/badge/") || !strings.HasSuffix(r.URL.Path, ".svg") {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	opts, err := parseBadgeOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/badge/"), ".svg")
+
+	repo, fetchedAt := lookupOpenRepo(name)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+
+	// Errors still get a badge and a 200, image proxies drop anything
+	// else and the README would show a broken image
+	if repo.Stars == -1 {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(renderBadge(opts.label, badgeErrorMessage, badgeColors["lightgrey"], opts.style))
+		return
+	}
+
+	writeCacheable(w, r, renderBadge(opts.label, compactCount(repo.Stars), opts.color, opts.style), fetchedAt)
+}
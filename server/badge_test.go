@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactCount(t *testing.T) {
+	assert.Equal(t, "0", compactCount(0))
+	assert.Equal(t, "999", compactCount(999))
+	assert.Equal(t, "1k", compactCount(1000))
+	assert.Equal(t, "77.6k", compactCount(77649))
+	assert.Equal(t, "1M", compactCount(999999))
+	assert.Equal(t, "1.5M", compactCount(1500000))
+	assert.Equal(t, "2B", compactCount(2000000000))
+}
+
+func TestParseBadgeColor(t *testing.T) {
+	color, err := parseBadgeColor("brightgreen")
+	assert.Nil(t, err)
+	assert.Equal(t, "#4c1", color)
+
+	color, err = parseBadgeColor("ff69b4")
+	assert.Nil(t, err)
+	assert.Equal(t, "#ff69b4", color)
+
+	color, err = parseBadgeColor("#abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "#abc", color)
+
+	_, err = parseBadgeColor("zzz")
+	assert.EqualError(t, err, "Recieved invalid color: zzz. Hint: a name like brightgreen or a hex code like 4c1")
+}
+
+func TestRenderBadge(t *testing.T) {
+	svg := string(renderBadge("stars", "77.6k", "#4c1", "flat"))
+	assert.Contains(t, svg, `aria-label="stars: 77.6k"`)
+	assert.Contains(t, svg, `fill="#4c1"`)
+	assert.Contains(t, svg, `rx="3"`)
+	assert.Contains(t, svg, `linearGradient`)
+
+	svg = string(renderBadge("stars", "1k", "#4c1", "flat-square"))
+	assert.Contains(t, svg, `rx="0"`)
+	assert.NotContains(t, svg, `linearGradient`)
+
+	svg = string(renderBadge("stars", "1k", "#4c1", "for-the-badge"))
+	assert.Contains(t, svg, `>STARS</text>`)
+	assert.Contains(t, svg, `height="28"`)
+
+	// labels are escaped
+	svg = string(renderBadge("<a&b>", "1", "#4c1", "flat"))
+	assert.Contains(t, svg, "&lt;a&amp;b&gt;")
+	assert.NotContains(t, svg, "<a&b>")
+
+	// longer text makes a wider badge
+	assert.True(t, textWidth("1.5M") > textWidth("1k"))
+}
+
+func TestBadgeHandler(t *testing.T) {
+
+	resetCache()
+
+	close := mockGithubAPI(`{"stargazers_count" : 77649}`, 200)
+	defer close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		http.HandlerFunc(badgeHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// test happy path
+	recorder := get("/badge/rdelpret/cartographer.svg?style=flat-square&colour=green&label=likes")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/svg+xml", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `aria-label="likes: 77.6k"`)
+	assert.Contains(t, recorder.Body.String(), `fill="#97ca00"`)
+	assert.Regexp(t, `^max-age=\d+$`, recorder.Header().Get("Cache-Control"))
+
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// matching etag gets a 304 with no body
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/badge/rdelpret/cartographer.svg?style=flat-square&colour=green&label=likes", nil)
+	req.Header.Set("If-None-Match", etag)
+	http.HandlerFunc(badgeHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, "", recorder.Body.String())
+
+	// bad options
+	recorder = get("/badge/rdelpret/cartographer.svg?style=round")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Recieved invalid style: round. Hint: flat, flat-square or for-the-badge\n", recorder.Body.String())
+
+	recorder = get("/badge/rdelpret/cartographer.svg?color=nope")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// errors still get a badge but are not cached
+	mockGithubAPI(`{}`, 404)
+	recorder = get("/badge/rdelpret/missing.svg")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `aria-label="stars: unavailable"`)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, "", recorder.Header().Get("ETag"))
+
+	// with auth on only cached counts are served, nothing goes upstream
+	defer enableAuth(authSettings{})()
+	mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	recorder = get("/badge/rdelpret/kfx.svg")
+	assert.Contains(t, recorder.Body.String(), `aria-label="stars: unavailable"`)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	_, ok := cache.get("rdelpret/kfx")
+	assert.False(t, ok)
+
+	cache.record("rdelpret/kfx", 5, false)
+	recorder = get("/badge/rdelpret/kfx.svg")
+	assert.Contains(t, recorder.Body.String(), `aria-label="stars: 5"`)
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/badge/rdelpret/cartographer.svg", nil)
+	http.HandlerFunc(badgeHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = get("/badge/rdelpret/cartographer.png")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
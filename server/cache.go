@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------- STAR CACHE ----------------------------
+
+// a star count we saw for a repo and when we saw it
+type starObservation struct {
+	Stars     int       `json:"stars"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// how many samples we keep per repo
+var historySize = 1000
+
+// how often a count is sampled into the history. With historySize that
+// is about 41 days, enough for star_growth_30d
+var historyInterval = time.Hour
+
+// star history is kept in the store under history/<repo>
+const historyPrefix = "history/"
+
+// Keeps every star count the server has learned about, either from a
+// lookup or an inbound webhook, so we can tell when a count changes.
+//
+// The latest count is kept in memory for serving. The history behind
+// /compare and /chart is kept in memory too once a repo has been read,
+// and written through to the store so it survives restarts. It gets a
+// sample at most every historyInterval from lookups, a busy repo changes
+// on nearly every lookup, and on every webhook since those are changes
+type starCache struct {
+	mu        sync.RWMutex
+	latest    map[string]starObservation
+	histories map[string]*repoHistory
+}
+
+// One repo's history. Its own lock keeps store reads and writes for one
+// repo from holding up lookups of every other repo
+type repoHistory struct {
+	mu      sync.Mutex
+	loaded  bool
+	samples []starObservation
+}
+
+func newStarCache() *starCache {
+	return &starCache{latest: make(map[string]starObservation), histories: make(map[string]*repoHistory)}
+}
+
+// github names are case insensitive so the cache is too
+func cacheKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func historyKey(name string) string {
+	return historyPrefix + cacheKey(name)
+}
+
+// read a repo's history from the store, oldest first
+func loadHistory(name string) []starObservation {
+	body, ok, err := store.Get(historyKey(name))
+	if err != nil {
+		log.Println(err)
+	}
+	if !ok {
+		return nil
+	}
+
+	var history []starObservation
+	if err := json.Unmarshal(body, &history); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return history
+}
+
+func saveHistory(name string, history []starObservation) {
+	body, err := json.Marshal(history)
+	if err == nil {
+		err = store.Put(historyKey(name), body)
+	}
+	if err != nil {
+		// a broken store shouldn't take lookups down with it
+		log.Println(err)
+	}
+}
+
+// a repo's history, read from the store the first time it is asked for.
+// Returned locked
+func (c *starCache) lockHistory(name string) *repoHistory {
+	key := cacheKey(name)
+
+	c.mu.Lock()
+	h, ok := c.histories[key]
+	if !ok {
+		h = &repoHistory{}
+		c.histories[key] = h
+	}
+	c.mu.Unlock()
+
+	h.mu.Lock()
+	if !h.loaded {
+		h.samples = loadHistory(name)
+		h.loaded = true
+	}
+	return h
+}
+
+// Record a new count and return whatever was there before. A sampled
+// count is always added to the history, otherwise only once the last
+// sample is historyInterval old
+func (c *starCache) record(name string, stars int, sampled bool) (starObservation, bool) {
+	key := cacheKey(name)
+	obs := starObservation{Stars: stars, FetchedAt: time.Now()}
+
+	c.mu.Lock()
+	previous, seen := c.latest[key]
+	c.latest[key] = obs
+	c.mu.Unlock()
+
+	h := c.lockHistory(name)
+	defer h.mu.Unlock()
+
+	// after a restart the last sample is the best we know
+	if !seen && len(h.samples) > 0 {
+		previous, seen = h.samples[len(h.samples)-1], true
+	}
+
+	if !sampled && len(h.samples) > 0 && obs.FetchedAt.Sub(h.samples[len(h.samples)-1].FetchedAt) < currentHistoryInterval() {
+		return previous, seen
+	}
+
+	// reread so samples other replicas on the store took since we last
+	// looked are kept
+	history := append(loadHistory(name), obs)
+	if size := currentHistorySize(); len(history) > size {
+		history = history[len(history)-size:]
+	}
+	h.samples = history
+	saveHistory(name, history)
+
+	return previous, seen
+}
+
+// most recent observation for a repo
+func (c *starCache) get(name string) (starObservation, bool) {
+	c.mu.RLock()
+	obs, ok := c.latest[cacheKey(name)]
+	c.mu.RUnlock()
+	if ok {
+		return obs, true
+	}
+
+	h := c.lockHistory(name)
+	defer h.mu.Unlock()
+
+	if len(h.samples) == 0 {
+		return starObservation{}, false
+	}
+	return h.samples[len(h.samples)-1], true
+}
+
+// every sample we still have for a repo, oldest first, ending at the
+// latest count even if that wasn't sampled
+func (c *starCache) history(name string) []starObservation {
+	h := c.lockHistory(name)
+	history := make([]starObservation, len(h.samples), len(h.samples)+1)
+	copy(history, h.samples)
+	h.mu.Unlock()
+
+	c.mu.RLock()
+	obs, ok := c.latest[cacheKey(name)]
+	c.mu.RUnlock()
+
+	if ok && (len(history) == 0 || obs.FetchedAt.After(history[len(history)-1].FetchedAt)) {
+		history = append(history, obs)
+	}
+	return history
+}
+
+// Record a new star count and let webhook receivers and websocket
+// clients know if it moved since the last time we looked
+func observeStars(name string, stars int) {
+	observe(name, stars, false)
+}
+
+// observeStars for a count github told us about, which always goes in
+// the history
+func observeWebhookStars(name string, stars int) {
+	observe(name, stars, true)
+}
+
+func observe(name string, stars int, sampled bool) {
+	previous, seen := cache.record(name, stars, sampled)
+	if seen && previous.Stars != stars {
+		webhooks.emit(newStarEvent(name, previous.Stars, stars))
+	}
+
+	// websocket clients want the first count too
+	if !seen || previous.Stars != stars {
+		obs, _ := cache.get(name)
+		live.publish(name, obs)
+	}
+}
+
+var cache = newStarCache()
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to start a test with nothing cached and no history
+func resetCache() {
+	store = newMemoryStore()
+	cache = newStarCache()
+}
+
+// helper to put earlier samples in a repo's history
+func seedHistory(name string, history ...starObservation) {
+	saveHistory(name, history)
+}
+
+func TestStarCache(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	c := newStarCache()
+
+	_, seen := c.record("rdelpret/cartographer", 1, false)
+	assert.False(t, seen)
+
+	previous, seen := c.record("rdelpret/cartographer", 2, false)
+	assert.True(t, seen)
+	assert.Equal(t, 1, previous.Stars)
+
+	obs, ok := c.get("rdelpret/cartographer")
+	assert.True(t, ok)
+	assert.Equal(t, 2, obs.Stars)
+
+	// names are case insensitive
+	obs, ok = c.get("RDelpret/Cartographer")
+	assert.True(t, ok)
+	assert.Equal(t, 2, obs.Stars)
+
+	history := c.history("rdelpret/cartographer")
+	assert.Len(t, history, 2)
+	assert.Equal(t, 1, history[0].Stars)
+
+	_, ok = c.get("rdelpret/kfx")
+	assert.False(t, ok)
+
+	// the history survives a restart and picks up where it left off. 2
+	// came inside the sampling interval so only 1 was kept
+	c = newStarCache()
+	obs, ok = c.get("rdelpret/cartographer")
+	assert.True(t, ok)
+	assert.Equal(t, 1, obs.Stars)
+
+	previous, seen = c.record("rdelpret/cartographer", 3, false)
+	assert.True(t, seen)
+	assert.Equal(t, 1, previous.Stars)
+	history = c.history("rdelpret/cartographer")
+	assert.Equal(t, []int{1, 3}, []int{history[0].Stars, history[1].Stars})
+}
+
+func TestStarCacheSampling(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	c := newStarCache()
+
+	// counts inside the interval aren't sampled, but are still the latest
+	c.record("rdelpret/kfx", 1, false)
+	first, _ := c.get("rdelpret/kfx")
+	time.Sleep(time.Millisecond)
+	c.record("rdelpret/kfx", 2, false)
+	c.record("rdelpret/kfx", 3, false)
+	assert.Len(t, loadHistory("rdelpret/kfx"), 1)
+
+	history := c.history("rdelpret/kfx")
+	assert.Len(t, history, 2)
+	assert.True(t, first.FetchedAt.Equal(history[0].FetchedAt))
+	assert.Equal(t, 3, history[1].Stars)
+
+	// counts from github webhooks are always sampled
+	c.record("rdelpret/kfx", 4, true)
+	assert.Len(t, loadHistory("rdelpret/kfx"), 2)
+
+	// once the last sample is older than the interval it is taken again.
+	// after a restart, the history is only read from the store once
+	seedHistory("rdelpret/kfx", starObservation{Stars: 1, FetchedAt: time.Now().Add(-2 * time.Hour)})
+	c = newStarCache()
+	c.record("rdelpret/kfx", 1, false)
+	assert.Len(t, loadHistory("rdelpret/kfx"), 2)
+
+	// and the history is trimmed to size
+	settingsMu.Lock()
+	historySize = 2
+	settingsMu.Unlock()
+	defer func() {
+		settingsMu.Lock()
+		historySize = 1000
+		settingsMu.Unlock()
+	}()
+
+	seedHistory("rdelpret/kfx",
+		starObservation{Stars: 1, FetchedAt: time.Now().Add(-3 * time.Hour)},
+		starObservation{Stars: 2, FetchedAt: time.Now().Add(-2 * time.Hour)})
+	c = newStarCache()
+	c.record("rdelpret/kfx", 3, false)
+	history = loadHistory("rdelpret/kfx")
+	assert.Equal(t, []int{2, 3}, []int{history[0].Stars, history[1].Stars})
+}
+
+func TestObserveStars(t *testing.T) {
+
+	resetCache()
+	webhooks = newWebhookDispatcher("http://localhost:1", "", "json")
+	defer func() { webhooks = newWebhookDispatcher("", "", "json") }()
+
+	// first sighting is not a change
+	observeStars("rdelpret/cartographer", 1)
+	assert.Len(t, webhooks.queue, 0)
+
+	// same count is not a change either
+	observeStars("rdelpret/cartographer", 1)
+	assert.Len(t, webhooks.queue, 0)
+
+	observeStars("rdelpret/cartographer", 5)
+	assert.Len(t, webhooks.queue, 1)
+
+	event := <-webhooks.queue
+	assert.Equal(t, "rdelpret/cartographer", event.Repo)
+	assert.Equal(t, 1, event.PreviousStars)
+	assert.Equal(t, 5, event.Stars)
+}
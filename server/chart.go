@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------ CHARTS ------------------------------
+
+// how many repos fit on one chart
+const maxChartRepos = 10
+
+// chart size and the space around the plot for axis labels
+const (
+	chartWidth        = 800
+	chartPlotHeight   = 300
+	chartMarginLeft   = 60
+	chartMarginRight  = 20
+	chartMarginTop    = 20
+	chartMarginBottom = 30
+	chartLegendRow    = 20
+	chartTicks        = 5
+)
+
+// default window when the client doesn't pass ?range=
+const defaultChartRange = 90 * 24 * time.Hour
+
+// one colour per repo, in the order they were asked for
+var chartColors = []string{
+	"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+	"#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac",
+}
+
+// units a chart range can be given in
+var chartRangeUnits = map[byte]time.Duration{
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'm': 30 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+// A line on the chart, what the server has seen for one repo
+type chartSeries struct {
+	name   string
+	points []starObservation
+}
+
+// Read a chart range like 90d, 12w or 1y. all gives 0, which means
+// every observation we have
+func parseChartRange(val string) (time.Duration, error) {
+	if val == "" {
+		return defaultChartRange, nil
+	}
+	if val == "all" {
+		return 0, nil
+	}
+
+	invalid := errors.New("Recieved invalid range: " + val + ". Hint: a number and a unit like 24h, 90d, 12w, 6m or 1y, or all")
+
+	unit, ok := chartRangeUnits[val[len(val)-1]]
+	if !ok {
+		return 0, invalid
+	}
+
+	num, err := strconv.Atoi(val[:len(val)-1])
+	if err != nil || num < 1 {
+		return 0, invalid
+	}
+
+	return time.Duration(num) * unit, nil
+}
+
+// Pick a round step for an axis, ie 1, 2, 5, 10, 20, 50... so that
+// span splits into about ticks pieces
+func niceStep(span float64, ticks int) float64 {
+	if span <= 0 {
+		return 1
+	}
+
+	raw := span / float64(ticks)
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+
+	for _, step := range []float64{1, 2, 5, 10} {
+		if raw <= step*magnitude {
+			return math.Max(1, step*magnitude)
+		}
+	}
+	return math.Max(1, 10*magnitude)
+}
+
+// helper function to get the observations inside the window
+func chartWindow(history []starObservation, since time.Time) []starObservation {
+	points := make([]starObservation, 0, len(history))
+	for _, obs := range history {
+		if !obs.FetchedAt.Before(since) {
+			points = append(points, obs)
+		}
+	}
+	return points
+}
+
+// pick a date format that fits how much time the chart covers
+func chartTimeFormat(span time.Duration) string {
+	switch {
+	case span < 2*24*time.Hour:
+		return "Jan 2 15:04"
+	case span < 365*24*time.Hour:
+		return "Jan 2"
+	default:
+		return "Jan 2006"
+	}
+}
+
+// Draw star history as an svg line chart. Repos with a single
+// observation are drawn as a dot, repos with none only get a legend entry
+func renderChart(series []chartSeries, now time.Time) []byte {
+	start := now
+	minStars, maxStars := math.MaxInt64, 0
+	for _, s := range series {
+		for _, obs := range s.points {
+			if obs.FetchedAt.Before(start) {
+				start = obs.FetchedAt
+			}
+			if obs.Stars < minStars {
+				minStars = obs.Stars
+			}
+			if obs.Stars > maxStars {
+				maxStars = obs.Stars
+			}
+		}
+	}
+
+	if minStars > maxStars {
+		minStars, maxStars = 0, 0
+	}
+
+	// round the axis out to whole steps so the lines don't touch the edges
+	step := niceStep(float64(maxStars-minStars), chartTicks)
+	yMin := math.Floor(float64(minStars)/step) * step
+	yMax := math.Ceil(float64(maxStars)/step) * step
+	if yMax == yMin {
+		yMax = yMin + step
+	}
+
+	span := now.Sub(start)
+	if span <= 0 {
+		span = time.Hour
+		start = now.Add(-span)
+	}
+
+	plotWidth := chartWidth - chartMarginLeft - chartMarginRight
+	legendTop := chartMarginTop + chartPlotHeight + chartMarginBottom
+	height := legendTop + chartLegendRow*len(series) + 10
+
+	x := func(t time.Time) float64 {
+		return chartMarginLeft + float64(plotWidth)*float64(t.Sub(start))/float64(span)
+	}
+	y := func(stars float64) float64 {
+		return chartMarginTop + chartPlotHeight*(1-(stars-yMin)/(yMax-yMin))
+	}
+
+	esc := html.EscapeString
+
+	names := make([]string, len(series))
+	for i, s := range series {
+		names[i] = s.name
+	}
+
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img" aria-label="%s">`, chartWidth, height, esc("star history: "+strings.Join(names, ", ")))
+	fmt.Fprintf(&svg, `<title>%s</title>`, esc("star history: "+strings.Join(names, ", ")))
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/>`, chartWidth, height)
+	svg.WriteString(`<g font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11" fill="#555">`)
+
+	// horizontal grid lines with star counts
+	for stars := yMin; stars <= yMax; stars += step {
+		fmt.Fprintf(&svg, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, chartMarginLeft, y(stars), chartMarginLeft+plotWidth, y(stars))
+		fmt.Fprintf(&svg, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, chartMarginLeft-6, y(stars)+4, compactCount(int(stars)))
+	}
+
+	// dates along the bottom
+	format := chartTimeFormat(span)
+	for i := 0; i <= chartTicks; i++ {
+		t := start.Add(span * time.Duration(i) / chartTicks)
+		anchor := "middle"
+		if i == 0 {
+			anchor = "start"
+		} else if i == chartTicks {
+			anchor = "end"
+		}
+		fmt.Fprintf(&svg, `<text x="%.1f" y="%d" text-anchor="%s">%s</text>`, x(t), chartMarginTop+chartPlotHeight+18, anchor, t.UTC().Format(format))
+	}
+
+	fmt.Fprintf(&svg, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, chartMarginLeft, chartMarginTop+chartPlotHeight, chartMarginLeft+plotWidth, chartMarginTop+chartPlotHeight)
+	svg.WriteString(`</g>`)
+
+	for i, s := range series {
+		color := chartColors[i%len(chartColors)]
+
+		switch len(s.points) {
+		case 0:
+		case 1:
+			fmt.Fprintf(&svg, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"/>`, x(s.points[0].FetchedAt), y(float64(s.points[0].Stars)), color)
+		default:
+			coords := make([]string, len(s.points))
+			for j, obs := range s.points {
+				coords[j] = fmt.Sprintf("%.1f,%.1f", x(obs.FetchedAt), y(float64(obs.Stars)))
+			}
+			fmt.Fprintf(&svg, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(coords, " "), color)
+		}
+	}
+
+	// legend, one row per repo with its latest count
+	svg.WriteString(`<g font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="12" fill="#333">`)
+	for i, s := range series {
+		rowY := legendTop + chartLegendRow*i
+		label := s.name + " (no data)"
+		if len(s.points) > 0 {
+			label = s.name + " " + compactCount(s.points[len(s.points)-1].Stars)
+		}
+		fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, chartMarginLeft, rowY, chartColors[i%len(chartColors)])
+		fmt.Fprintf(&svg, `<text x="%d" y="%d">%s</text>`, chartMarginLeft+18, rowY+11, esc(label))
+	}
+	svg.WriteString(`</g></svg>`)
+
+	return svg.Bytes()
+}
+
+// HTTP route to get a star history chart, ie
+// GET /chart/kubernetes/kubernetes.svg?range=90d&repos=istio/istio
+func chartHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /chart/ routes
+	if !strings.HasPrefix(r.URL.Path, "/chart/") || !strings.HasSuffix(r.URL.Path, ".svg") {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	window, err := parseChartRange(r.URL.Query().Get("range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the repo in the path comes first, then any others to draw with it
+	names := []string{strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/chart/"), ".svg")}
+	for _, val := range r.URL.Query()["repos"] {
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) > maxChartRepos {
+		http.Error(w, "Too many repos. Limit is "+strconv.Itoa(maxChartRepos)+" per chart.", http.StatusBadRequest)
+		return
+	}
+
+	if errs := validateRepoNames(names); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// make sure every line ends at a current count. The chart can only be
+	// kept as long as the oldest of those counts
+	var fetchedAt time.Time
+	for _, name := range names {
+		repo, at := lookupOpenRepo(name)
+		if repo.Stars != -1 && (fetchedAt.IsZero() || at.Before(fetchedAt)) {
+			fetchedAt = at
+		}
+	}
+
+	now := time.Now()
+	var since time.Time
+	if window > 0 {
+		since = now.Add(-window)
+	}
+
+	series := make([]chartSeries, len(names))
+	for i, name := range names {
+		series[i] = chartSeries{name: name, points: chartWindow(cache.history(name), since)}
+	}
+
+	svg := renderChart(series, now)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+
+	// nothing worked, so don't let anyone hold on to it
+	if fetchedAt.IsZero() {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(svg)
+		return
+	}
+
+	writeCacheable(w, r, svg, fetchedAt)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChartRange(t *testing.T) {
+	window, err := parseChartRange("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultChartRange, window)
+
+	window, err = parseChartRange("90d")
+	assert.Nil(t, err)
+	assert.Equal(t, 90*24*time.Hour, window)
+
+	window, err = parseChartRange("12w")
+	assert.Nil(t, err)
+	assert.Equal(t, 84*24*time.Hour, window)
+
+	window, err = parseChartRange("all")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), window)
+
+	for _, val := range []string{"d", "0d", "-1d", "90", "90s", "ninetyd"} {
+		_, err = parseChartRange(val)
+		assert.EqualError(t, err, "Recieved invalid range: "+val+". Hint: a number and a unit like 24h, 90d, 12w, 6m or 1y, or all")
+	}
+}
+
+func TestNiceStep(t *testing.T) {
+	assert.Equal(t, 1.0, niceStep(0, 5))
+	assert.Equal(t, 1.0, niceStep(3, 5))
+	assert.Equal(t, 20.0, niceStep(77, 5))
+	assert.Equal(t, 500.0, niceStep(2400, 5))
+	assert.Equal(t, 1000.0, niceStep(5000, 5))
+}
+
+func TestChartWindow(t *testing.T) {
+	now := time.Now()
+	history := []starObservation{
+		{Stars: 1, FetchedAt: now.Add(-48 * time.Hour)},
+		{Stars: 2, FetchedAt: now.Add(-12 * time.Hour)},
+		{Stars: 3, FetchedAt: now},
+	}
+
+	assert.Equal(t, history[1:], chartWindow(history, now.Add(-24*time.Hour)))
+	assert.Equal(t, history, chartWindow(history, time.Time{}))
+	assert.Empty(t, chartWindow(history, now.Add(time.Hour)))
+}
+
+func TestRenderChart(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	svg := string(renderChart([]chartSeries{
+		{name: "a/b", points: []starObservation{
+			{Stars: 100, FetchedAt: now.Add(-72 * time.Hour)},
+			{Stars: 150, FetchedAt: now},
+		}},
+		{name: "c/<d>", points: []starObservation{{Stars: 120, FetchedAt: now}}},
+		{name: "e/f"},
+	}, now))
+
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg"`))
+	assert.Equal(t, 1, strings.Count(svg, "<polyline"))
+	assert.Equal(t, 1, strings.Count(svg, "<circle"))
+
+	// legend has every repo, escaped, with its latest count
+	assert.Contains(t, svg, ">a/b 150</text>")
+	assert.Contains(t, svg, ">c/&lt;d&gt; 120</text>")
+	assert.Contains(t, svg, ">e/f (no data)</text>")
+
+	// axis covers what we have
+	assert.Contains(t, svg, ">Oct 15</text>")
+	assert.Contains(t, svg, ">Oct 18</text>")
+	assert.Contains(t, svg, ">100</text>")
+	assert.Contains(t, svg, ">150</text>")
+
+	// an empty chart still renders
+	svg = string(renderChart([]chartSeries{{name: "a/b"}}, now))
+	assert.Contains(t, svg, ">a/b (no data)</text>")
+	assert.NotContains(t, svg, "<polyline")
+}
+
+func TestChartHandler(t *testing.T) {
+
+	resetCache()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		http.HandlerFunc(chartHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// earlier counts already in the history
+	yesterday := time.Now().Add(-24 * time.Hour)
+	seedHistory("rdelpret/cartographer", starObservation{Stars: 0, FetchedAt: yesterday})
+	seedHistory("rdelpret/kfx", starObservation{Stars: 5, FetchedAt: yesterday})
+
+	// test happy path
+	recorder := get("/chart/rdelpret/cartographer.svg?range=30d&repos=rdelpret/kfx")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/svg+xml", recorder.Header().Get("Content-Type"))
+	assert.Regexp(t, `^max-age=\d+$`, recorder.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, recorder.Header().Get("ETag"))
+	assert.Contains(t, recorder.Body.String(), ">rdelpret/cartographer 1</text>")
+	assert.Contains(t, recorder.Body.String(), ">rdelpret/kfx 1</text>")
+	assert.Equal(t, 2, strings.Count(recorder.Body.String(), "<polyline"))
+
+	// bad range
+	recorder = get("/chart/rdelpret/cartographer.svg?range=forever")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// too many repos
+	recorder = get("/chart/a/b.svg?repos=" + strings.Repeat("c/d,", maxChartRepos))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Too many repos. Limit is 10 per chart.\n", recorder.Body.String())
+
+	// bad names
+	recorder = get("/chart/rdelpret/cartographer.svg?repos=invalid")
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+
+	var res validationErrors
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	assert.Equal(t, []validationError{{Index: 1, Name: "invalid", Error: "Recieved invalid repo name: invalid"}}, res.Errors)
+
+	// nothing could be looked up, so nothing is cached
+	mockGithubAPI(`{}`, 404)
+	recorder = get("/chart/rdelpret/missing.svg")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Contains(t, recorder.Body.String(), ">rdelpret/missing (no data)</text>")
+
+	// with auth on only cached counts are drawn, nothing goes upstream
+	defer enableAuth(authSettings{})()
+	mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	recorder = get("/chart/rdelpret/uncached.svg?repos=rdelpret/kfx")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), ">rdelpret/uncached (no data)</text>")
+	assert.Contains(t, recorder.Body.String(), ">rdelpret/kfx 1</text>")
+	_, ok := cache.get("rdelpret/uncached")
+	assert.False(t, ok)
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/chart/rdelpret/cartographer.svg", nil)
+	http.HandlerFunc(chartHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = get("/wrongroute")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------- COMPARE -----------------------------
+
+// how many repos can be compared at once
+const (
+	minCompareRepos = 2
+	maxCompareRepos = 10
+)
+
+// window for star growth, and how many recent releases set the cadence
+const (
+	growthWindow     = 30 * 24 * time.Hour
+	cadenceReleases  = 10
+	releasesPageSize = 100
+)
+
+// How often a repo ships, from its most recent releases
+type ReleaseCadence struct {
+	// releases on the first page of the releases api, up to 100
+	RecentReleases int        `json:"recent_releases"`
+	LastRelease    *time.Time `json:"last_release"`
+	// average gap over the last 10 releases, null with fewer than 2
+	DaysBetweenReleases *float64 `json:"days_between_releases"`
+}
+
+// Ratios that make repos of different sizes easier to compare
+type CompareRatios struct {
+	ForksPerStar      *float64 `json:"forks_per_star"`
+	OpenIssuesPerStar *float64 `json:"open_issues_per_star"`
+}
+
+// One repo in a /compare response. Anything we couldn't find out is null
+type ComparedRepo struct {
+	RepoV2
+	Forks      *int       `json:"forks"`
+	OpenIssues *int       `json:"open_issues"`
+	LastPush   *time.Time `json:"last_push"`
+	// change over the last 30 days from the server's own history,
+	// counted from StarGrowthSince. Null until history covers 30 days
+	StarGrowth30d   *int            `json:"star_growth_30d"`
+	StarGrowthSince *time.Time      `json:"star_growth_since"`
+	Releases        *ReleaseCadence `json:"releases"`
+	Ratios          CompareRatios   `json:"ratios"`
+}
+
+// Struct that represents a /compare response. Winners maps each
+// metric to the repo that did best on it, null on a tie or no data
+type Comparison struct {
+	Repos   []ComparedRepo     `json:"repos"`
+	Winners map[string]*string `json:"winners"`
+}
+
+// helper function to get a pointer to a known count, nil for -1
+func knownCount(count int) *int {
+	if count < 0 {
+		return nil
+	}
+	return &count
+}
+
+// divide two counts, nil if either is unknown or there is nothing to divide by
+func ratio(x *int, y *int) *float64 {
+	if x == nil || y == nil || *y == 0 {
+		return nil
+	}
+	r := float64(*x) / float64(*y)
+	return &r
+}
+
+// Work out star growth over the window from the server's history.
+// Counts from the last observation before the window started. Growth
+// over less than the window isn't growth over the window, so that is nil
+func starGrowth(history []starObservation, now time.Time) (*int, *time.Time) {
+	start := now.Add(-growthWindow)
+	if len(history) < 2 || history[0].FetchedAt.After(start) {
+		return nil, nil
+	}
+
+	baseline := history[0]
+	for _, obs := range history {
+		if obs.FetchedAt.After(start) {
+			break
+		}
+		baseline = obs
+	}
+
+	growth := history[len(history)-1].Stars - baseline.Stars
+	since := baseline.FetchedAt.UTC()
+	return &growth, &since
+}
+
+// work out release cadence from publish dates, newest first
+func releaseCadence(published []time.Time) *ReleaseCadence {
+	cadence := &ReleaseCadence{RecentReleases: len(published)}
+	if len(published) == 0 {
+		return cadence
+	}
+
+	last := published[0].UTC()
+	cadence.LastRelease = &last
+
+	recent := published
+	if len(recent) > cadenceReleases {
+		recent = recent[:cadenceReleases]
+	}
+
+	if len(recent) >= 2 {
+		span := recent[0].Sub(recent[len(recent)-1]).Hours() / 24
+		days := span / float64(len(recent)-1)
+		cadence.DaysBetweenReleases = &days
+	}
+
+	return cadence
+}
+
+// Look up a repo's most recent releases, newest first. Drafts and
+// anything else without a publish date are skipped
+func lookupReleases(name string) ([]time.Time, error) {
+	provider, path, err := resolveProvider(name)
+	if err != nil {
+		return nil, err
+	}
+
+	url, err := provider.ReleasesURL(path, releasesPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// this is for testing so we can setup a mock http server
+	if serverURLOverride != "" {
+		url = serverURLOverride
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	provider.Authorize(req)
+
+	countUpstreamRequest(provider.Name())
+	resp, err := doUpstream(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Could not list releases for " + name + ": " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []map[string]interface{}
+	err = json.Unmarshal(body, &releases)
+	if err != nil {
+		return nil, err
+	}
+	countUpstreamRequest200(provider.Name())
+
+	published := make([]time.Time, 0, len(releases))
+	for _, release := range releases {
+		if t := provider.ParseReleaseTime(release); !t.IsZero() {
+			published = append(published, t)
+		}
+	}
+
+	sort.Slice(published, func(i, j int) bool {
+		return published[i].After(published[j])
+	})
+
+	return published, nil
+}
+
+// shape a lookup and its releases for the compare api
+func newComparedRepo(res repoResult, published []time.Time, releasesErr error) ComparedRepo {
+	repo := ComparedRepo{RepoV2: newRepoV2(res)}
+	if res.Err != nil {
+		return repo
+	}
+
+	repo.Forks = knownCount(res.Meta.Forks)
+	repo.OpenIssues = knownCount(res.Meta.OpenIssues)
+
+	if !res.Meta.PushedAt.IsZero() {
+		pushed := res.Meta.PushedAt.UTC()
+		repo.LastPush = &pushed
+	}
+
+	repo.StarGrowth30d, repo.StarGrowthSince = starGrowth(cache.history(res.Name), time.Now())
+
+	if releasesErr == nil {
+		repo.Releases = releaseCadence(published)
+	}
+
+	repo.Ratios = CompareRatios{
+		ForksPerStar:      ratio(repo.Forks, repo.Stars),
+		OpenIssuesPerStar: ratio(repo.OpenIssues, repo.Stars),
+	}
+
+	return repo
+}
+
+// Pick the repo that did best on a metric. score returns false when a
+// repo has no value for it. Ties and metrics nobody has get no winner
+func pickWinner(repos []ComparedRepo, higherWins bool, score func(repo ComparedRepo) (float64, bool)) *string {
+	var winner *string
+	best := 0.0
+	tied := false
+
+	for i := range repos {
+		val, ok := score(repos[i])
+		if !ok {
+			continue
+		}
+
+		better := val > best
+		if !higherWins {
+			better = val < best
+		}
+
+		switch {
+		case winner == nil || better:
+			winner = &repos[i].Name
+			best = val
+			tied = false
+		case val == best:
+			tied = true
+		}
+	}
+
+	if tied {
+		return nil
+	}
+	return winner
+}
+
+// which repo wins each metric. More stars, forks, growth and recent
+// activity win, as do fewer open issues and shorter gaps between releases
+func compareWinners(repos []ComparedRepo) map[string]*string {
+	count := func(field func(repo ComparedRepo) *int) func(repo ComparedRepo) (float64, bool) {
+		return func(repo ComparedRepo) (float64, bool) {
+			val := field(repo)
+			if val == nil {
+				return 0, false
+			}
+			return float64(*val), true
+		}
+	}
+
+	return map[string]*string{
+		"stars":           pickWinner(repos, true, count(func(r ComparedRepo) *int { return r.Stars })),
+		"forks":           pickWinner(repos, true, count(func(r ComparedRepo) *int { return r.Forks })),
+		"open_issues":     pickWinner(repos, false, count(func(r ComparedRepo) *int { return r.OpenIssues })),
+		"star_growth_30d": pickWinner(repos, true, count(func(r ComparedRepo) *int { return r.StarGrowth30d })),
+		"last_push": pickWinner(repos, true, func(r ComparedRepo) (float64, bool) {
+			if r.LastPush == nil {
+				return 0, false
+			}
+			return float64(r.LastPush.Unix()), true
+		}),
+		"release_cadence": pickWinner(repos, false, func(r ComparedRepo) (float64, bool) {
+			if r.Releases == nil || r.Releases.DaysBetweenReleases == nil {
+				return 0, false
+			}
+			return *r.Releases.DaysBetweenReleases, true
+		}),
+	}
+}
+
+// Look up every repo and its releases, then line them up
+func compareRepos(names []string) Comparison {
+	results := fetchRepos(names)
+
+	published := make([][]time.Time, len(names))
+	releaseErrs := make([]error, len(names))
+
+	wg := sync.WaitGroup{}
+	for i, res := range results {
+		if res.Err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, name string) {
+			defer wg.Done()
+			published[index], releaseErrs[index] = lookupReleases(name)
+			if releaseErrs[index] != nil {
+				log.Println(releaseErrs[index])
+			}
+		}(i, res.Name)
+	}
+	wg.Wait()
+
+	comparison := Comparison{Repos: make([]ComparedRepo, len(names))}
+	for i, res := range results {
+		comparison.Repos[i] = newComparedRepo(res, published[i], releaseErrs[i])
+	}
+	comparison.Winners = compareWinners(comparison.Repos)
+
+	return comparison
+}
+
+// HTTP route to compare repos side by side, ie /compare?repos=a/b,c/d
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /compare route
+	if r.URL.Path != "/compare" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	// repos can be comma separated, repeated, or both
+	var names []string
+	for _, val := range r.URL.Query()["repos"] {
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) < minCompareRepos || len(names) > maxCompareRepos {
+		http.Error(w, "Compare takes "+strconv.Itoa(minCompareRepos)+" to "+strconv.Itoa(maxCompareRepos)+" repos. Hint: /compare?repos=<org>/<repo-name>,<org>/<repo-name>", http.StatusBadRequest)
+		return
+	}
+
+	if errs := validateRepoNames(names); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// stars and releases are a lookup each
+	if !chargeRequest(w, r, 2*len(names)) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(compareRepos(names))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStarGrowth(t *testing.T) {
+	now := time.Now()
+
+	growth, since := starGrowth(nil, now)
+	assert.Nil(t, growth)
+	assert.Nil(t, since)
+
+	// counts from the last observation before the window
+	history := []starObservation{
+		{Stars: 50, FetchedAt: now.Add(-40 * 24 * time.Hour)},
+		{Stars: 100, FetchedAt: now.Add(-31 * 24 * time.Hour)},
+		{Stars: 120, FetchedAt: now.Add(-10 * 24 * time.Hour)},
+		{Stars: 150, FetchedAt: now},
+	}
+	growth, since = starGrowth(history, now)
+	assert.Equal(t, 50, *growth)
+	assert.Equal(t, history[1].FetchedAt.UTC(), *since)
+
+	// history that doesn't go back 30 days has no growth yet
+	growth, since = starGrowth(history[2:], now)
+	assert.Nil(t, growth)
+	assert.Nil(t, since)
+}
+
+func TestReleaseCadence(t *testing.T) {
+	now := time.Now().UTC()
+
+	cadence := releaseCadence(nil)
+	assert.Equal(t, &ReleaseCadence{}, cadence)
+
+	cadence = releaseCadence([]time.Time{now})
+	assert.Equal(t, 1, cadence.RecentReleases)
+	assert.Equal(t, now, *cadence.LastRelease)
+	assert.Nil(t, cadence.DaysBetweenReleases)
+
+	// only the last 10 releases count toward the cadence
+	var published []time.Time
+	for i := 0; i < 12; i++ {
+		gap := 7
+		if i >= 10 {
+			gap = 100
+		}
+		published = append(published, now.Add(-time.Duration(i*gap)*24*time.Hour))
+	}
+	cadence = releaseCadence(published)
+	assert.Equal(t, 12, cadence.RecentReleases)
+	assert.Equal(t, 7.0, *cadence.DaysBetweenReleases)
+}
+
+func TestPickWinner(t *testing.T) {
+	one, two, three := 1, 2, 2
+	repos := []ComparedRepo{
+		{RepoV2: RepoV2{Name: "a/a", Stars: &one}},
+		{RepoV2: RepoV2{Name: "b/b", Stars: &two}},
+		{RepoV2: RepoV2{Name: "c/c"}},
+	}
+	stars := func(repo ComparedRepo) (float64, bool) {
+		if repo.Stars == nil {
+			return 0, false
+		}
+		return float64(*repo.Stars), true
+	}
+
+	assert.Equal(t, "b/b", *pickWinner(repos, true, stars))
+	assert.Equal(t, "a/a", *pickWinner(repos, false, stars))
+
+	// ties have no winner
+	repos[2].Stars = &three
+	assert.Nil(t, pickWinner(repos, true, stars))
+
+	// neither does a metric nobody has
+	assert.Nil(t, pickWinner(repos, true, func(repo ComparedRepo) (float64, bool) { return 0, false }))
+}
+
+// helper to serve fake github repos and releases
+func mockCompareAPI(t *testing.T) func() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/rdelpret/kfx":
+			fmt.Fprintln(w, `{"stargazers_count": 100, "forks_count": 10, "open_issues_count": 5, "pushed_at": "2021-06-01T10:00:00Z"}`)
+		case "/repos/rdelpret/kfx/releases":
+			assert.Equal(t, "100", r.URL.Query().Get("per_page"))
+			fmt.Fprintln(w, `[{"published_at": "2021-05-21T10:00:00Z"}, {"published_at": "2021-05-01T10:00:00Z"}, {"published_at": null}]`)
+		case "/repos/rdelpret/cartographer":
+			fmt.Fprintln(w, `{"stargazers_count": 50, "forks_count": 20, "open_issues_count": 1, "pushed_at": "2021-06-02T10:00:00Z"}`)
+		case "/repos/rdelpret/cartographer/releases":
+			fmt.Fprintln(w, `[]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	original := providers["github"]
+	providers["github"] = &githubProvider{baseURL: ts.URL + "/"}
+
+	return func() {
+		providers["github"] = original
+		ts.Close()
+	}
+}
+
+func TestCompareHandler(t *testing.T) {
+
+	close := mockCompareAPI(t)
+	defer close()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/compare?repos=rdelpret/kfx,rdelpret/cartographer&repos=rdelpret/missing", nil)
+	http.HandlerFunc(compareHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var res Comparison
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	assert.Len(t, res.Repos, 3)
+
+	kfx := res.Repos[0]
+	assert.Equal(t, "rdelpret/kfx", kfx.Name)
+	assert.Equal(t, 100, *kfx.Stars)
+	assert.Equal(t, 10, *kfx.Forks)
+	assert.Equal(t, 5, *kfx.OpenIssues)
+	assert.Equal(t, time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC), *kfx.LastPush)
+	assert.Equal(t, 2, kfx.Releases.RecentReleases)
+	assert.Equal(t, 20.0, *kfx.Releases.DaysBetweenReleases)
+	assert.Equal(t, 0.1, *kfx.Ratios.ForksPerStar)
+	assert.Equal(t, 0.05, *kfx.Ratios.OpenIssuesPerStar)
+
+	cartographer := res.Repos[1]
+	assert.Equal(t, 0, cartographer.Releases.RecentReleases)
+	assert.Nil(t, cartographer.Releases.DaysBetweenReleases)
+
+	missing := res.Repos[2]
+	assert.Equal(t, StatusNotFound, missing.Status)
+	assert.Nil(t, missing.Forks)
+	assert.Nil(t, missing.Releases)
+
+	name := func(s string) *string { return &s }
+	assert.Equal(t, name("rdelpret/kfx"), res.Winners["stars"])
+	assert.Equal(t, name("rdelpret/cartographer"), res.Winners["forks"])
+	assert.Equal(t, name("rdelpret/cartographer"), res.Winners["open_issues"])
+	assert.Equal(t, name("rdelpret/cartographer"), res.Winners["last_push"])
+	assert.Equal(t, name("rdelpret/kfx"), res.Winners["release_cadence"])
+	assert.Contains(t, res.Winners, "star_growth_30d")
+}
+
+func TestCompareHandlerErrors(t *testing.T) {
+
+	get := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/compare"+query, nil)
+		http.HandlerFunc(compareHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := get("?repos=rdelpret/kfx")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Body.String(), "Compare takes 2 to 10 repos."))
+
+	recorder = get("?repos=rdelpret/kfx,invalid")
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"index":1,"name":"invalid"`)
+
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/compare", nil)
+	http.HandlerFunc(compareHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+}
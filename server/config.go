@@ -0,0 +1,963 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ------------------------------ CONFIG ------------------------------
+
+// Everything the server can be set up with. Settings are merged from
+// defaults, a config file, RAINBOW_ROAD_* environment variables and
+// command line flags, each overriding the one before
+type serverConfig struct {
+	listen      string
+	grpcListen  string
+	upstream    upstreamConfig
+	cacheMaxAge time.Duration
+	historySize int
+	// how often a count is sampled into the history
+	historyInterval time.Duration
+	storePath       string
+	limits          requestLimits
+	jobs            jobsConfig
+	webhooks        webhooksConfig
+	watchlist       watchlistConfig
+	shutdown        shutdownConfig
+	tls             tlsSettings
+	auth            authSettings
+	rateLimits      rateLimitSettings
+	// how often watched files are checked for changes, 0 only reloads on SIGHUP
+	reloadInterval time.Duration
+}
+
+// where star counts come from and how hard we lean on them
+type upstreamConfig struct {
+	githubURL   string
+	githubToken string
+	gitlabURL   string
+	gitlabToken string
+	giteaURL    string
+	giteaToken  string
+	timeout     time.Duration
+	// most upstream requests in flight at once, across every route
+	concurrency int
+}
+
+type jobsConfig struct {
+	workers     int
+	concurrency int
+	retention   time.Duration
+}
+
+type webhooksConfig struct {
+	url    string
+	secret string
+	format string
+	// shared with github to verify inbound webhooks
+	githubSecret string
+}
+
+type watchlistConfig struct {
+	pollInterval time.Duration
+	// where alerts are POSTed
+	alertURL    string
+	alertSecret string
+}
+
+// Certificates to serve HTTPS and gRPC over TLS with. Without a cert we
+// serve plain text, ie behind a service mesh
+type tlsSettings struct {
+	certFile string
+	keyFile  string
+	// turns on mutual TLS, client certs have to chain up to this
+	clientCAFile string
+	// require or verify_if_given
+	clientAuth string
+}
+
+// Who can call the api. Without auth anyone who can reach the server can
+// spend our upstream quota
+type authSettings struct {
+	enabled bool
+	// bootstrap key with every scope and no quota, for minting the rest
+	adminKey string
+	// client cert identities treated like the admin key
+	adminClients []string
+	// daily upstream calls for keys minted without a quota
+	defaultQuota int
+}
+
+// Token bucket limits per client, see rateLimiter
+type rateLimitSettings struct {
+	enabled      bool
+	defaultLimit rateLimit
+	routes       []routeLimit
+	// keep buckets in the store so replicas sharing it share limits
+	shared bool
+}
+
+// One thing the server can be configured with. The key names it in the
+// config file, the env var and flag names are worked out from it
+type setting struct {
+	key   string
+	def   string
+	usage string
+	// env var this was read from before there was a config layer.
+	// Still honoured, the RAINBOW_ROAD_ one wins if both are set
+	legacyEnv string
+	// turn a legacy env value into what the setting expects
+	fromLegacy func(val string) string
+	// never printed by --print-config
+	secret bool
+	// this setting is a file path the value of another (secret) setting
+	// is read from, ie a mounted kubernetes secret. Watched for changes
+	fileOf string
+	// can't change without a restart, reloads keep the old value
+	restart bool
+	// parse the value into the config, the error is the hint shown to the user
+	set func(cfg *serverConfig, val string) error
+}
+
+// comma separated list, blanks dropped
+func listValue(field func(cfg *serverConfig) *[]string) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		var list []string
+		for _, item := range strings.Split(val, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(cfg) = list
+		return nil
+	}
+}
+
+func rateLimitValue(field func(cfg *serverConfig) *rateLimit) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		limit, err := parseRateLimit(val)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = limit
+		return nil
+	}
+}
+
+// comma separated route limits, ie /stars=60/1m,/metrics=off
+func routeLimitsValue(field func(cfg *serverConfig) *[]routeLimit) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		var routes []routeLimit
+		for _, item := range strings.Split(val, ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			route, err := parseRouteLimit(item)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, route)
+		}
+		*field(cfg) = routes
+		return nil
+	}
+}
+
+// settings that are paths to files, with anything else allowed as is
+func pathValue(cfg *serverConfig, val string) error {
+	return nil
+}
+
+// A setting's value after merging, and where it came from
+type configValue struct {
+	val    string
+	source string
+}
+
+// What loadConfig worked out
+type loadedConfig struct {
+	cfg    serverConfig
+	values map[string]configValue
+	// config file, if there was one
+	path string
+	// --print-config was passed, dump and exit instead of serving
+	print bool
+}
+
+// prefix for every environment variable the config layer reads
+const envPrefix = "RAINBOW_ROAD_"
+
+// env var for a setting, ie upstream.timeout is RAINBOW_ROAD_UPSTREAM_TIMEOUT
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// flag for a setting, ie cache.max_age is --cache.max-age
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// ---- PARSERS ----
+
+func stringValue(field func(cfg *serverConfig) *string) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		*field(cfg) = val
+		return nil
+	}
+}
+
+func enumValue(field func(cfg *serverConfig) *string, options ...string) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		for _, option := range options {
+			if val == option {
+				*field(cfg) = val
+				return nil
+			}
+		}
+		return errors.New(strings.Join(options, " or "))
+	}
+}
+
+// host:port or :port
+func addrValue(field func(cfg *serverConfig) *string) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		_, port, err := net.SplitHostPort(val)
+		if err == nil {
+			var num int
+			num, err = strconv.Atoi(port)
+			if err == nil && (num < 0 || num > 65535) {
+				err = errors.New("port out of range")
+			}
+		}
+		if err != nil {
+			return errors.New("host:port or :port, ie :9999")
+		}
+		*field(cfg) = val
+		return nil
+	}
+}
+
+// an absolute http or https url, always ending in a slash. Empty is only
+// allowed if optional is set
+func urlValue(field func(cfg *serverConfig) *string, optional bool) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		if val == "" && optional {
+			*field(cfg) = ""
+			return nil
+		}
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("an http or https url, ie https://api.github.com/")
+		}
+		*field(cfg) = val
+		return nil
+	}
+}
+
+// like urlValue, for base urls we append paths to
+func baseURLValue(field func(cfg *serverConfig) *string) func(*serverConfig, string) error {
+	parse := urlValue(field, false)
+	return func(cfg *serverConfig, val string) error {
+		return parse(cfg, normalizeBaseURL(val))
+	}
+}
+
+func durationValue(field func(cfg *serverConfig) *time.Duration, allowZero bool) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 || (d == 0 && !allowZero) {
+			if allowZero {
+				return errors.New("a duration like 30s or 1m")
+			}
+			return errors.New("a duration above 0 like 30s or 1m")
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+func intValue(field func(cfg *serverConfig) *int) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		num, err := strconv.Atoi(val)
+		if err != nil || num <= 0 {
+			return errors.New("a number above 0")
+		}
+		*field(cfg) = num
+		return nil
+	}
+}
+
+func int64Value(field func(cfg *serverConfig) *int64) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		num, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || num <= 0 {
+			return errors.New("a number above 0")
+		}
+		*field(cfg) = num
+		return nil
+	}
+}
+
+func boolValue(field func(cfg *serverConfig) *bool) func(*serverConfig, string) error {
+	return func(cfg *serverConfig, val string) error {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.New("true or false")
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+// ---- SETTINGS ----
+
+// Every setting, in the order --print-config shows them. Top level
+// settings have to come before any section
+var settings = []setting{
+	{
+		key: "listen", restart: true, def: ":9999", usage: "address the HTTP API listens on",
+		set: addrValue(func(c *serverConfig) *string { return &c.listen }),
+	},
+	{
+		key: "grpc_listen", restart: true, def: ":9998", usage: "address the gRPC API listens on",
+		legacyEnv: "GRPC_PORT", fromLegacy: func(val string) string { return ":" + val },
+		set: addrValue(func(c *serverConfig) *string { return &c.grpcListen }),
+	},
+	{
+		key: "upstream.github_url", def: "https://api.github.com/", usage: "GitHub API, change for GitHub Enterprise",
+		legacyEnv: "GITHUB_API_URL",
+		set:       baseURLValue(func(c *serverConfig) *string { return &c.upstream.githubURL }),
+	},
+	{
+		key: "upstream.github_token", usage: "GitHub token, requests without one are rate limited",
+		legacyEnv: "GITHUB_TOKEN", secret: true,
+		set: stringValue(func(c *serverConfig) *string { return &c.upstream.githubToken }),
+	},
+	{
+		key: "upstream.github_token_file", usage: "file to read upstream.github_token from, reread when it changes",
+		fileOf: "upstream.github_token", set: pathValue,
+	},
+	{
+		key: "upstream.gitlab_url", def: "https://gitlab.com/", usage: "GitLab instance for gitlab: repos",
+		legacyEnv: "GITLAB_URL",
+		set:       baseURLValue(func(c *serverConfig) *string { return &c.upstream.gitlabURL }),
+	},
+	{
+		key: "upstream.gitlab_token", usage: "GitLab token",
+		legacyEnv: "GITLAB_TOKEN", secret: true,
+		set: stringValue(func(c *serverConfig) *string { return &c.upstream.gitlabToken }),
+	},
+	{
+		key: "upstream.gitlab_token_file", usage: "file to read upstream.gitlab_token from, reread when it changes",
+		fileOf: "upstream.gitlab_token", set: pathValue,
+	},
+	{
+		key: "upstream.gitea_url", def: "https://gitea.com/", usage: "Gitea instance for gitea: repos",
+		legacyEnv: "GITEA_URL",
+		set:       baseURLValue(func(c *serverConfig) *string { return &c.upstream.giteaURL }),
+	},
+	{
+		key: "upstream.gitea_token", usage: "Gitea token",
+		legacyEnv: "GITEA_TOKEN", secret: true,
+		set: stringValue(func(c *serverConfig) *string { return &c.upstream.giteaToken }),
+	},
+	{
+		key: "upstream.gitea_token_file", usage: "file to read upstream.gitea_token from, reread when it changes",
+		fileOf: "upstream.gitea_token", set: pathValue,
+	},
+	{
+		key: "upstream.timeout", def: "10s", usage: "how long a single upstream request can take",
+		set: durationValue(func(c *serverConfig) *time.Duration { return &c.upstream.timeout }, false),
+	},
+	{
+		key: "upstream.concurrency", def: "100", usage: "most upstream requests in flight at once, across every route",
+		set: intValue(func(c *serverConfig) *int { return &c.upstream.concurrency }),
+	},
+	{
+		key: "cache.max_age", def: "60s", usage: "how long a count is served from the cache by /repos, /badge and /chart",
+		set: durationValue(func(c *serverConfig) *time.Duration { return &c.cacheMaxAge }, true),
+	},
+	{
+		key: "cache.history_size", def: "1000", usage: "star counts kept per repo for /compare and /chart",
+		set: intValue(func(c *serverConfig) *int { return &c.historySize }),
+	},
+	{
+		key: "cache.history_interval", def: "1h", usage: "how often a count is added to the history for /compare and /chart",
+		set: durationValue(func(c *serverConfig) *time.Duration { return &c.historyInterval }, false),
+	},
+	{
+		key: "storage.path", restart: true, usage: "file to keep jobs, dead letters and star history in, empty keeps them in memory",
+		legacyEnv: "STORE_PATH",
+		set:       stringValue(func(c *serverConfig) *string { return &c.storePath }),
+	},
+	{
+		key: "requests.max_bytes", def: "1048576", usage: "largest request body",
+		legacyEnv: "MAX_REQUEST_BYTES",
+		set:       int64Value(func(c *serverConfig) *int64 { return &c.limits.maxBytes }),
+	},
+	{
+		key: "requests.max_repos", def: "1000", usage: "most repos per /stars or /v2/stars request",
+		legacyEnv: "MAX_REPOS",
+		set:       intValue(func(c *serverConfig) *int { return &c.limits.maxRepos }),
+	},
+	{
+		key: "requests.max_job_repos", def: "10000", usage: "most repos per job",
+		legacyEnv: "MAX_JOB_REPOS",
+		set:       intValue(func(c *serverConfig) *int { return &c.limits.maxJobRepos }),
+	},
+	{
+		key: "requests.strict", def: "false", usage: "reject request bodies with fields the API doesn't know about",
+		legacyEnv: "STRICT_REQUESTS",
+		set:       boolValue(func(c *serverConfig) *bool { return &c.limits.strict }),
+	},
+	{
+		key: "jobs.workers", restart: true, def: "2", usage: "jobs run at once",
+		set: intValue(func(c *serverConfig) *int { return &c.jobs.workers }),
+	},
+	{
+		key: "jobs.concurrency", def: "10", usage: "lookups a single job runs at once",
+		set: intValue(func(c *serverConfig) *int { return &c.jobs.concurrency }),
+	},
+	{
+		key: "jobs.retention", def: "24h", usage: "how long finished jobs are kept",
+		legacyEnv: "JOB_RETENTION",
+		set:       durationValue(func(c *serverConfig) *time.Duration { return &c.jobs.retention }, false),
+	},
+	{
+		key: "webhooks.url", usage: "where star.changed events are POSTed, empty turns them off",
+		legacyEnv: "WEBHOOK_URL",
+		set:       urlValue(func(c *serverConfig) *string { return &c.webhooks.url }, true),
+	},
+	{
+		key: "webhooks.secret", usage: "signs outgoing webhooks",
+		legacyEnv: "WEBHOOK_SECRET", secret: true,
+		set: stringValue(func(c *serverConfig) *string { return &c.webhooks.secret }),
+	},
+	{
+		key: "webhooks.secret_file", usage: "file to read webhooks.secret from, reread when it changes",
+		fileOf: "webhooks.secret", set: pathValue,
+	},
+	{
+		key: "webhooks.format", def: "json", usage: "json or cloudevents",
+		legacyEnv: "WEBHOOK_FORMAT",
+		set:       enumValue(func(c *serverConfig) *string { return &c.webhooks.format }, "json", "cloudevents"),
+	},
+	{
+		key: "webhooks.github_secret", usage: "verifies webhooks from github",
+		legacyEnv: "GITHUB_WEBHOOK_SECRET", secret: true,
+		set: stringValue(func(c *serverConfig) *string { return &c.webhooks.githubSecret }),
+	},
+	{
+		key: "webhooks.github_secret_file", usage: "file to read webhooks.github_secret from, reread when it changes",
+		fileOf: "webhooks.github_secret", set: pathValue,
+	},
+	{
+		key: "watchlist.poll_interval", restart: true, def: "5m", usage: "how often watched repos are polled and their alerts checked",
+		legacyEnv: "WATCHLIST_POLL_INTERVAL",
+		set:       durationValue(func(c *serverConfig) *time.Duration { return &c.watchlist.pollInterval }, false),
+	},
+	{
+		key: "watchlist.alert_url", usage: "where watchlist alerts are POSTed",
+		legacyEnv: "ALERT_WEBHOOK_URL",
+		set:       urlValue(func(c *serverConfig) *string { return &c.watchlist.alertURL }, true),
+	},
+	{
+		key: "watchlist.alert_secret", usage: "signs watchlist alerts",
+		legacyEnv: "ALERT_WEBHOOK_SECRET", secret: true,
+		set: stringValue(func(c *serverConfig) *string { return &c.watchlist.alertSecret }),
+	},
+	{
+		key: "watchlist.alert_secret_file", usage: "file to read watchlist.alert_secret from, reread when it changes",
+		fileOf: "watchlist.alert_secret", set: pathValue,
+	},
+	{
+		key: "shutdown.delay", def: "5s", usage: "how long to fail /readyz before we stop taking connections",
+		legacyEnv: "SHUTDOWN_DELAY",
+		set:       durationValue(func(c *serverConfig) *time.Duration { return &c.shutdown.delay }, true),
+	},
+	{
+		key: "shutdown.grace_period", def: "25s", usage: "how long in flight work gets to finish on shutdown",
+		legacyEnv: "SHUTDOWN_GRACE_PERIOD",
+		set:       durationValue(func(c *serverConfig) *time.Duration { return &c.shutdown.grace }, true),
+	},
+	{
+		key: "tls.cert_file", restart: true, usage: "PEM certificate to serve HTTPS and gRPC with, reloaded when it changes",
+		set: stringValue(func(c *serverConfig) *string { return &c.tls.certFile }),
+	},
+	{
+		key: "tls.key_file", restart: true, usage: "PEM private key for tls.cert_file",
+		set: stringValue(func(c *serverConfig) *string { return &c.tls.keyFile }),
+	},
+	{
+		key: "tls.client_ca_file", restart: true, usage: "PEM CA bundle client certificates are checked against, turns on mutual TLS",
+		set: stringValue(func(c *serverConfig) *string { return &c.tls.clientCAFile }),
+	},
+	{
+		key: "tls.client_auth", restart: true, def: "require", usage: "with tls.client_ca_file, require a client certificate or only verify_if_given",
+		set: enumValue(func(c *serverConfig) *string { return &c.tls.clientAuth }, "require", "verify_if_given"),
+	},
+	{
+		key: "auth.enabled", def: "false", usage: "require an API key for the data, jobs and admin endpoints",
+		set: boolValue(func(c *serverConfig) *bool { return &c.auth.enabled }),
+	},
+	{
+		key: "auth.admin_key", usage: "key with every scope and no quota, for minting API keys",
+		secret: true,
+		set:    stringValue(func(c *serverConfig) *string { return &c.auth.adminKey }),
+	},
+	{
+		key: "auth.admin_key_file", usage: "file to read auth.admin_key from, reread when it changes",
+		fileOf: "auth.admin_key", set: pathValue,
+	},
+	{
+		key: "auth.admin_clients", usage: "client certificate identities treated like auth.admin_key, comma separated",
+		set: listValue(func(c *serverConfig) *[]string { return &c.auth.adminClients }),
+	},
+	{
+		key: "auth.default_quota", def: "10000", usage: "daily upstream calls for API keys minted without a quota",
+		set: intValue(func(c *serverConfig) *int { return &c.auth.defaultQuota }),
+	},
+	{
+		key: "ratelimit.enabled", def: "false", usage: "limit how fast each API key or client address can make requests",
+		set: boolValue(func(c *serverConfig) *bool { return &c.rateLimits.enabled }),
+	},
+	{
+		key: "ratelimit.default", def: "600/1m", usage: "limit for routes without their own, <requests>/<duration> or off",
+		set: rateLimitValue(func(c *serverConfig) *rateLimit { return &c.rateLimits.defaultLimit }),
+	},
+	{
+		key: "ratelimit.routes", def: "/health=off,/livez=off,/readyz=off,/metrics=off", usage: "per route limits, comma separated <route>=<requests>/<duration> or <route>=off",
+		set: routeLimitsValue(func(c *serverConfig) *[]routeLimit { return &c.rateLimits.routes }),
+	},
+	{
+		key: "ratelimit.shared", restart: true, def: "false", usage: "keep rate limit buckets in the store so replicas sharing it share limits",
+		set: boolValue(func(c *serverConfig) *bool { return &c.rateLimits.shared }),
+	},
+	{
+		key: "reload.interval", restart: true, def: "10s", usage: "how often the config and secret files are checked for changes, 0 only reloads on SIGHUP",
+		set: durationValue(func(c *serverConfig) *time.Duration { return &c.reloadInterval }, true),
+	},
+}
+
+// helper function to look up a setting by key
+func findSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// ---- CONFIG FILES ----
+
+// Flatten nested yaml sections into dotted keys, ie upstream.timeout
+func flattenYAML(prefix string, node map[string]interface{}, out map[string]string) {
+	for key, val := range node {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := val.(type) {
+		case map[string]interface{}:
+			flattenYAML(key, v, out)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[key] = strings.Join(items, ",")
+		case nil:
+			out[key] = ""
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Parse the small part of TOML config files need: [sections], comments,
+// and key = value with strings, numbers, booleans and one line arrays of
+// them. Arrays are joined with commas like yaml lists are
+func parseTOML(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("line %d: unclosed section header", num)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("line %d: expected key = value", num)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		raw := strings.TrimSpace(line[eq+1:])
+		if section != "" {
+			key = section + "." + key
+		}
+
+		val, err := parseTOMLValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", num, err)
+		}
+		values[key] = val
+	}
+
+	return values, scanner.Err()
+}
+
+// drop a trailing # comment that isn't inside a string
+func stripTOMLComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote && (quote == '\'' || i == 0 || line[i-1] != '\\'):
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "["):
+		return parseTOMLArray(raw)
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'") && len(raw) >= 2:
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+
+	// underscores are allowed in toml numbers, ie 1_000
+	num := strings.Replace(raw, "_", "", -1)
+	if _, err := strconv.ParseFloat(num, 64); err == nil {
+		return num, nil
+	}
+
+	return "", errors.New("unsupported value " + raw + ", use a quoted string, number, true/false or an array")
+}
+
+// parse a one line array like ["a", "b"] into a,b
+func parseTOMLArray(raw string) (string, error) {
+	if !strings.HasSuffix(raw, "]") {
+		return "", errors.New("unclosed array " + raw + ", arrays have to fit on one line")
+	}
+
+	inner := strings.TrimSpace(raw[1 : len(raw)-1])
+	if inner == "" {
+		return "", nil
+	}
+
+	// split on commas that aren't inside a string
+	var items []string
+	var quote rune
+	last := 0
+	for i, c := range inner {
+		switch {
+		case quote != 0 && c == quote && (quote == '\'' || i == 0 || inner[i-1] != '\\'):
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			items = append(items, inner[last:i])
+			last = i + 1
+		}
+	}
+	// a trailing comma is allowed
+	if rest := strings.TrimSpace(inner[last:]); rest != "" || len(items) == 0 {
+		items = append(items, rest)
+	}
+
+	vals := make([]string, len(items))
+	for i, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.HasPrefix(item, "[") {
+			return "", errors.New("unsupported value " + raw + ", arrays can only hold strings, numbers or true/false")
+		}
+		val, err := parseTOMLValue(item)
+		if err != nil {
+			return "", err
+		}
+		vals[i] = val
+	}
+
+	return strings.Join(vals, ","), nil
+}
+
+// Read a yaml or toml config file into dotted keys, picked by extension
+func readConfigFile(path string) (map[string]string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return parseTOML(strings.NewReader(string(body)))
+	case ".yaml", ".yml":
+		var doc map[string]interface{}
+		err = yaml.Unmarshal(body, &doc)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]string)
+		flattenYAML("", doc, values)
+		return values, nil
+	default:
+		return nil, errors.New("Recieved unknown config file type: " + path + ". Hint: .yaml, .yml or .toml")
+	}
+}
+
+// ---- LOADING ----
+
+// Work out the config from defaults, a config file, the environment and
+// flags, in that order. Every bad value is reported, not just the first
+func loadConfig(args []string, lookupEnv func(key string) (string, bool)) (*loadedConfig, error) {
+	values := make(map[string]configValue)
+	for _, s := range settings {
+		values[s.key] = configValue{val: s.def, source: "default"}
+	}
+
+	// flags are parsed first so --config can pick the file, but applied last
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML or TOML config file (env "+envPrefix+"CONFIG)")
+	printConfig := fs.Bool("print-config", false, "print the merged config, with secrets redacted, and exit")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.key] = fs.String(flagName(s.key), s.def, s.usage+" (env "+envName(s.key)+")")
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, errors.New("Recieved unexpected argument: " + fs.Arg(0) + ". Hint: settings are passed as --<setting>=<value>")
+	}
+
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+
+	if path != "" {
+		fileValues, err := readConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read config file %s: %v", path, err)
+		}
+
+		// sorted so unknown keys are reported the same way every time
+		keys := make([]string, 0, len(fileValues))
+		for key := range fileValues {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, ok := findSetting(key); !ok {
+				return nil, errors.New("Recieved unknown setting " + key + " in " + path)
+			}
+			values[key] = configValue{val: fileValues[key], source: path}
+		}
+	}
+
+	for _, s := range settings {
+		if val, ok := lookupEnv(envName(s.key)); ok {
+			values[s.key] = configValue{val: val, source: envName(s.key)}
+			continue
+		}
+		if s.legacyEnv == "" {
+			continue
+		}
+		if val, ok := lookupEnv(s.legacyEnv); ok && val != "" {
+			if s.fromLegacy != nil {
+				val = s.fromLegacy(val)
+			}
+			values[s.key] = configValue{val: val, source: s.legacyEnv}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if flagName(s.key) == f.Name {
+				values[s.key] = configValue{val: *flagValues[s.key], source: "--" + f.Name}
+			}
+		}
+	})
+
+	loaded := &loadedConfig{values: values, path: path, print: *printConfig}
+
+	var problems []string
+	for _, s := range settings {
+		v := values[s.key]
+		err := s.set(&loaded.cfg, v.val)
+		if err != nil {
+			name := v.source
+			switch {
+			case v.source == "default":
+				name = s.key
+			case v.source == path:
+				name = s.key + " in " + path
+			}
+			problems = append(problems, "Recieved invalid "+name+": "+v.val+". Hint: "+err.Error())
+		}
+	}
+
+	// secrets read from files replace whatever was set inline
+	for _, s := range settings {
+		file := values[s.key].val
+		if s.fileOf == "" || file == "" {
+			continue
+		}
+
+		if values[s.fileOf].val != "" {
+			problems = append(problems, "Recieved both "+s.fileOf+" and "+s.key+". Hint: set one or the other")
+			continue
+		}
+
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			problems = append(problems, "Could not read "+s.key+": "+err.Error())
+			continue
+		}
+
+		secret, _ := findSetting(s.fileOf)
+		secret.set(&loaded.cfg, strings.TrimSpace(string(body)))
+	}
+
+	problems = append(problems, loaded.cfg.conflicts()...)
+
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+
+	return loaded, nil
+}
+
+// every file the config came from, checked for changes while we run
+func (l *loadedConfig) files() []string {
+	var files []string
+	if l.path != "" {
+		files = append(files, l.path)
+	}
+	for _, s := range settings {
+		if s.fileOf != "" && l.values[s.key].val != "" {
+			files = append(files, l.values[s.key].val)
+		}
+	}
+	return files
+}
+
+// Settings that are fine on their own but not together
+func (c serverConfig) conflicts() []string {
+	var problems []string
+
+	if (c.tls.certFile == "") != (c.tls.keyFile == "") {
+		problems = append(problems, "Recieved only one of tls.cert_file and tls.key_file. Hint: set both to serve TLS, or neither")
+	}
+
+	if c.tls.clientCAFile != "" && c.tls.certFile == "" {
+		problems = append(problems, "Recieved tls.client_ca_file without tls.cert_file. Hint: mutual TLS needs the server to serve TLS too")
+	}
+
+	return problems
+}
+
+// Things that work but probably aren't what was meant
+func (c serverConfig) warnings() []string {
+	var warnings []string
+
+	if c.upstream.githubToken == "" {
+		warnings = append(warnings, "WARNING: upstream.github_token not set. API requests to github will be rate limited")
+	}
+
+	if c.auth.enabled && c.auth.adminKey == "" && len(c.auth.adminClients) == 0 {
+		warnings = append(warnings, "WARNING: auth.enabled is set without auth.admin_key or auth.admin_clients. There is no way to mint API keys")
+	}
+
+	if c.webhooks.url != "" && c.webhooks.secret == "" {
+		warnings = append(warnings, "WARNING: webhooks.secret not set. Webhook payloads will not be signed")
+	}
+
+	if c.rateLimits.shared && c.storePath == "" {
+		warnings = append(warnings, "WARNING: ratelimit.shared is set without storage.path. Rate limit buckets will be kept in memory")
+	}
+
+	if c.watchlist.alertURL != "" && c.watchlist.alertSecret == "" {
+		warnings = append(warnings, "WARNING: watchlist.alert_secret not set. Alert payloads will not be signed")
+	}
+
+	return warnings
+}
+
+// Write the merged config as yaml that can be used as a config file,
+// with where each value came from. Secrets are redacted
+func (l *loadedConfig) write(w io.Writer) {
+	fmt.Fprintln(w, "# rainbow-road server config, secrets are redacted")
+
+	section := ""
+	for _, s := range settings {
+		v := l.values[s.key]
+
+		name := s.key
+		indent := ""
+		if i := strings.Index(s.key, "."); i != -1 {
+			if s.key[:i] != section {
+				section = s.key[:i]
+				fmt.Fprintf(w, "%s:\n", section)
+			}
+			name = s.key[i+1:]
+			indent = "  "
+		}
+
+		val := strconv.Quote(v.val)
+		if s.secret && v.val != "" {
+			val = `"<redacted>"`
+		}
+
+		fmt.Fprintf(w, "%s%s: %s # %s\n", indent, name, val, v.source)
+	}
+}
+
+// the config with nothing but defaults, what the globals start out as
+func defaultConfig() serverConfig {
+	var cfg serverConfig
+	for _, s := range settings {
+		err := s.set(&cfg, s.def)
+		if err != nil {
+			panic("bad default for " + s.key + ": " + err.Error())
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to fake the environment
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		val, ok := env[key]
+		return val, ok
+	}
+}
+
+// helper to write a config file into a temp dir
+func writeConfigFile(t *testing.T, name string, body string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(body), 0600))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestNames(t *testing.T) {
+	assert.Equal(t, "RAINBOW_ROAD_UPSTREAM_TIMEOUT", envName("upstream.timeout"))
+	assert.Equal(t, "RAINBOW_ROAD_GRPC_LISTEN", envName("grpc_listen"))
+	assert.Equal(t, "cache.max-age", flagName("cache.max_age"))
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	loaded, err := loadConfig(nil, testEnv(nil))
+	assert.Nil(t, err)
+	assert.False(t, loaded.print)
+
+	cfg := loaded.cfg
+	assert.Equal(t, defaultConfig(), cfg)
+	assert.Equal(t, ":9999", cfg.listen)
+	assert.Equal(t, ":9998", cfg.grpcListen)
+	assert.Equal(t, "https://api.github.com/", cfg.upstream.githubURL)
+	assert.Equal(t, 10*time.Second, cfg.upstream.timeout)
+	assert.Equal(t, 60*time.Second, cfg.cacheMaxAge)
+	assert.Equal(t, 1000, cfg.historySize)
+	assert.Equal(t, time.Hour, cfg.historyInterval)
+	assert.Equal(t, defaultRequestLimits, cfg.limits)
+	assert.Equal(t, jobsConfig{workers: 2, concurrency: 10, retention: 24 * time.Hour}, cfg.jobs)
+	assert.Equal(t, "json", cfg.webhooks.format)
+	assert.Equal(t, 5*time.Minute, cfg.watchlist.pollInterval)
+	assert.Equal(t, defaultShutdownConfig, cfg.shutdown)
+	assert.Equal(t, "default", loaded.values["listen"].source)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "server.yaml", `
+listen: ":8000"
+upstream:
+  timeout: 5s
+  concurrency: 20
+cache:
+  max_age: 2m
+jobs:
+  workers: 4
+`)
+	defer cleanup()
+
+	env := testEnv(map[string]string{
+		"RAINBOW_ROAD_CONFIG":               path,
+		"RAINBOW_ROAD_UPSTREAM_CONCURRENCY": "30",
+		"RAINBOW_ROAD_JOBS_WORKERS":         "6",
+	})
+
+	loaded, err := loadConfig([]string{"--jobs.workers=8"}, env)
+	assert.Nil(t, err)
+
+	// file beats defaults, env beats the file, flags beat everything
+	assert.Equal(t, ":8000", loaded.cfg.listen)
+	assert.Equal(t, 5*time.Second, loaded.cfg.upstream.timeout)
+	assert.Equal(t, 2*time.Minute, loaded.cfg.cacheMaxAge)
+	assert.Equal(t, 30, loaded.cfg.upstream.concurrency)
+	assert.Equal(t, 8, loaded.cfg.jobs.workers)
+
+	assert.Equal(t, path, loaded.values["listen"].source)
+	assert.Equal(t, "RAINBOW_ROAD_UPSTREAM_CONCURRENCY", loaded.values["upstream.concurrency"].source)
+	assert.Equal(t, "--jobs.workers", loaded.values["jobs.workers"].source)
+
+	// --config wins over RAINBOW_ROAD_CONFIG
+	_, err = loadConfig([]string{"--config", "/does/not/exist.yaml"}, env)
+	assert.Contains(t, err.Error(), "Could not read config file /does/not/exist.yaml")
+}
+
+func TestLoadConfigLegacyEnv(t *testing.T) {
+	env := map[string]string{
+		"GITHUB_TOKEN":      "token",
+		"GITLAB_URL":        "https://gitlab.example.com",
+		"GRPC_PORT":         "7000",
+		"MAX_REPOS":         "10",
+		"STRICT_REQUESTS":   "true",
+		"JOB_RETENTION":     "2h",
+		"WEBHOOK_URL":       "http://localhost:8080/hook",
+		"WEBHOOK_SECRET":    "secret",
+		"SHUTDOWN_DELAY":    "0s",
+		"STORE_PATH":        "/data/store.json",
+		"MAX_REQUEST_BYTES": "2048",
+
+		"WATCHLIST_POLL_INTERVAL": "30s",
+		"ALERT_WEBHOOK_URL":       "http://localhost:8080/alerts",
+		"ALERT_WEBHOOK_SECRET":    "alerts",
+	}
+
+	loaded, err := loadConfig(nil, testEnv(env))
+	assert.Nil(t, err)
+
+	cfg := loaded.cfg
+	assert.Equal(t, "token", cfg.upstream.githubToken)
+	assert.Equal(t, "https://gitlab.example.com/", cfg.upstream.gitlabURL)
+	assert.Equal(t, ":7000", cfg.grpcListen)
+	assert.Equal(t, requestLimits{maxBytes: 2048, maxRepos: 10, maxJobRepos: 10000, strict: true}, cfg.limits)
+	assert.Equal(t, 2*time.Hour, cfg.jobs.retention)
+	assert.Equal(t, "http://localhost:8080/hook", cfg.webhooks.url)
+	assert.Equal(t, "secret", cfg.webhooks.secret)
+	assert.Equal(t, time.Duration(0), cfg.shutdown.delay)
+	assert.Equal(t, "/data/store.json", cfg.storePath)
+	assert.Equal(t, watchlistConfig{pollInterval: 30 * time.Second, alertURL: "http://localhost:8080/alerts", alertSecret: "alerts"}, cfg.watchlist)
+
+	// the new names win when both are set
+	env["RAINBOW_ROAD_UPSTREAM_GITHUB_TOKEN"] = "newer"
+	loaded, err = loadConfig(nil, testEnv(env))
+	assert.Nil(t, err)
+	assert.Equal(t, "newer", loaded.cfg.upstream.githubToken)
+}
+
+// what the old getAuth, getGRPCAddr, getJobRetention, getShutdownConfig,
+// getRequestLimits, getWebhookConfig and getBaseURL did still holds
+func TestLoadConfigLegacyEnvDefaults(t *testing.T) {
+	loaded, err := loadConfig(nil, testEnv(nil))
+	assert.Nil(t, err)
+
+	cfg := loaded.cfg
+	assert.Equal(t, ":9998", cfg.grpcListen)
+	assert.Equal(t, 24*time.Hour, cfg.jobs.retention)
+	assert.Equal(t, shutdownConfig{delay: 5 * time.Second, grace: 25 * time.Second}, cfg.shutdown)
+	assert.Equal(t, requestLimits{maxBytes: 1 << 20, maxRepos: 1000, maxJobRepos: 10000}, cfg.limits)
+	assert.Equal(t, "", cfg.webhooks.url)
+	assert.Equal(t, "json", cfg.webhooks.format)
+	assert.Equal(t, "https://gitlab.com/", cfg.upstream.gitlabURL)
+
+	// no token still works, with a warning
+	assert.Equal(t, "", cfg.upstream.githubToken)
+	assert.Contains(t, cfg.warnings(), "WARNING: upstream.github_token not set. API requests to github will be rate limited")
+
+	loaded, err = loadConfig(nil, testEnv(map[string]string{
+		"GITHUB_TOKEN":          "test",
+		"GITLAB_URL":            "https://gitlab.example.com",
+		"MAX_JOB_REPOS":         "100",
+		"SHUTDOWN_GRACE_PERIOD": "1m",
+		"WEBHOOK_FORMAT":        "cloudevents",
+	}))
+	assert.Nil(t, err)
+	cfg = loaded.cfg
+	assert.Equal(t, "test", cfg.upstream.githubToken)
+	assert.NotContains(t, cfg.warnings(), "WARNING: upstream.github_token not set. API requests to github will be rate limited")
+	assert.Equal(t, "https://gitlab.example.com/", cfg.upstream.gitlabURL)
+	assert.Equal(t, 100, cfg.limits.maxJobRepos)
+	assert.Equal(t, shutdownConfig{delay: 5 * time.Second, grace: time.Minute}, cfg.shutdown)
+	assert.Equal(t, "cloudevents", cfg.webhooks.format)
+
+	for env, want := range map[string]string{
+		"GRPC_PORT=port":                "Recieved invalid GRPC_PORT: :port. Hint: host:port or :port",
+		"JOB_RETENTION=forever":         "Recieved invalid JOB_RETENTION: forever. Hint: ",
+		"SHUTDOWN_DELAY=later":          "Recieved invalid SHUTDOWN_DELAY: later. Hint: ",
+		"SHUTDOWN_GRACE_PERIOD=soon":    "Recieved invalid SHUTDOWN_GRACE_PERIOD: soon. Hint: ",
+		"MAX_REQUEST_BYTES=lots":        "Recieved invalid MAX_REQUEST_BYTES: lots. Hint: ",
+		"MAX_REPOS=0":                   "Recieved invalid MAX_REPOS: 0. Hint: a number above 0",
+		"MAX_JOB_REPOS=-1":              "Recieved invalid MAX_JOB_REPOS: -1. Hint: a number above 0",
+		"STRICT_REQUESTS=sometimes":     "Recieved invalid STRICT_REQUESTS: sometimes. Hint: true or false",
+		"WEBHOOK_URL=localhost/hook":    "Recieved invalid WEBHOOK_URL: localhost/hook. Hint: ",
+		"WEBHOOK_FORMAT=xml":            "Recieved invalid WEBHOOK_FORMAT: xml. Hint: json or cloudevents",
+		"GITLAB_URL=gitlab.example.com": "Recieved invalid GITLAB_URL: gitlab.example.com. Hint: ",
+	} {
+		parts := strings.SplitN(env, "=", 2)
+		_, err := loadConfig(nil, testEnv(map[string]string{parts[0]: parts[1]}))
+		if assert.Error(t, err, env) {
+			assert.True(t, strings.HasPrefix(err.Error(), want), err.Error())
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+
+	// every bad value is reported at once, named the way it was set
+	_, err := loadConfig([]string{"--upstream.timeout=soon"}, testEnv(map[string]string{
+		"MAX_REPOS":                  "0",
+		"WEBHOOK_FORMAT":             "xml",
+		"RAINBOW_ROAD_LISTEN":        "9999",
+		"RAINBOW_ROAD_WEBHOOKS_URL":  "localhost/hook",
+		"RAINBOW_ROAD_JOBS_WORKERS":  "-1",
+		"RAINBOW_ROAD_CACHE_MAX_AGE": "-1s",
+	}))
+	assert.EqualError(t, err, strings.Join([]string{
+		"Recieved invalid RAINBOW_ROAD_LISTEN: 9999. Hint: host:port or :port, ie :9999",
+		"Recieved invalid --upstream.timeout: soon. Hint: a duration above 0 like 30s or 1m",
+		"Recieved invalid RAINBOW_ROAD_CACHE_MAX_AGE: -1s. Hint: a duration like 30s or 1m",
+		"Recieved invalid MAX_REPOS: 0. Hint: a number above 0",
+		"Recieved invalid RAINBOW_ROAD_JOBS_WORKERS: -1. Hint: a number above 0",
+		"Recieved invalid RAINBOW_ROAD_WEBHOOKS_URL: localhost/hook. Hint: an http or https url, ie https://api.github.com/",
+		"Recieved invalid WEBHOOK_FORMAT: xml. Hint: json or cloudevents",
+	}, "\n"))
+
+	// bad values in a file say which file
+	path, cleanup := writeConfigFile(t, "server.toml", "[requests]\nstrict = \"sometimes\"\n")
+	defer cleanup()
+	_, err = loadConfig([]string{"--config", path}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved invalid requests.strict in "+path+": sometimes. Hint: true or false")
+
+	// typos in the file are caught
+	path, cleanup = writeConfigFile(t, "typo.yaml", "upstream:\n  timout: 5s\n")
+	defer cleanup()
+	_, err = loadConfig([]string{"--config", path}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved unknown setting upstream.timout in "+path)
+
+	path, cleanup = writeConfigFile(t, "server.json", "{}")
+	defer cleanup()
+	_, err = loadConfig([]string{"--config", path}, testEnv(nil))
+	assert.Contains(t, err.Error(), "Hint: .yaml, .yml or .toml")
+
+	_, err = loadConfig([]string{"serve"}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved unexpected argument: serve. Hint: settings are passed as --<setting>=<value>")
+
+	_, err = loadConfig([]string{"--no-such-flag"}, testEnv(nil))
+	assert.NotNil(t, err)
+}
+
+func TestParseTOML(t *testing.T) {
+	values, err := parseTOML(strings.NewReader(`
+# top level settings come first
+listen = ":8000" # trailing comment
+
+[upstream]
+github_url = 'https://github.example.com/api/v3/'
+concurrency = 1_000
+token_hint = "has a # in it"
+
+[requests]
+strict = true
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"listen":               ":8000",
+		"upstream.github_url":  "https://github.example.com/api/v3/",
+		"upstream.concurrency": "1000",
+		"upstream.token_hint":  "has a # in it",
+		"requests.strict":      "true",
+	}, values)
+
+	_, err = parseTOML(strings.NewReader("[upstream\n"))
+	assert.EqualError(t, err, "line 1: unclosed section header")
+
+	_, err = parseTOML(strings.NewReader("listen\n"))
+	assert.EqualError(t, err, "line 1: expected key = value")
+
+	_, err = parseTOML(strings.NewReader("\nlisten = {a = 1}\n"))
+	assert.EqualError(t, err, "line 2: unsupported value {a = 1}, use a quoted string, number, true/false or an array")
+
+	// arrays are joined with commas like yaml lists
+	values, err = parseTOML(strings.NewReader(`
+[auth]
+admin_clients = ["spiffe://a", 'b,c', "d # not a comment", ] # comment
+empty = []
+
+[ratelimit]
+routes = ["/stars=1/s", "/repos/=off"]
+ports = [1, 2]
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"auth.admin_clients": "spiffe://a,b,c,d # not a comment",
+		"auth.empty":         "",
+		"ratelimit.routes":   "/stars=1/s,/repos/=off",
+		"ratelimit.ports":    "1,2",
+	}, values)
+
+	_, err = parseTOML(strings.NewReader("routes = [\n"))
+	assert.EqualError(t, err, "line 1: unclosed array [, arrays have to fit on one line")
+
+	_, err = parseTOML(strings.NewReader("routes = [[1], [2]]\n"))
+	assert.EqualError(t, err, "line 1: unsupported value [[1], [2]], arrays can only hold strings, numbers or true/false")
+
+	// and end up as the same settings a yaml list does
+	path, cleanup := writeConfigFile(t, "server.toml", "[auth]\nenabled = true\nadmin_clients = [\"spiffe://a\", \"spiffe://b\"]\n\n[ratelimit]\nroutes = [\"/stars=1/s\"]\n")
+	defer cleanup()
+	loaded, err := loadConfig([]string{"--config", path}, testEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"spiffe://a", "spiffe://b"}, loaded.cfg.auth.adminClients)
+	assert.Equal(t, []routeLimit{{route: "/stars", limit: rateLimit{requests: 1, per: time.Second}}}, loaded.cfg.rateLimits.routes)
+}
+
+func TestPrintConfig(t *testing.T) {
+	loaded, err := loadConfig([]string{"--print-config", "--listen=:8000"}, testEnv(map[string]string{
+		"GITHUB_TOKEN": "super-secret",
+	}))
+	assert.Nil(t, err)
+	assert.True(t, loaded.print)
+
+	var buf bytes.Buffer
+	loaded.write(&buf)
+	out := buf.String()
+
+	assert.Contains(t, out, "listen: \":8000\" # --listen\n")
+	assert.Contains(t, out, "upstream:\n  github_url: \"https://api.github.com/\" # default\n")
+	assert.Contains(t, out, "  github_token: \"<redacted>\" # GITHUB_TOKEN\n")
+	assert.Contains(t, out, "  gitlab_token: \"\" # default\n")
+	assert.NotContains(t, out, "super-secret")
+
+	// what we print can be read back in
+	path, cleanup := writeConfigFile(t, "printed.yaml", out)
+	defer cleanup()
+	reloaded, err := loadConfig([]string{"--config", path}, testEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, ":8000", reloaded.cfg.listen)
+}
+
+func TestConfigWarnings(t *testing.T) {
+	cfg := defaultConfig()
+	assert.Equal(t, []string{"WARNING: upstream.github_token not set. API requests to github will be rate limited"}, cfg.warnings())
+
+	cfg.upstream.githubToken = "token"
+	cfg.webhooks.url = "http://localhost:8080/hook"
+	assert.Equal(t, []string{"WARNING: webhooks.secret not set. Webhook payloads will not be signed"}, cfg.warnings())
+
+	cfg.webhooks.secret = "secret"
+	assert.Empty(t, cfg.warnings())
+
+	cfg.watchlist.alertURL = "http://localhost:8080/alerts"
+	assert.Equal(t, []string{"WARNING: watchlist.alert_secret not set. Alert payloads will not be signed"}, cfg.warnings())
+
+	cfg.watchlist.alertSecret = "secret"
+	cfg.rateLimits.shared = true
+	assert.Equal(t, []string{"WARNING: ratelimit.shared is set without storage.path. Rate limit buckets will be kept in memory"}, cfg.warnings())
+
+	cfg.storePath = "/data/store.json"
+	assert.Empty(t, cfg.warnings())
+}
+
+func TestDoUpstream(t *testing.T) {
+	defer func() { upstreamSlots = make(chan struct{}, 100) }()
+	upstreamSlots = make(chan struct{}, 1)
+
+	close := mockGithubAPI(`{}`, 200)
+	defer close()
+
+	// the slot is held until the body is closed
+	req, _ := http.NewRequest("GET", serverURLOverride, nil)
+	resp, err := doUpstream(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(upstreamSlots))
+
+	resp.Body.Close()
+	resp.Body.Close()
+	assert.Equal(t, 0, len(upstreamSlots))
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "token", "from-a-file\n")
+	defer cleanup()
+
+	loaded, err := loadConfig([]string{"--upstream.github-token-file", path}, testEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "from-a-file", loaded.cfg.upstream.githubToken)
+	assert.Equal(t, []string{path}, loaded.files())
+
+	_, err = loadConfig([]string{"--upstream.github-token-file", path}, testEnv(map[string]string{"GITHUB_TOKEN": "inline"}))
+	assert.EqualError(t, err, "Recieved both upstream.github_token and upstream.github_token_file. Hint: set one or the other")
+
+	_, err = loadConfig([]string{"--webhooks.secret-file", "/does/not/exist"}, testEnv(nil))
+	assert.EqualError(t, err, "Could not read webhooks.secret_file: open /does/not/exist: no such file or directory")
+}
+
+func TestConfigConflicts(t *testing.T) {
+	_, err := loadConfig([]string{"--tls.cert-file=server.crt", "--tls.client-ca-file=ca.crt"}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved only one of tls.cert_file and tls.key_file. Hint: set both to serve TLS, or neither")
+
+	_, err = loadConfig([]string{"--tls.client-ca-file=ca.crt"}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved tls.client_ca_file without tls.cert_file. Hint: mutual TLS needs the server to serve TLS too")
+
+	_, err = loadConfig([]string{"--tls.client-auth=sometimes"}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved invalid --tls.client-auth: sometimes. Hint: require or verify_if_given")
+}
+
+func TestLoadConfigAuth(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "server.yaml", `
+auth:
+  enabled: true
+  admin_clients:
+    - spiffe://cluster/ops
+    - ops.internal
+`)
+	defer cleanup()
+
+	loaded, err := loadConfig([]string{"--config", path}, testEnv(map[string]string{"RAINBOW_ROAD_AUTH_DEFAULT_QUOTA": "500"}))
+	assert.Nil(t, err)
+	assert.Equal(t, authSettings{enabled: true, adminClients: []string{"spiffe://cluster/ops", "ops.internal"}, defaultQuota: 500}, loaded.cfg.auth)
+
+	loaded, err = loadConfig([]string{"--auth.admin-clients", " a, ,b "}, testEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, loaded.cfg.auth.adminClients)
+
+	cfg := defaultConfig()
+	cfg.upstream.githubToken = "token"
+	cfg.auth.enabled = true
+	assert.Equal(t, []string{"WARNING: auth.enabled is set without auth.admin_key or auth.admin_clients. There is no way to mint API keys"}, cfg.warnings())
+
+	cfg.auth.adminKey = "admin"
+	assert.Empty(t, cfg.warnings())
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------ FILTERS ------------------------------
+
+// Filter expressions pick repos by their metadata, ie
+//
+//	stars > 1000 && language == "Go" && !archived
+//
+// Expressions can only compare fields with literals and combine the
+// results, there is nothing in the language that can loop, call out or
+// touch the server, so they are safe to take from clients. Fields and
+// types are checked when the filter is parsed.
+
+// longest filter we take and how deep brackets and ! can nest
+const (
+	maxFilterLength = 1000
+	maxFilterDepth  = 50
+)
+
+type filterType int
+
+const (
+	filterNumber filterType = iota
+	filterString
+	filterBool
+)
+
+func (t filterType) String() string {
+	switch t {
+	case filterNumber:
+		return "number"
+	case filterString:
+		return "string"
+	default:
+		return "bool"
+	}
+}
+
+// every field a filter can use
+var filterFields = map[string]filterType{
+	"name":            filterString,
+	"owner":           filterString,
+	"provider":        filterString,
+	"status":          filterString,
+	"stars":           filterNumber,
+	"forks":           filterNumber,
+	"open_issues":     filterNumber,
+	"language":        filterString,
+	"archived":        filterBool,
+	"days_since_push": filterNumber,
+}
+
+// the values a filter sees for a repo. Counts we don't have are -1
+func filterValues(res repoResult) map[string]interface{} {
+	provider := "github"
+	path := res.Name
+	if i := strings.Index(res.Name, ":"); i != -1 {
+		provider = res.Name[:i]
+		path = res.Name[i+1:]
+	}
+
+	owner := path
+	if i := strings.Index(path, "/"); i != -1 {
+		owner = path[:i]
+	}
+
+	daysSincePush := -1.0
+	if !res.Meta.PushedAt.IsZero() {
+		daysSincePush = math.Floor(time.Since(res.Meta.PushedAt).Hours() / 24)
+	}
+
+	stars := res.Stars
+	if res.Err != nil {
+		stars = -1
+	}
+
+	return map[string]interface{}{
+		"name":            res.Name,
+		"owner":           owner,
+		"provider":        provider,
+		"status":          lookupStatus(res.Err),
+		"stars":           float64(stars),
+		"forks":           float64(res.Meta.Forks),
+		"open_issues":     float64(res.Meta.OpenIssues),
+		"language":        res.Meta.Language,
+		"archived":        res.Meta.Archived,
+		"days_since_push": daysSincePush,
+	}
+}
+
+// A parsed filter, ready to check repos against
+type repoFilter struct {
+	source string
+	root   filterNode
+}
+
+// check a repo against the filter
+func (f *repoFilter) matches(res repoResult) bool {
+	return f.root.eval(filterValues(res)).(bool)
+}
+
+// ------------------------------- lexer -------------------------------
+
+type filterTokenKind int
+
+const (
+	tokenEOF filterTokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	// 1 based position in the filter, for errors
+	pos int
+}
+
+// every operator, longest first so <= wins over <
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func filterError(pos int, format string, args ...interface{}) error {
+	return errors.New("Recieved invalid filter: " + fmt.Sprintf(format, args...) + " at position " + strconv.Itoa(pos))
+}
+
+// split a filter into tokens
+func lexFilter(src string) ([]filterToken, error) {
+	var tokens []filterToken
+	i := 0
+
+	for i < len(src) {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenNumber, src[start:i], start + 1})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, src[start:i], start + 1})
+		case c == '"':
+			start := i
+			i++
+			for i < len(src) && src[i] != '"' {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, filterError(start+1, "unterminated string")
+			}
+			i++
+			text, err := strconv.Unquote(src[start:i])
+			if err != nil {
+				return nil, filterError(start+1, "bad string %s", src[start:i])
+			}
+			tokens = append(tokens, filterToken{tokenString, text, start + 1})
+		default:
+			op := ""
+			for _, candidate := range filterOps {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, filterError(i+1, "unexpected %q", c)
+			}
+			tokens = append(tokens, filterToken{tokenOp, op, i + 1})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, filterToken{tokenEOF, "", len(src) + 1}), nil
+}
+
+// ------------------------------- parser -------------------------------
+
+// A piece of a parsed filter. Types are known up front so eval never fails
+type filterNode interface {
+	typ() filterType
+	eval(values map[string]interface{}) interface{}
+}
+
+type filterLiteral struct {
+	t   filterType
+	val interface{}
+}
+
+func (n *filterLiteral) typ() filterType                                { return n.t }
+func (n *filterLiteral) eval(values map[string]interface{}) interface{} { return n.val }
+
+type filterField struct {
+	name string
+}
+
+func (n *filterField) typ() filterType                                { return filterFields[n.name] }
+func (n *filterField) eval(values map[string]interface{}) interface{} { return values[n.name] }
+
+type filterNot struct {
+	x filterNode
+}
+
+func (n *filterNot) typ() filterType { return filterBool }
+func (n *filterNot) eval(values map[string]interface{}) interface{} {
+	return !n.x.eval(values).(bool)
+}
+
+// && and ||
+type filterLogic struct {
+	op   string
+	x, y filterNode
+}
+
+func (n *filterLogic) typ() filterType { return filterBool }
+func (n *filterLogic) eval(values map[string]interface{}) interface{} {
+	x := n.x.eval(values).(bool)
+	if n.op == "&&" {
+		return x && n.y.eval(values).(bool)
+	}
+	return x || n.y.eval(values).(bool)
+}
+
+// ==, !=, <, <=, > and >=
+type filterCompare struct {
+	op   string
+	x, y filterNode
+}
+
+func (n *filterCompare) typ() filterType { return filterBool }
+func (n *filterCompare) eval(values map[string]interface{}) interface{} {
+	x, y := n.x.eval(values), n.y.eval(values)
+
+	switch n.op {
+	case "==":
+		return x == y
+	case "!=":
+		return x != y
+	}
+
+	// the parser only lets numbers through to here
+	a, b := x.(float64), y.(float64)
+	switch n.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+// recursive descent parser, one method per precedence level
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	depth  int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// check if the next token is one of these operators
+func (p *filterParser) atOp(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokenOp {
+		return false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// helper to describe a token in an error
+func describeToken(tok filterToken) string {
+	if tok.kind == tokenEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(tok.text)
+}
+
+func (p *filterParser) expectBool(node filterNode, tok filterToken, what string) error {
+	if node.typ() != filterBool {
+		return filterError(tok.pos, "%s needs true or false, got a %s", what, node.typ())
+	}
+	return nil
+}
+
+// or := and ("||" and)*
+func (p *filterParser) parseOr() (filterNode, error) {
+	return p.parseLogic("||", p.parseAnd)
+}
+
+// and := unary ("&&" unary)*
+func (p *filterParser) parseAnd() (filterNode, error) {
+	return p.parseLogic("&&", p.parseUnary)
+}
+
+func (p *filterParser) parseLogic(op string, operand func() (filterNode, error)) (filterNode, error) {
+	start := p.peek()
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.atOp(op) {
+		opTok := p.next()
+		if err := p.expectBool(x, start, op); err != nil {
+			return nil, err
+		}
+
+		start = p.peek()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectBool(y, start, op); err != nil {
+			return nil, err
+		}
+
+		x = &filterLogic{op: opTok.text, x: x, y: y}
+	}
+
+	return x, nil
+}
+
+// unary := "!" unary | compare
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if !p.atOp("!") {
+		return p.parseCompare()
+	}
+
+	p.next()
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterDepth {
+		return nil, filterError(p.peek().pos, "too deeply nested")
+	}
+
+	start := p.peek()
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectBool(x, start, "!"); err != nil {
+		return nil, err
+	}
+
+	return &filterNot{x: x}, nil
+}
+
+// compare := primary (op primary)?
+func (p *filterParser) parseCompare() (filterNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.atOp("==", "!=", "<", "<=", ">", ">=") {
+		return x, nil
+	}
+
+	opTok := p.next()
+	y, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if x.typ() != y.typ() {
+		return nil, filterError(opTok.pos, "can't compare a %s with a %s", x.typ(), y.typ())
+	}
+
+	if opTok.text != "==" && opTok.text != "!=" && x.typ() != filterNumber {
+		return nil, filterError(opTok.pos, "%s only works on numbers, got a %s", opTok.text, x.typ())
+	}
+
+	return &filterCompare{op: opTok.text, x: x, y: y}, nil
+}
+
+// primary := number | string | true | false | field | "(" or ")"
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenNumber:
+		num, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, filterError(tok.pos, "bad number %s", tok.text)
+		}
+		return &filterLiteral{filterNumber, num}, nil
+	case tokenString:
+		return &filterLiteral{filterString, tok.text}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return &filterLiteral{filterBool, true}, nil
+		case "false":
+			return &filterLiteral{filterBool, false}, nil
+		}
+		if _, ok := filterFields[tok.text]; !ok {
+			return nil, filterError(tok.pos, "unknown field %s", tok.text)
+		}
+		return &filterField{name: tok.text}, nil
+	case tokenOp:
+		if tok.text == "(" {
+			p.depth++
+			defer func() { p.depth-- }()
+			if p.depth > maxFilterDepth {
+				return nil, filterError(tok.pos, "too deeply nested")
+			}
+
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.atOp(")") {
+				return nil, filterError(p.peek().pos, "expected ) but got %s", describeToken(p.peek()))
+			}
+			p.next()
+			return x, nil
+		}
+	}
+
+	return nil, filterError(tok.pos, "unexpected %s", describeToken(tok))
+}
+
+// Parse and type check a filter expression
+func parseFilter(src string) (*repoFilter, error) {
+	if len(src) > maxFilterLength {
+		return nil, errors.New("Recieved invalid filter: longer than " + strconv.Itoa(maxFilterLength) + " characters")
+	}
+
+	tokens, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, filterError(tok.pos, "unexpected %s", describeToken(tok))
+	}
+
+	if root.typ() != filterBool {
+		return nil, filterError(1, "filter needs to be true or false, got a %s", root.typ())
+	}
+
+	return &repoFilter{source: src, root: root}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, expr := range []string{
+		`stars > 1000`,
+		`stars > 1000 && language == "Go" && !archived`,
+		`(forks >= 10 || open_issues < 5) && provider != "gitlab"`,
+		`!!archived`,
+		`status == "not_found" || days_since_push <= 30.5`,
+		`archived == false`,
+	} {
+		_, err := parseFilter(expr)
+		assert.Nil(t, err, expr)
+	}
+
+	for expr, msg := range map[string]string{
+		`stars >`:                "unexpected end of filter at position 8",
+		`stars > 1000 &&`:        "unexpected end of filter at position 16",
+		`stars >> 1`:             `unexpected ">" at position 8`,
+		`(stars > 1`:             "expected ) but got end of filter at position 11",
+		`stars > 1)`:             `unexpected ")" at position 10`,
+		`watchers > 1`:           "unknown field watchers at position 1",
+		`language == 1`:          "can't compare a string with a number at position 10",
+		`language > "Go"`:        "> only works on numbers, got a string at position 10",
+		`stars`:                  "filter needs to be true or false, got a number at position 1",
+		`stars && archived`:      "&& needs true or false, got a number at position 1",
+		`archived || "yes"`:      "|| needs true or false, got a string at position 13",
+		`!stars`:                 "! needs true or false, got a number at position 2",
+		`language == "Go`:        "unterminated string at position 13",
+		`stars > 1.2.3`:          "bad number 1.2.3 at position 9",
+		`stars > 1 ; drop table`: `unexpected ';' at position 11`,
+	} {
+		_, err := parseFilter(expr)
+		assert.EqualError(t, err, "Recieved invalid filter: "+msg, expr)
+	}
+
+	_, err := parseFilter(string(bytes.Repeat([]byte("("), 60)) + "archived" + string(bytes.Repeat([]byte(")"), 60)))
+	assert.EqualError(t, err, "Recieved invalid filter: too deeply nested at position 51")
+
+	_, err = parseFilter(string(bytes.Repeat([]byte(" "), maxFilterLength+1)))
+	assert.EqualError(t, err, "Recieved invalid filter: longer than 1000 characters")
+}
+
+func TestFilterMatches(t *testing.T) {
+	goRepo := repoResult{Name: "rdelpret/kfx", Stars: 1500, Meta: repoMeta{Forks: 20, OpenIssues: 3, Language: "Go", PushedAt: time.Now().Add(-72 * time.Hour)}}
+	archived := repoResult{Name: "gitlab:group/project", Stars: 5000, Meta: repoMeta{Forks: -1, OpenIssues: -1, Archived: true}}
+	missing := repoResult{Name: "rdelpret/missing", Stars: -1, Err: &lookupError{StatusNotFound, errors.New("Repo Not found: rdelpret/missing")}}
+
+	check := func(expr string, res repoResult) bool {
+		filter, err := parseFilter(expr)
+		assert.Nil(t, err)
+		return filter.matches(res)
+	}
+
+	expr := `stars > 1000 && language == "Go" && !archived`
+	assert.True(t, check(expr, goRepo))
+	assert.False(t, check(expr, archived))
+	assert.False(t, check(expr, missing))
+
+	assert.True(t, check(`provider == "gitlab" && owner == "group"`, archived))
+	assert.True(t, check(`owner == "rdelpret" && days_since_push == 3`, goRepo))
+	assert.True(t, check(`status == "not_found"`, missing))
+	assert.True(t, check(`forks < 0 || archived`, archived))
+	assert.False(t, check(`!(stars >= 1500)`, goRepo))
+}
+
+func TestStarsHandlerFilter(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1, "language": "Go"}`, 200)
+	defer close()
+
+	body := `{"repos": [{"name": "rdelpret/kfx"}, {"name": "rdelpret/cartographer"}]}`
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", `/stars?filter=language+%3D%3D+%22Go%22+%26%26+stars+%3E%3D+1`, bytes.NewBufferString(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"meta":{"total":2,`)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", `/stars?filter=language+%3D%3D+%22Rust%22`, bytes.NewBufferString(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, `{"repos":[],"meta":{"total":0,"returned":0,"next_cursor":null}}`+"\n", recorder.Body.String())
+
+	// parse errors go back to the client
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", `/stars?filter=stars+%3E`, bytes.NewBufferString(body))
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Recieved invalid filter: unexpected end of filter at position 8\n", recorder.Body.String())
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// -------------------------- RESPONSE FORMATS --------------------------
+
+// formats /stars can answer in
+const (
+	formatJSON    = "application/json"
+	formatCSV     = "text/csv"
+	formatYAML    = "application/yaml"
+	formatMsgpack = "application/msgpack"
+)
+
+// every media type we understand, including the unofficial ones
+// clients still send, mapped to the format we answer with
+var responseMediaTypes = map[string]string{
+	"application/json":        formatJSON,
+	"text/csv":                formatCSV,
+	"application/yaml":        formatYAML,
+	"application/x-yaml":      formatYAML,
+	"text/yaml":               formatYAML,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+}
+
+// short names for ?format=
+var responseFormatNames = map[string]string{
+	"json":    formatJSON,
+	"csv":     formatCSV,
+	"yaml":    formatYAML,
+	"msgpack": formatMsgpack,
+}
+
+// sent back with a 406 so clients know what they can ask for
+const notAcceptableMessage = "Not Acceptable. Hint: application/json, text/csv, application/yaml or application/msgpack, or ?format=json|csv|yaml|msgpack"
+
+// Pick the response format. ?format= wins over the Accept header, and
+// the Accept header is read in order of preference. No preference is JSON.
+// Returns an empty string if nothing the client takes is something we send
+func negotiateFormat(r *http.Request) string {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return responseFormatNames[strings.ToLower(name)]
+	}
+
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return formatJSON
+	}
+
+	type accepted struct {
+		format string
+		q      float64
+	}
+
+	var candidates []accepted
+	for _, val := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(val))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(raw, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		// q=0 means the client won't take it
+		if q <= 0 {
+			continue
+		}
+
+		format := responseMediaTypes[mediaType]
+		if mediaType == "*/*" || mediaType == "application/*" {
+			format = formatJSON
+		}
+
+		if format != "" {
+			candidates = append(candidates, accepted{format: format, q: q})
+		}
+	}
+
+	// stable so equal preferences keep the client's order
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].format
+}
+
+// Turn a response into plain maps, slices and numbers using its json
+// tags, so every format has the same field names as the JSON one
+func toGeneric(val interface{}) (interface{}, error) {
+	body, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var generic interface{}
+	err = dec.Decode(&generic)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeNumbers(generic), nil
+}
+
+// swap json.Numbers for ints where they fit and floats where they don't
+func normalizeNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	case json.Number:
+		if num, err := v.Int64(); err == nil {
+			return num
+		}
+		num, _ := v.Float64()
+		return num
+	}
+	return val
+}
+
+// Write a v1 response as CSV, one row per repo. Stars are left empty for
+// lookups that failed and errors are left empty for ones that worked so
+// pandas reads them as missing
+func encodeCSV(repos Repos) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	writer.Write([]string{"name", "stars", "error"})
+	for _, repo := range repos.Repos {
+		stars, errMsg := strconv.Itoa(repo.Stars), ""
+		if repo.Stars == -1 {
+			stars, errMsg = "", repo.Error
+		}
+		writer.Write([]string{repo.Name, stars, errMsg})
+	}
+
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// Write a value as MessagePack. Only handles what toGeneric produces
+func encodeMsgpack(buf *bytes.Buffer, val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int64:
+		switch {
+		case v >= 0 && v <= 127:
+			buf.WriteByte(byte(v))
+		case v < 0 && v >= -32:
+			buf.WriteByte(byte(v))
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(v))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLength(buf, len(v), 0x90, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackLength(buf, len(v), 0x80, 0xde, 0xdf)
+
+		// sorted so the same response always encodes the same way
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			encodeMsgpack(buf, key)
+			if err := encodeMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("can't encode %T as msgpack", val)
+	}
+	return nil
+}
+
+// array and map headers share a layout, a fix type for short ones then 16 and 32 bit lengths
+func writeMsgpackLength(buf *bytes.Buffer, n int, fix byte, len16 byte, len32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(len16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(len32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// Encode a v1 /stars response in the negotiated format
+func encodeResults(format string, repos Repos) ([]byte, error) {
+	switch format {
+	case formatCSV:
+		return encodeCSV(repos)
+	case formatYAML, formatMsgpack:
+		generic, err := toGeneric(repos)
+		if err != nil {
+			return nil, err
+		}
+		if format == formatYAML {
+			return yaml.Marshal(generic)
+		}
+		var buf bytes.Buffer
+		err = encodeMsgpack(&buf, generic)
+		return buf.Bytes(), err
+	default:
+		body, err := json.Marshal(repos)
+		return append(body, '\n'), err
+	}
+}
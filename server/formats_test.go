@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	negotiate := func(accept string, query string) string {
+		req, _ := http.NewRequest("POST", "/stars"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return negotiateFormat(req)
+	}
+
+	assert.Equal(t, formatJSON, negotiate("", ""))
+	assert.Equal(t, formatJSON, negotiate("*/*", ""))
+	assert.Equal(t, formatCSV, negotiate("text/csv", ""))
+	assert.Equal(t, formatYAML, negotiate("application/x-yaml", ""))
+	assert.Equal(t, formatMsgpack, negotiate("application/vnd.msgpack", ""))
+
+	// preference order
+	assert.Equal(t, formatYAML, negotiate("text/csv;q=0.5, application/yaml", ""))
+	assert.Equal(t, formatCSV, negotiate("text/html, text/csv, application/yaml", ""))
+	assert.Equal(t, formatJSON, negotiate("text/csv;q=0, */*;q=0.1", ""))
+
+	// ?format= wins over the header
+	assert.Equal(t, formatMsgpack, negotiate("text/csv", "?format=msgpack"))
+	assert.Equal(t, formatYAML, negotiate("", "?format=YAML"))
+
+	// nothing we send
+	assert.Equal(t, "", negotiate("text/html", ""))
+	assert.Equal(t, "", negotiate("text/csv;q=0", ""))
+	assert.Equal(t, "", negotiate("", "?format=xml"))
+}
+
+func TestEncodeCSV(t *testing.T) {
+	body, err := encodeCSV(Repos{Repos: []Repo{
+		{Name: "a/b", Stars: 10, Error: "<nil>"},
+		{Name: "c/d", Stars: -1, Error: "Could not find repo, it may be private"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "name,stars,error\na/b,10,\nc/d,,\"Could not find repo, it may be private\"\n", string(body))
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	encode := func(val interface{}) []byte {
+		var buf bytes.Buffer
+		assert.Nil(t, encodeMsgpack(&buf, val))
+		return buf.Bytes()
+	}
+
+	assert.Equal(t, []byte{0xc0}, encode(nil))
+	assert.Equal(t, []byte{0xc3}, encode(true))
+	assert.Equal(t, []byte{0x07}, encode(int64(7)))
+	assert.Equal(t, []byte{0xff}, encode(int64(-1)))
+	assert.Equal(t, []byte{0xd2, 0x00, 0x01, 0x2f, 0x51}, encode(int64(77649)))
+	assert.Equal(t, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, encode(1.5))
+	assert.Equal(t, []byte{0xa3, 'a', '/', 'b'}, encode("a/b"))
+	assert.Equal(t, []byte{0x92, 0x01, 0x02}, encode([]interface{}{int64(1), int64(2)}))
+
+	// keys are sorted
+	assert.Equal(t, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0xc2}, encode(map[string]interface{}{"b": false, "a": int64(1)}))
+
+	var buf bytes.Buffer
+	assert.EqualError(t, encodeMsgpack(&buf, struct{}{}), "can't encode struct {} as msgpack")
+}
+
+func TestEncodeResults(t *testing.T) {
+	repos := Repos{Repos: []Repo{{Name: "a/b", Stars: 10, Error: "<nil>"}}}
+
+	body, err := encodeResults(formatJSON, repos)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"repos\":[{\"name\":\"a/b\",\"Stars\":10,\"Error\":\"\\u003cnil\\u003e\"}]}\n", string(body))
+
+	// yaml keeps the json field names
+	body, err = encodeResults(formatYAML, repos)
+	assert.Nil(t, err)
+
+	var decoded map[string][]map[string]interface{}
+	assert.Nil(t, yaml.Unmarshal(body, &decoded))
+	assert.Equal(t, map[string]interface{}{"name": "a/b", "Stars": 10, "Error": "<nil>"}, decoded["repos"][0])
+
+	body, err = encodeResults(formatMsgpack, repos)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x81), body[0])
+	assert.Equal(t, []byte{0xa5, 'r', 'e', 'p', 'o', 's', 0x91, 0x83}, body[1:9])
+}
+
+func TestStarsHandlerFormats(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	post := func(path string, accept string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"repos": [{"name": "rdelpret/cartographer"}, {"name": "rdelpret/kfx"}]}`))
+		req.Header.Set("Accept", accept)
+		http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := post("/stars", "text/csv")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+	assert.Equal(t, "name,stars,error\nrdelpret/cartographer,1,\nrdelpret/kfx,1,\n", recorder.Body.String())
+
+	// paging info goes in headers for csv
+	recorder = post("/stars?limit=1", "text/csv")
+	assert.Equal(t, "name,stars,error\nrdelpret/cartographer,1,\n", recorder.Body.String())
+	assert.Equal(t, "2", recorder.Header().Get("X-Total-Count"))
+	assert.Equal(t, 22, len(recorder.Header().Get("X-Next-Cursor")))
+
+	recorder = post("/stars?aggregates=true", "text/csv")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Aggregates are not supported with CSV.\n", recorder.Body.String())
+
+	recorder = post("/stars?format=yaml", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/yaml", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "name: rdelpret/cartographer")
+
+	recorder = post("/stars", "application/msgpack")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/msgpack", recorder.Header().Get("Content-Type"))
+
+	recorder = post("/stars", "text/html")
+	assert.Equal(t, http.StatusNotAcceptable, recorder.Code)
+	assert.Equal(t, notAcceptableMessage+"\n", recorder.Body.String())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ------------------------- INBOUND WEBHOOKS -------------------------
+
+// The parts of a github star/watch event payload we care about
+type githubStarEvent struct {
+	Action     string `json:"action"`
+	Repository struct {
+		FullName        string `json:"full_name"`
+		StargazersCount int    `json:"stargazers_count"`
+	} `json:"repository"`
+}
+
+// how many delivery ids we remember for replay protection
+const seenDeliveriesSize = 10000
+
+// Remembers recent X-GitHub-Delivery ids so a captured delivery
+// can't be sent to us a second time
+type deliveryTracker struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{seen: make(map[string]bool)}
+}
+
+// returns false if we have already seen this delivery id
+func (t *deliveryTracker) firstSeen(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.seen[id] {
+		return false
+	}
+
+	t.seen[id] = true
+	t.order = append(t.order, id)
+
+	// forget the oldest ids once we are over the limit
+	if len(t.order) > seenDeliveriesSize {
+		delete(t.seen, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	return true
+}
+
+// check the X-Hub-Signature-256 header against our own signature of the body
+func validGithubSignature(secret string, signature string, body []byte) bool {
+	if secret == "" || signature == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signPayload(secret, body)))
+}
+
+// HTTP route github sends star and watch events to
+func githubWebhookHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /webhooks/github route
+	if r.URL.Path != "/webhooks/github" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure POST is the only method used
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	// without a secret we have no way to trust anything sent here
+	secret := currentGithubWebhookSecret()
+	if secret == "" {
+		http.Error(w, "Webhook secret not configured.", http.StatusForbidden)
+		return
+	}
+
+	// anyone can reach this route, don't read more than any other request
+	if r.ContentLength > currentLimits().maxBytes {
+		writeRequestError(w, errRequestTooLarge)
+		return
+	}
+
+	body, err := ioutil.ReadAll(newLimitedBody(r.Body))
+
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	if !validGithubSignature(secret, r.Header.Get("X-Hub-Signature-256"), body) {
+		http.Error(w, "Invalid signature.", http.StatusUnauthorized)
+		return
+	}
+
+	// only check for replays once we know github really sent it
+	deliveryID := r.Header.Get("X-GitHub-Delivery")
+
+	if deliveryID == "" {
+		http.Error(w, "Missing delivery id.", http.StatusBadRequest)
+		return
+	}
+
+	if !githubDeliveries.firstSeen(deliveryID) {
+		http.Error(w, "Delivery already processed.", http.StatusConflict)
+		return
+	}
+
+	switch r.Header.Get("X-GitHub-Event") {
+	case "ping":
+		w.WriteHeader(http.StatusOK)
+		return
+	case "star", "watch":
+	default:
+		// not something we track, but not an error either
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var event githubStarEvent
+
+	err = json.Unmarshal(body, &event)
+
+	if err != nil || event.Repository.FullName == "" {
+		http.Error(w, "Malformed Request.", http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	observeWebhookStars(event.Repository.FullName, event.Repository.StargazersCount)
+	githubWebhookEvents.Inc()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var githubDeliveries = newDeliveryTracker()
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to send a signed github delivery to the handler
+func sendGithubDelivery(event string, id string, signature string, body []byte) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/webhooks/github", bytes.NewBuffer(body))
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Delivery", id)
+	req.Header.Set("X-Hub-Signature-256", signature)
+	http.HandlerFunc(githubWebhookHandler).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestDeliveryTracker(t *testing.T) {
+	tracker := newDeliveryTracker()
+	assert.True(t, tracker.firstSeen("a"))
+	assert.False(t, tracker.firstSeen("a"))
+	assert.True(t, tracker.firstSeen("b"))
+}
+
+func TestValidGithubSignature(t *testing.T) {
+	body := []byte("Hello, World!")
+	signature := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+	assert.True(t, validGithubSignature("It's a Secret to Everybody", signature, body))
+	assert.False(t, validGithubSignature("wrong secret", signature, body))
+	assert.False(t, validGithubSignature("It's a Secret to Everybody", "", body))
+	assert.False(t, validGithubSignature("", signature, body))
+}
+
+func TestGithubWebhookHandler(t *testing.T) {
+
+	resetCache()
+	githubDeliveries = newDeliveryTracker()
+	githubWebhookSecret = "secret"
+	defer func() { githubWebhookSecret = "" }()
+
+	body := []byte(`{"action":"created","repository":{"full_name":"rdelpret/cartographer","stargazers_count":42}}`)
+	signature := signPayload("secret", body)
+
+	// test happy path
+	recorder := sendGithubDelivery("star", "delivery-1", signature, body)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	obs, ok := cache.get("rdelpret/cartographer")
+	assert.True(t, ok)
+	assert.Equal(t, 42, obs.Stars)
+
+	// same delivery again is a replay
+	recorder = sendGithubDelivery("star", "delivery-1", signature, body)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, "Delivery already processed.\n", recorder.Body.String())
+
+	// watch events count too
+	body = []byte(`{"action":"started","repository":{"full_name":"rdelpret/cartographer","stargazers_count":43}}`)
+	recorder = sendGithubDelivery("watch", "delivery-2", signPayload("secret", body), body)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Len(t, cache.history("rdelpret/cartographer"), 2)
+
+	// webhook counts go in the stored history straight away
+	assert.Len(t, loadHistory("rdelpret/cartographer"), 2)
+
+	// bad signature
+	recorder = sendGithubDelivery("star", "delivery-3", signPayload("wrong", body), body)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, "Invalid signature.\n", recorder.Body.String())
+
+	// events we don't track are ignored
+	recorder = sendGithubDelivery("push", "delivery-4", signPayload("secret", body), body)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Len(t, cache.history("rdelpret/cartographer"), 2)
+
+	// malformed payload
+	body = []byte(`{"action":"created"}`)
+	recorder = sendGithubDelivery("star", "delivery-5", signPayload("secret", body), body)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// bodies over the request limit aren't read, signed or not
+	body = bytes.Repeat([]byte("a"), int(currentLimits().maxBytes)+1)
+	recorder = sendGithubDelivery("star", "delivery-7", signPayload("secret", body), body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/webhooks/github", struct{ io.Reader }{bytes.NewReader(body)})
+	http.HandlerFunc(githubWebhookHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	// no secret configured means nothing is trusted
+	githubWebhookSecret = ""
+	recorder = sendGithubDelivery("star", "delivery-6", signature, body)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/webhooks/github", nil)
+	http.HandlerFunc(githubWebhookHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+}
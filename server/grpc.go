@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"rdelpret/rainbow-road/server/starspb"
+)
+
+// ------------------------------- GRPC -------------------------------
+
+// v2 status strings to their protobuf enum
+var grpcStatuses = map[string]starspb.Status{
+	StatusOK:            starspb.Status_STATUS_OK,
+	StatusInvalid:       starspb.Status_STATUS_INVALID,
+	StatusNotFound:      starspb.Status_STATUS_NOT_FOUND,
+	StatusUpstreamError: starspb.Status_STATUS_UPSTREAM_ERROR,
+}
+
+// gRPC version of the stars api, backed by the same lookups as /stars
+type starsServer struct {
+	starspb.UnimplementedStarsServer
+}
+
+// shape a lookup result for grpc
+func newRepoResult(index int, res repoResult) *starspb.RepoResult {
+	result := &starspb.RepoResult{
+		Index:  int32(index),
+		Name:   res.Name,
+		Status: grpcStatuses[lookupStatus(res.Err)],
+	}
+
+	if res.Err != nil {
+		result.Error = res.Err.Error()
+	} else {
+		result.Stars = int64(res.Stars)
+	}
+
+	return result
+}
+
+// the grpc side of readRepoNames, checked before anything is charged
+func checkRepoNames(names []string) error {
+	if max := currentLimits().maxRepos; len(names) > max {
+		return status.Error(codes.ResourceExhausted, (&tooManyReposError{max}).Error())
+	}
+
+	errs := validateRepoNames(names)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, "repos["+strconv.Itoa(e.Index)+"]: "+e.Error)
+	}
+	return status.Error(codes.InvalidArgument, "Invalid Request. "+strings.Join(msgs, "; "))
+}
+
+func (s *starsServer) GetStars(ctx context.Context, req *starspb.GetStarsRequest) (*starspb.GetStarsResponse, error) {
+	starsApiReqAll.Inc()
+
+	if err := checkRepoNames(req.Repos); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := chargeQuota(ctx, len(req.Repos)); err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	res := &starspb.GetStarsResponse{Repos: make([]*starspb.RepoResult, 0, len(req.Repos))}
+	for i, result := range fetchRepos(req.Repos) {
+		res.Repos = append(res.Repos, newRepoResult(i, result))
+	}
+
+	starsApiReq200.Inc()
+	return res, nil
+}
+
+func (s *starsServer) StreamStars(req *starspb.GetStarsRequest, stream starspb.Stars_StreamStarsServer) error {
+	starsApiReqAll.Inc()
+
+	if err := checkRepoNames(req.Repos); err != nil {
+		return err
+	}
+
+	if _, _, err := chargeQuota(stream.Context(), len(req.Repos)); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	// grpc streams aren't safe to Send on from more than one goroutine
+	results := make(chan *starspb.RepoResult)
+	go func() {
+		fetchReposEach(req.Repos, func(index int, res repoResult) {
+			results <- newRepoResult(index, res)
+		})
+		close(results)
+	}()
+
+	var err error
+	for result := range results {
+		// keep draining after an error so every lookup can finish
+		if err == nil {
+			err = stream.Send(result)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	starsApiReq200.Inc()
+	return nil
+}
+
+// grpc version of httpLogger
+func grpcLogger(ctx context.Context, method string, start time.Time) {
+	requesterIP := "-"
+	if p, ok := peer.FromContext(ctx); ok {
+		requesterIP = p.Addr.String()
+	}
+
+	identity := grpcClientIdentity(ctx)
+	if identity == "" {
+		identity = "-"
+	}
+
+	log.Printf("%-20s%-20s%-20s%-20s%-20v", "GRPC", method, requesterIP, identity, time.Since(start))
+}
+
+func grpcUnaryLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	grpcLogger(ctx, info.FullMethod, start)
+	return res, err
+}
+
+func grpcStreamLogger(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	grpcLogger(ss.Context(), info.FullMethod, start)
+	return err
+}
+
+// grpc version of requireScope. Every stars method needs the read scope,
+// health checks and reflection stay open
+func grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	auth := currentAuth()
+	if !auth.enabled || !strings.HasPrefix(method, "/"+starspb.Stars_ServiceDesc.ServiceName+"/") {
+		return ctx, nil
+	}
+
+	header := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		header = md.Get("authorization")[0]
+	}
+
+	c := authenticate(auth, header, grpcClientIdentity(ctx))
+
+	if c == nil {
+		return nil, status.Error(codes.Unauthenticated, missingKeyMessage)
+	}
+
+	if !c.can(scopeRead) {
+		return nil, status.Error(codes.PermissionDenied, "API key is missing the "+scopeRead+" scope.")
+	}
+
+	return withCaller(ctx, c), nil
+}
+
+// grpc version of rateLimiter. Limits go by method name, so a route like
+// /rainbowroad.v1.Stars/ covers the whole service. Health checks and
+// reflection aren't limited
+func grpcRateLimit(ctx context.Context, method string) error {
+	if !strings.HasPrefix(method, "/"+starspb.Stars_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+
+	header := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		header = md.Get("authorization")[0]
+	}
+
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	route, limit, state, limited := takeRateLimit(method, rateLimitClientFor(header, remoteAddr))
+	if !limited {
+		return nil
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(
+		"ratelimit-limit", strconv.Itoa(limit.requests),
+		"ratelimit-remaining", strconv.Itoa(state.remaining),
+		"ratelimit-reset", ceilSeconds(state.reset),
+	))
+
+	if !state.allowed {
+		rateLimitedRequests.WithLabelValues(route).Inc()
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", ceilSeconds(state.retryAfter)))
+		return status.Error(codes.ResourceExhausted, tooManyRequestsMessage(state))
+	}
+
+	return nil
+}
+
+func grpcUnaryRateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcRateLimit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamRateLimit(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcRateLimit(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// a stream with the caller added to its context
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// health of the last server newGRPCServer made, so shutdown can mark it
+// not serving while it drains
+var grpcHealth *health.Server
+
+// set up the grpc server with health checks and reflection so
+// grpcurl, grpc_health_probe and friends work out of the box. Extra
+// options are for TLS
+func newGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(grpcUnaryLogger, grpcUnaryRateLimit, grpcUnaryAuth),
+		grpc.ChainStreamInterceptor(grpcStreamLogger, grpcStreamRateLimit, grpcStreamAuth),
+	)
+	s := grpc.NewServer(opts...)
+	starspb.RegisterStarsServer(s, &starsServer{})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(starspb.Stars_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+	grpcHealth = healthServer
+
+	reflection.Register(s)
+
+	return s
+}
+
+// serve grpc on its own port next to the http mux
+func serveGRPC(s *grpc.Server, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
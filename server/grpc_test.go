@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"rdelpret/rainbow-road/server/starspb"
+)
+
+// helper to run the grpc server in memory and get a client connection to it
+func dialGRPC(t *testing.T) (*grpc.ClientConn, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	s := newGRPCServer()
+	go s.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestNewRepoResult(t *testing.T) {
+	assert.Equal(t,
+		&starspb.RepoResult{Index: 1, Name: "rdelpret/kfx", Stars: 1, Status: starspb.Status_STATUS_OK},
+		newRepoResult(1, repoResult{Name: "rdelpret/kfx", Stars: 1}))
+
+	assert.Equal(t,
+		&starspb.RepoResult{Index: 0, Name: "invalid", Status: starspb.Status_STATUS_INVALID, Error: "bad"},
+		newRepoResult(0, repoResult{Name: "invalid", Stars: -1, Err: &lookupError{StatusInvalid, errors.New("bad")}}))
+}
+
+func TestGRPCGetStars(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	conn, closeConn := dialGRPC(t)
+	defer closeConn()
+
+	client := starspb.NewStarsClient(conn)
+	res, err := client.GetStars(context.Background(), &starspb.GetStarsRequest{Repos: []string{"rdelpret/cartographer", "rdelpret/kfx"}})
+	assert.Nil(t, err)
+	assert.Len(t, res.Repos, 2)
+	assert.Equal(t, "rdelpret/cartographer", res.Repos[0].Name)
+	assert.Equal(t, int64(1), res.Repos[0].Stars)
+	assert.Equal(t, starspb.Status_STATUS_OK, res.Repos[0].Status)
+	assert.Equal(t, "rdelpret/kfx", res.Repos[1].Name)
+
+	// bad names turn the whole request away like a 422 does
+	_, err = client.GetStars(context.Background(), &starspb.GetStarsRequest{Repos: []string{"rdelpret/cartographer", "invalid", ""}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "Invalid Request. repos[1]: Recieved invalid repo name: invalid; repos[2]: Missing repo name. Hint: <org>/<repo-name>", status.Convert(err).Message())
+
+	settingsMu.Lock()
+	limits.maxRepos = 1
+	settingsMu.Unlock()
+	defer func() {
+		settingsMu.Lock()
+		limits.maxRepos = 1000
+		settingsMu.Unlock()
+	}()
+
+	_, err = client.GetStars(context.Background(), &starspb.GetStarsRequest{Repos: []string{"rdelpret/cartographer", "rdelpret/kfx"}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, "Too many repos. Limit is 1 per request", status.Convert(err).Message())
+}
+
+func TestGRPCStreamStars(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	conn, closeConn := dialGRPC(t)
+	defer closeConn()
+
+	client := starspb.NewStarsClient(conn)
+	stream, err := client.StreamStars(context.Background(), &starspb.GetStarsRequest{Repos: []string{"rdelpret/cartographer", "rdelpret/kfx", "rdelpret/rainbow-road"}})
+	assert.Nil(t, err)
+
+	var results []*starspb.RepoResult
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		results = append(results, result)
+	}
+
+	// results come back as they finish so put them in request order
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	assert.Len(t, results, 3)
+	assert.Equal(t, "rdelpret/cartographer", results[0].Name)
+	assert.Equal(t, "rdelpret/kfx", results[1].Name)
+	assert.Equal(t, "rdelpret/rainbow-road", results[2].Name)
+
+	// bad names fail the stream before anything is sent
+	stream, err = client.StreamStars(context.Background(), &starspb.GetStarsRequest{Repos: []string{"invalid"}})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCHealth(t *testing.T) {
+
+	conn, closeConn := dialGRPC(t)
+	defer closeConn()
+
+	client := healthpb.NewHealthClient(conn)
+	res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "rainbowroad.v1.Stars"})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+}
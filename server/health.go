@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ------------------------------ HEALTH ------------------------------
+
+// how a single readiness check went. Warnings are reported but don't
+// take the server out of rotation
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// how long an upstream check is reused so probes don't burn rate limit
+var upstreamCheckTTL = 30 * time.Second
+
+// how long we wait on github before calling it unreachable
+var upstreamCheckTimeout = 5 * time.Second
+
+// store key the storage check writes to
+const storeProbeKey = "health:readyz"
+
+// how long a storage check is reused, the file store rewrites and syncs
+// the whole file on every write so probes shouldn't write every time
+var storeCheckTTL = 30 * time.Second
+
+// Result of one dependency check in a /readyz report
+type HealthCheck struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	// true when this came from an earlier check
+	Cached bool `json:"cached"`
+}
+
+// Struct that represents a /livez or /readyz response. Status is fail if
+// any check failed
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// last result of the github checks, shared by every probe
+type upstreamChecker struct {
+	mu        sync.Mutex
+	token     HealthCheck
+	reachable HealthCheck
+}
+
+var upstream = &upstreamChecker{}
+
+// Check github is reachable and that it accepts our token, using the
+// rate limit api since it is free to call. Reuses the last result for
+// upstreamCheckTTL
+func (c *upstreamChecker) check() (HealthCheck, HealthCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.reachable.CheckedAt.IsZero() && time.Since(c.reachable.CheckedAt) < upstreamCheckTTL {
+		token, reachable := c.token, c.reachable
+		token.Cached, reachable.Cached = true, true
+		return token, reachable
+	}
+
+	c.token, c.reachable = checkGithub()
+	return c.token, c.reachable
+}
+
+// forget the last result, ie when the token changes
+func (c *upstreamChecker) reset() {
+	c.mu.Lock()
+	c.token, c.reachable = HealthCheck{}, HealthCheck{}
+	c.mu.Unlock()
+}
+
+// last result of the storage check, shared by every probe
+type storeChecker struct {
+	mu    sync.Mutex
+	last  HealthCheck
+	store Store
+}
+
+var storeHealth = &storeChecker{}
+
+// Check the store, reusing the last result for storeCheckTTL unless the
+// store has been swapped out since
+func (c *storeChecker) check() HealthCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.store == store && !c.last.CheckedAt.IsZero() && time.Since(c.last.CheckedAt) < storeCheckTTL {
+		res := c.last
+		res.Cached = true
+		return res
+	}
+
+	c.store, c.last = store, checkStore()
+	return c.last
+}
+
+// call github's rate limit api and work out how both checks went
+func checkGithub() (HealthCheck, HealthCheck) {
+	now := time.Now().UTC()
+	token := HealthCheck{Status: CheckOK, CheckedAt: now}
+	reachable := HealthCheck{Status: CheckOK, CheckedAt: now}
+
+	provider := currentProviders()["github"].(*githubProvider)
+
+	url := provider.baseURL + "rate_limit"
+
+	// this is for testing so we can setup a mock http server
+	if serverURLOverride != "" {
+		url = serverURLOverride
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		reachable.Status, reachable.Message = CheckFail, err.Error()
+		token.Status, token.Message = CheckWarn, "Could not check token, github is unreachable"
+		return token, reachable
+	}
+	provider.Authorize(req)
+
+	client := &http.Client{Timeout: upstreamCheckTimeout}
+
+	countUpstreamRequest(provider.Name())
+	resp, err := client.Do(req)
+	if err != nil {
+		reachable.Status, reachable.Message = CheckFail, err.Error()
+		token.Status, token.Message = CheckWarn, "Could not check token, github is unreachable"
+		return token, reachable
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		token.Status, token.Message = CheckFail, "GitHub rejected upstream.github_token, it may be revoked or expired"
+		return token, reachable
+	case resp.StatusCode >= 500:
+		reachable.Status, reachable.Message = CheckFail, "GitHub returned "+resp.Status
+		token.Status, token.Message = CheckWarn, "Could not check token, github returned "+resp.Status
+		return token, reachable
+	case resp.StatusCode != http.StatusOK:
+		reachable.Status, reachable.Message = CheckWarn, "GitHub returned "+resp.Status
+	default:
+		countUpstreamRequest200(provider.Name())
+	}
+
+	if provider.token == "" {
+		token.Status, token.Message = CheckWarn, "upstream.github_token (RAINBOW_ROAD_UPSTREAM_GITHUB_TOKEN) not set, requests to github will be rate limited"
+	}
+
+	// running out of rate limit isn't fatal, the limit resets on its own
+	if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining == "0" {
+		reachable.Status = CheckWarn
+		reachable.Message = "Out of rate limit until " + rateLimitReset(resp.Header.Get("X-RateLimit-Reset"))
+	}
+
+	return token, reachable
+}
+
+// helper function to format github's rate limit reset header
+func rateLimitReset(header string) string {
+	secs, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return "unknown"
+	}
+	return time.Unix(secs, 0).UTC().Format(time.RFC3339)
+}
+
+// make sure the store can still be written to and read back
+func checkStore() HealthCheck {
+	res := HealthCheck{Status: CheckOK, CheckedAt: time.Now().UTC()}
+	probe := []byte(res.CheckedAt.Format(time.RFC3339Nano))
+
+	err := store.Put(storeProbeKey, probe)
+	if err == nil {
+		var val []byte
+		var ok bool
+		val, ok, err = store.Get(storeProbeKey)
+		if err == nil && (!ok || string(val) != string(probe)) {
+			err = errors.New("Read back something other than what was written")
+		}
+	}
+
+	if err != nil {
+		res.Status, res.Message = CheckFail, err.Error()
+	}
+
+	return res
+}
+
+// run every readiness check and roll them up
+func readiness() HealthReport {
+
+	// nothing else matters once we are on the way out
+	if isDraining() {
+		return HealthReport{
+			Status: CheckFail,
+			Checks: map[string]HealthCheck{
+				"shutdown": {Status: CheckFail, Message: "Server is shutting down", CheckedAt: time.Now().UTC()},
+			},
+		}
+	}
+
+	token, reachable := upstream.check()
+
+	report := HealthReport{
+		Status: CheckOK,
+		Checks: map[string]HealthCheck{
+			"github_token": token,
+			"upstream":     reachable,
+			"storage":      storeHealth.check(),
+		},
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == CheckFail {
+			report.Status = CheckFail
+		}
+	}
+
+	return report
+}
+
+// helper function to guard a GET only health route
+func healthRoute(w http.ResponseWriter, r *http.Request, path string) bool {
+
+	// Ensure this handler can only be called from its own route
+	if r.URL.Path != path {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return false
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+// helper function to write a health report, 503 if anything failed
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if report.Status == CheckFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// HTTP route for liveness probes. Only says the process can still
+// serve requests, dependencies are left to /readyz so an upstream
+// outage doesn't get every pod restarted
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	if !healthRoute(w, r, "/livez") {
+		return
+	}
+	writeHealthReport(w, HealthReport{Status: CheckOK})
+}
+
+// HTTP route for readiness probes. Checks the github token, that github
+// is reachable and that the store works, with a report of each check
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !healthRoute(w, r, "/readyz") {
+		return
+	}
+	writeHealthReport(w, readiness())
+}
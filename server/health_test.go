@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// store that can't be written to
+type brokenStore struct {
+	*memoryStore
+}
+
+func (s *brokenStore) Put(key string, value []byte) error {
+	return errors.New("disk full")
+}
+
+// helper to point github at a test server for the readiness checks
+func mockGithubRateLimit(code int, headers map[string]string) func() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, val := range headers {
+			w.Header().Set(key, val)
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(`{}`))
+	}))
+
+	original := providers["github"]
+	providers["github"] = &githubProvider{baseURL: ts.URL + "/", token: "test"}
+	upstream = &upstreamChecker{}
+
+	return func() {
+		ts.Close()
+		providers["github"] = original
+		upstream = &upstreamChecker{}
+	}
+}
+
+func TestCheckGithub(t *testing.T) {
+	close := mockGithubRateLimit(200, nil)
+	token, reachable := checkGithub()
+	assert.Equal(t, CheckOK, token.Status)
+	assert.Equal(t, CheckOK, reachable.Status)
+	close()
+
+	// revoked token
+	close = mockGithubRateLimit(401, nil)
+	token, reachable = checkGithub()
+	assert.Equal(t, CheckFail, token.Status)
+	assert.Equal(t, "GitHub rejected upstream.github_token, it may be revoked or expired", token.Message)
+	assert.Equal(t, CheckOK, reachable.Status)
+	close()
+
+	// no token works, just slowly
+	close = mockGithubRateLimit(200, nil)
+	providers["github"].(*githubProvider).token = ""
+	token, _ = checkGithub()
+	assert.Equal(t, CheckWarn, token.Status)
+	assert.Equal(t, "upstream.github_token (RAINBOW_ROAD_UPSTREAM_GITHUB_TOKEN) not set, requests to github will be rate limited", token.Message)
+	close()
+
+	// github is having a bad day
+	close = mockGithubRateLimit(502, nil)
+	token, reachable = checkGithub()
+	assert.Equal(t, CheckWarn, token.Status)
+	assert.Equal(t, CheckFail, reachable.Status)
+	assert.Equal(t, "GitHub returned 502 Bad Gateway", reachable.Message)
+	close()
+
+	// out of rate limit is only a warning
+	close = mockGithubRateLimit(200, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "1792324800"})
+	_, reachable = checkGithub()
+	assert.Equal(t, CheckWarn, reachable.Status)
+	assert.Equal(t, "Out of rate limit until 2026-10-18T12:00:00Z", reachable.Message)
+	close()
+
+	// nothing listening
+	original := providers["github"]
+	providers["github"] = &githubProvider{baseURL: "http://127.0.0.1:1/"}
+	token, reachable = checkGithub()
+	assert.Equal(t, CheckWarn, token.Status)
+	assert.Equal(t, CheckFail, reachable.Status)
+	providers["github"] = original
+}
+
+func TestUpstreamCheckerCaches(t *testing.T) {
+	close := mockGithubRateLimit(200, nil)
+	defer close()
+
+	_, first := upstream.check()
+	assert.False(t, first.Cached)
+
+	_, second := upstream.check()
+	assert.True(t, second.Cached)
+	assert.Equal(t, first.CheckedAt, second.CheckedAt)
+
+	// stale results are checked again
+	upstreamCheckTTL = 0
+	defer func() { upstreamCheckTTL = 30 * time.Second }()
+	_, third := upstream.check()
+	assert.False(t, third.Cached)
+}
+
+func TestCheckStore(t *testing.T) {
+	defer func() { store = newMemoryStore() }()
+
+	store = newMemoryStore()
+	assert.Equal(t, CheckOK, checkStore().Status)
+
+	store = &brokenStore{newMemoryStore()}
+	res := checkStore()
+	assert.Equal(t, CheckFail, res.Status)
+	assert.Equal(t, "disk full", res.Message)
+}
+
+func TestStoreCheckerCaches(t *testing.T) {
+	defer func() { store = newMemoryStore() }()
+
+	store = newMemoryStore()
+	storeHealth = &storeChecker{}
+
+	first := storeHealth.check()
+	assert.False(t, first.Cached)
+
+	// probes in between don't write to the store
+	store.Delete(storeProbeKey)
+	second := storeHealth.check()
+	assert.True(t, second.Cached)
+	assert.Equal(t, first.CheckedAt, second.CheckedAt)
+	_, ok, _ := store.Get(storeProbeKey)
+	assert.False(t, ok)
+
+	// a new store is checked straight away
+	store = &brokenStore{newMemoryStore()}
+	assert.Equal(t, CheckFail, storeHealth.check().Status)
+
+	// stale results are checked again
+	store = newMemoryStore()
+	storeHealth.store = store
+	storeCheckTTL = 0
+	defer func() { storeCheckTTL = 30 * time.Second }()
+	assert.Equal(t, CheckOK, storeHealth.check().Status)
+}
+
+func TestLivezHandler(t *testing.T) {
+
+	// test happy path
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/livez", nil)
+	http.HandlerFunc(livezHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"status\":\"ok\"}\n", recorder.Body.String())
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/livez", nil)
+	http.HandlerFunc(livezHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/wrongroute", nil)
+	http.HandlerFunc(livezHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
+
+func TestReadyzHandler(t *testing.T) {
+	defer func() { store = newMemoryStore() }()
+
+	get := func() (int, HealthReport) {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		http.HandlerFunc(readyzHandler).ServeHTTP(recorder, req)
+
+		var report HealthReport
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+		assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+		return recorder.Code, report
+	}
+
+	// test happy path
+	close := mockGithubRateLimit(200, nil)
+	code, report := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, CheckOK, report.Status)
+	assert.Equal(t, CheckOK, report.Checks["github_token"].Status)
+	assert.Equal(t, CheckOK, report.Checks["upstream"].Status)
+	assert.Equal(t, CheckOK, report.Checks["storage"].Status)
+	close()
+
+	// a revoked token takes us out of rotation
+	close = mockGithubRateLimit(401, nil)
+	code, report = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, CheckFail, report.Status)
+	assert.Equal(t, CheckFail, report.Checks["github_token"].Status)
+
+	// so does a broken store
+	upstream = &upstreamChecker{}
+	providers["github"] = &githubProvider{baseURL: "http://127.0.0.1:1/"}
+	store = &brokenStore{newMemoryStore()}
+	code, report = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, CheckFail, report.Checks["storage"].Status)
+	close()
+
+	// Test using wrong HTTP Method
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/readyz", nil)
+	http.HandlerFunc(readyzHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------- JOBS -------------------------------
+
+// Every state a job can be in
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobCancelled = "cancelled"
+)
+
+const jobPrefix = "job/"
+
+// A finished lookup inside a job, Index is the repo's position in the request
+type jobResult struct {
+	Index int `json:"index"`
+	RepoV2
+}
+
+// An asynchronous /stars request. Results fill in as lookups finish
+type Job struct {
+	ID         string      `json:"id"`
+	Status     string      `json:"status"`
+	Total      int         `json:"total"`
+	Completed  int         `json:"completed"`
+	Repos      []string    `json:"repos"`
+	Results    []jobResult `json:"results"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	FinishedAt *time.Time  `json:"finished_at"`
+	ExpiresAt  *time.Time  `json:"expires_at"`
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobDone || j.Status == JobCancelled
+}
+
+// Runs jobs in the background and keeps them in the store so the
+// queue survives a restart when the store is persistent
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+	// when each job was last written to the store
+	saved map[string]time.Time
+	queue chan string
+	// set once stop has been called, no new jobs are accepted after that
+	stopped bool
+	// set on shutdown, workers leave queued jobs for the next start
+	draining bool
+	workers  sync.WaitGroup
+	// cancelled when shutdown runs out of time, interrupts running jobs
+	// without finishing them so they resume after a restart
+	ctx  context.Context
+	halt context.CancelFunc
+
+	// how long finished jobs are kept around
+	retention time.Duration
+	// how many lookups a single job runs at once
+	concurrency int
+}
+
+func newJobManager(retention time.Duration) *jobManager {
+	ctx, halt := context.WithCancel(context.Background())
+	return &jobManager{
+		ctx:         ctx,
+		halt:        halt,
+		jobs:        make(map[string]*Job),
+		cancels:     make(map[string]context.CancelFunc),
+		saved:       make(map[string]time.Time),
+		queue:       make(chan string, 1000),
+		retention:   retention,
+		concurrency: 10,
+	}
+}
+
+// change how long finished jobs are kept and how many lookups new jobs
+// run at once. Jobs already running keep going as they are
+func (m *jobManager) configure(retention time.Duration, concurrency int) {
+	m.mu.Lock()
+	m.retention = retention
+	m.concurrency = concurrency
+	m.mu.Unlock()
+}
+
+// returned by submit once the server is shutting down
+var errJobQueueStopped = errors.New("job queue stopped")
+
+// Queue a job for a list of repos
+func (m *jobManager) submit(names []string) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        newEventID(),
+		Status:    JobQueued,
+		Total:     len(names),
+		Repos:     names,
+		Results:   []jobResult{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	m.mu.Lock()
+
+	if m.stopped {
+		m.mu.Unlock()
+		return nil, errJobQueueStopped
+	}
+
+	select {
+	case m.queue <- job.ID:
+		m.jobs[job.ID] = job
+	default:
+		m.mu.Unlock()
+		return nil, errors.New("job queue full")
+	}
+
+	m.mu.Unlock()
+
+	m.save(job.ID, true)
+	return m.get(job.ID), nil
+}
+
+// copy of a job so callers can read it without holding the lock
+func (m *jobManager) get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil
+	}
+
+	cp := *job
+	cp.Results = append([]jobResult{}, job.Results...)
+	return &cp
+}
+
+// Stop a queued or running job. Lookups already in flight still finish
+// but their results are kept
+func (m *jobManager) cancel(id string) (*Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+
+	if !ok {
+		m.mu.Unlock()
+		return nil, nil
+	}
+
+	if job.finished() {
+		m.mu.Unlock()
+		return nil, errors.New("job already finished")
+	}
+
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+	}
+	m.finish(job, JobCancelled)
+	m.mu.Unlock()
+
+	m.save(id, true)
+	return m.get(id), nil
+}
+
+// mark a job finished and start its retention clock. Caller holds the lock
+func (m *jobManager) finish(job *Job, status string) {
+	now := time.Now().UTC()
+	expires := now.Add(m.retention)
+	job.Status = status
+	job.UpdatedAt = now
+	job.FinishedAt = &now
+	job.ExpiresAt = &expires
+}
+
+// Write a job to the store. Progress updates are throttled to once a
+// second so huge jobs don't rewrite the store for every repo
+func (m *jobManager) save(id string, force bool) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+
+	if !ok || (!force && time.Since(m.saved[id]) < time.Second) {
+		m.mu.Unlock()
+		return
+	}
+
+	m.saved[id] = time.Now()
+	body, err := json.Marshal(job)
+	m.mu.Unlock()
+
+	if err == nil {
+		err = store.Put(jobPrefix+id, body)
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// start the background workers
+func (m *jobManager) start(workers int) {
+	for i := 0; i < workers; i++ {
+		m.workers.Add(1)
+		go func() {
+			defer m.workers.Done()
+			for id := range m.queue {
+				if m.isDraining() {
+					continue
+				}
+				m.run(id)
+			}
+		}()
+	}
+}
+
+// Stop taking new jobs and wait for the workers to finish
+// everything already queued
+func (m *jobManager) stop() {
+	m.mu.Lock()
+	if !m.stopped {
+		m.stopped = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	m.workers.Wait()
+}
+
+func (m *jobManager) isDraining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.draining
+}
+
+// Stop for a server shutdown. Running jobs get until ctx is done to
+// finish, queued ones are left for the next start. Jobs still running
+// after that are interrupted and saved as they are so they resume after
+// a restart
+func (m *jobManager) shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.draining = true
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.stop()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		m.halt()
+	}
+
+	// progress saves are throttled, make sure the store has everything
+	m.mu.Lock()
+	var unfinished []string
+	for id, job := range m.jobs {
+		if !job.finished() {
+			unfinished = append(unfinished, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range unfinished {
+		m.save(id, true)
+	}
+
+	return err
+}
+
+// Look up every repo in a job that doesn't have a result yet
+func (m *jobManager) run(id string) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+
+	// cancelled while it was waiting in the queue
+	if !ok || job.Status != JobQueued {
+		m.mu.Unlock()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	m.cancels[id] = cancel
+
+	job.Status = JobRunning
+	job.UpdatedAt = time.Now().UTC()
+
+	// skip anything we already have, ie from before a restart
+	done := make(map[int]bool)
+	for _, res := range job.Results {
+		done[res.Index] = true
+	}
+	names := job.Repos
+	concurrency := m.concurrency
+	m.mu.Unlock()
+
+	m.save(id, true)
+
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+dispatch:
+	for i, name := range names {
+		if done[i] {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case sem <- struct{}{}:
+		}
+
+		// both cases can be ready at once, don't start new work after a cancel
+		if ctx.Err() != nil {
+			<-sem
+			break dispatch
+		}
+
+		wg.Add(1)
+		go func(index int, name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			m.record(id, index, fetchRepo(name))
+		}(i, name)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	delete(m.cancels, id)
+
+	// interrupted by a shutdown jobs stay running so they resume after a restart
+	if job.Status == JobRunning && m.ctx.Err() == nil {
+		m.finish(job, JobDone)
+	}
+	m.mu.Unlock()
+
+	m.save(id, true)
+}
+
+// add a finished lookup to a job
+func (m *jobManager) record(id string, index int, res repoResult) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if ok {
+		job.Results = append(job.Results, jobResult{Index: index, RepoV2: newRepoV2(res)})
+		job.Completed++
+		job.UpdatedAt = time.Now().UTC()
+	}
+	m.mu.Unlock()
+
+	m.save(id, false)
+}
+
+// Load jobs from the store after a restart. Anything that hadn't
+// finished goes back on the queue and picks up where it left off
+func (m *jobManager) restore() error {
+	entries, err := store.List(jobPrefix)
+
+	if err != nil {
+		return err
+	}
+
+	for key, body := range entries {
+		var job Job
+		err = json.Unmarshal(body, &job)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if !job.finished() {
+			job.Status = JobQueued
+		}
+
+		m.mu.Lock()
+		m.jobs[job.ID] = &job
+		m.mu.Unlock()
+
+		if job.finished() {
+			continue
+		}
+
+		select {
+		case m.queue <- job.ID:
+		default:
+			log.Println("job queue full, could not restore", strings.TrimPrefix(key, jobPrefix))
+		}
+	}
+
+	m.expire()
+	return nil
+}
+
+// Drop finished jobs that are past their retention
+func (m *jobManager) expire() {
+	now := time.Now()
+	var expired []string
+
+	m.mu.Lock()
+	for id, job := range m.jobs {
+		if job.ExpiresAt != nil && now.After(*job.ExpiresAt) {
+			expired = append(expired, id)
+			delete(m.jobs, id)
+			delete(m.saved, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range expired {
+		err := store.Delete(jobPrefix + id)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// check for expired jobs every so often
+func (m *jobManager) startJanitor(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			m.expire()
+		}
+	}()
+}
+
+// HTTP route to submit a job, takes the same body as /stars
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /jobs route
+	if r.URL.Path != "/jobs" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure POST is the only method used
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	// Read and validate body. Jobs are for big lookups so they get a higher limit
+	names, ok := readRepoNames(w, r, currentLimits().maxJobRepos)
+
+	if !ok {
+		return
+	}
+
+	job, err := jobs.submit(names)
+
+	if err == errJobQueueStopped {
+		http.Error(w, "Server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "Job queue full.", http.StatusServiceUnavailable)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// HTTP route to check on or cancel a job, ie GET /jobs/{id}
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /jobs/ routes
+	if !strings.HasPrefix(r.URL.Path, "/jobs/") {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+
+	var job *Job
+	var err error
+
+	switch r.Method {
+	case "GET":
+		job = jobs.get(id)
+	case "DELETE":
+		job, err = jobs.cancel(id)
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "Job already finished.", http.StatusConflict)
+		return
+	}
+
+	if job == nil {
+		http.Error(w, "Job not found.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// replaced in main once the retention setting is loaded
+var jobs = newJobManager(24 * time.Hour)
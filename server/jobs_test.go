@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to wait for a job to finish so tests don't race the workers
+func waitForJob(t *testing.T, m *jobManager, id string) *Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job := m.get(id)
+		if job.finished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("job did not finish")
+	return nil
+}
+
+func TestJobManager(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	m := newJobManager(time.Hour)
+	m.start(1)
+	defer m.stop()
+
+	job, err := m.submit([]string{"rdelpret/cartographer", "invalid"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, job.Total)
+
+	job = waitForJob(t, m, job.ID)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 2, job.Completed)
+	assert.NotNil(t, job.ExpiresAt)
+
+	sort.Slice(job.Results, func(i, j int) bool { return job.Results[i].Index < job.Results[j].Index })
+	assert.Equal(t, "rdelpret/cartographer", job.Results[0].Name)
+	assert.Equal(t, 1, *job.Results[0].Stars)
+	assert.Equal(t, StatusInvalid, job.Results[1].Status)
+
+	// finished jobs are in the store
+	_, ok, _ := store.Get(jobPrefix + job.ID)
+	assert.True(t, ok)
+
+	// and can't be cancelled
+	_, err = m.cancel(job.ID)
+	assert.EqualError(t, err, "job already finished")
+
+	// unknown jobs are just nil
+	job, err = m.cancel("nope")
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+	assert.Nil(t, m.get("nope"))
+}
+
+func TestJobCancel(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	// no workers so the job stays queued
+	m := newJobManager(time.Hour)
+	job, _ := m.submit([]string{"rdelpret/cartographer"})
+
+	job, err := m.cancel(job.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, JobCancelled, job.Status)
+
+	// a worker picking it up afterwards leaves it alone
+	m.run(job.ID)
+	assert.Equal(t, JobCancelled, m.get(job.ID).Status)
+	assert.Equal(t, 0, m.get(job.ID).Completed)
+
+	// nothing new once we are stopped
+	m.stop()
+	_, err = m.submit([]string{"rdelpret/cartographer"})
+	assert.EqualError(t, err, "job queue stopped")
+}
+
+func TestJobManagerShutdown(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	// lookups that take longer than the shutdown has
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"stargazers_count" : 1}`))
+	}))
+	defer ts.Close()
+	serverURLOverride = ts.URL
+	defer func() { serverURLOverride = "" }()
+
+	m := newJobManager(time.Hour)
+	m.concurrency = 1
+	running, _ := m.submit([]string{"rdelpret/cartographer", "rdelpret/kfx"})
+	queued, _ := m.submit([]string{"rdelpret/kfx"})
+	m.start(1)
+
+	// wait for the first job to start
+	deadline := time.Now().Add(5 * time.Second)
+	for m.get(running.ID).Status != JobRunning && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, m.shutdown(ctx))
+
+	// nothing new once we are shutting down
+	_, err := m.submit([]string{"rdelpret/cartographer"})
+	assert.Equal(t, errJobQueueStopped, err)
+
+	// neither job is finished, so both are picked up again after a restart
+	restored := newJobManager(time.Hour)
+	assert.Nil(t, restored.restore())
+	assert.Equal(t, JobQueued, restored.get(running.ID).Status)
+	assert.Equal(t, JobQueued, restored.get(queued.ID).Status)
+
+	// let the interrupted lookup finish so the worker is gone before the next test
+	close(release)
+	m.workers.Wait()
+	assert.Equal(t, JobRunning, m.get(running.ID).Status)
+}
+
+func TestJobRestoreAndExpire(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	// a job that was half done when the server stopped
+	stars := 3
+	half := Job{
+		ID:      "half",
+		Status:  JobRunning,
+		Total:   2,
+		Repos:   []string{"rdelpret/kfx", "rdelpret/cartographer"},
+		Results: []jobResult{{Index: 0, RepoV2: RepoV2{Name: "rdelpret/kfx", Stars: &stars, Status: StatusOK}}},
+	}
+	body, _ := json.Marshal(half)
+	store.Put(jobPrefix+"half", body)
+
+	// and one that should have been cleaned up already
+	expired := time.Now().Add(-time.Minute)
+	old := Job{ID: "old", Status: JobDone, ExpiresAt: &expired}
+	body, _ = json.Marshal(old)
+	store.Put(jobPrefix+"old", body)
+
+	m := newJobManager(time.Hour)
+	assert.Nil(t, m.restore())
+	assert.Nil(t, m.get("old"))
+	_, ok, _ := store.Get(jobPrefix + "old")
+	assert.False(t, ok)
+
+	m.start(1)
+	defer m.stop()
+	job := waitForJob(t, m, "half")
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 1, job.Completed)
+	assert.Len(t, job.Results, 2)
+
+	// the result from before the restart is kept, not looked up again
+	assert.Equal(t, 3, *job.Results[0].Stars)
+	assert.Equal(t, 1, *job.Results[1].Stars)
+}
+
+func TestJobHandlers(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	jobs = newJobManager(time.Hour)
+	defer func() { jobs = newJobManager(24 * time.Hour) }()
+
+	// test happy path
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jobs", bytes.NewBuffer([]byte(`{"repos": [{"name": "rdelpret/cartographer"}]}`)))
+	http.HandlerFunc(jobsHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	var job Job
+	json.NewDecoder(recorder.Body).Decode(&job)
+	assert.Equal(t, JobQueued, job.Status)
+	assert.Equal(t, "/jobs/"+job.ID, recorder.Header().Get("Location"))
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/jobs/"+job.ID, nil)
+	http.HandlerFunc(jobHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/jobs/"+job.ID, nil)
+	http.HandlerFunc(jobHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	json.NewDecoder(recorder.Body).Decode(&job)
+	assert.Equal(t, JobCancelled, job.Status)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/jobs/"+job.ID, nil)
+	http.HandlerFunc(jobHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, "Job already finished.\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/jobs/nope", nil)
+	http.HandlerFunc(jobHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Job not found.\n", recorder.Body.String())
+
+	// test malformed json
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/jobs", bytes.NewBuffer([]byte(`{"repos": [{"name" "rdelpret/cartographer"}]}`)))
+	http.HandlerFunc(jobsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Malformed Request.\n", recorder.Body.String())
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/jobs", nil)
+	http.HandlerFunc(jobsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/jobs/"+job.ID, nil)
+	http.HandlerFunc(jobHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/wrongroute", nil)
+	http.HandlerFunc(jobsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --------------------------- LIVE UPDATES ---------------------------
+
+// how many repos one websocket connection can watch at once
+var maxLiveSubscriptions = 100
+
+// heartbeat timings. Clients have liveReadTimeout to answer a ping
+var (
+	livePingInterval = 30 * time.Second
+	liveReadTimeout  = 60 * time.Second
+	liveWriteTimeout = 10 * time.Second
+)
+
+// Message a client sends to change what it is watching, ie
+// {"type": "subscribe", "repos": ["kubernetes/kubernetes"]}
+type liveRequest struct {
+	Type  string   `json:"type"`
+	Repos []string `json:"repos"`
+}
+
+// Star count pushed to a client
+type liveUpdate struct {
+	Type string `json:"type"`
+	RepoV2
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+}
+
+// Problem with something the client sent
+type liveError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// One websocket client and the repos it is watching
+type liveConn struct {
+	ws   *websocket.Conn
+	send chan interface{}
+
+	mu   sync.Mutex
+	subs map[string]bool
+	// last count sent per repo so we don't repeat ourselves
+	sent   map[string]int
+	closed bool
+	slow   bool
+
+	// lookups still running for new subscriptions
+	pending sync.WaitGroup
+
+	// carries the caller, lookups count against their quota
+	ctx context.Context
+}
+
+// Keeps track of which connections are watching which repos
+type liveHub struct {
+	mu   sync.RWMutex
+	subs map[string]map[*liveConn]bool
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{subs: make(map[string]map[*liveConn]bool)}
+}
+
+func (h *liveHub) subscribe(c *liveConn, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := cacheKey(name)
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[*liveConn]bool)
+	}
+	h.subs[key][c] = true
+}
+
+func (h *liveHub) unsubscribe(c *liveConn, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := cacheKey(name)
+	delete(h.subs[key], c)
+	if len(h.subs[key]) == 0 {
+		delete(h.subs, key)
+	}
+}
+
+// Push a new star count to everyone watching the repo
+func (h *liveHub) publish(name string, obs starObservation) {
+	h.mu.RLock()
+	conns := make([]*liveConn, 0, len(h.subs[cacheKey(name)]))
+	for c := range h.subs[cacheKey(name)] {
+		conns = append(conns, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range conns {
+		c.sendStars(name, obs)
+	}
+}
+
+func newLiveConn(ws *websocket.Conn) *liveConn {
+	return &liveConn{
+		ws:   ws,
+		ctx:  context.Background(),
+		send: make(chan interface{}, 64),
+		subs: make(map[string]bool),
+		sent: make(map[string]int),
+	}
+}
+
+// queue a message for the writer. Clients too slow to keep up get dropped
+// rather than holding up everyone else
+func (c *liveConn) queue(msg interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.send <- msg:
+	default:
+		log.Println("dropping slow websocket client", c.ws.RemoteAddr())
+		c.closed = true
+		c.slow = true
+		close(c.send)
+	}
+}
+
+// queue a star count unless the client already has it
+func (c *liveConn) sendStars(name string, obs starObservation) {
+	key := cacheKey(name)
+
+	c.mu.Lock()
+	last, ok := c.sent[key]
+	if !c.subs[key] || (ok && last == obs.Stars) {
+		c.mu.Unlock()
+		return
+	}
+	c.sent[key] = obs.Stars
+	c.mu.Unlock()
+
+	fetchedAt := obs.FetchedAt.UTC()
+	stars := obs.Stars
+	c.queue(liveUpdate{
+		Type:      "stars",
+		RepoV2:    RepoV2{Name: name, Stars: &stars, Status: StatusOK},
+		FetchedAt: &fetchedAt,
+	})
+}
+
+// send the current count for a repo we just subscribed to, looking it up if we have to
+func (c *liveConn) sendCurrent(name string) {
+	if obs, ok := cache.get(name); ok {
+		c.sendStars(name, obs)
+		return
+	}
+
+	if _, _, err := chargeQuota(c.ctx, 1); err != nil {
+		c.queue(liveError{Type: "error", Error: err.Error()})
+		return
+	}
+
+	res := fetchRepo(name)
+
+	if res.Err != nil {
+		c.queue(liveUpdate{Type: "stars", RepoV2: newRepoV2(res)})
+		return
+	}
+
+	// the lookup already went out through the hub, this
+	// covers us if someone else beat us to the cache
+	obs, _ := cache.get(name)
+	c.sendStars(name, obs)
+}
+
+// apply a subscribe or unsubscribe message
+func (c *liveConn) handle(req liveRequest) {
+	switch req.Type {
+	case "subscribe":
+		// a bad name would sit in the hub forever, turn the whole message away
+		if errs := validateRepoNames(req.Repos); len(errs) > 0 {
+			c.queue(liveError{Type: "error", Error: errs[0].Error})
+			return
+		}
+
+		c.mu.Lock()
+		added := make([]string, 0, len(req.Repos))
+		// the same repo twice in one message is one subscription
+		seen := make(map[string]bool, len(req.Repos))
+		for _, name := range req.Repos {
+			if !c.subs[cacheKey(name)] && !seen[cacheKey(name)] {
+				seen[cacheKey(name)] = true
+				added = append(added, name)
+			}
+		}
+
+		if len(c.subs)+len(added) > maxLiveSubscriptions {
+			c.mu.Unlock()
+			c.queue(liveError{Type: "error", Error: "Too many subscriptions. Limit is " + strconv.Itoa(maxLiveSubscriptions) + " repos per connection"})
+			return
+		}
+
+		for _, name := range added {
+			c.subs[cacheKey(name)] = true
+		}
+		c.mu.Unlock()
+
+		for _, name := range added {
+			live.subscribe(c, name)
+			c.pending.Add(1)
+			go func(name string) {
+				defer c.pending.Done()
+				c.sendCurrent(name)
+			}(name)
+		}
+	case "unsubscribe":
+		for _, name := range req.Repos {
+			live.unsubscribe(c, name)
+			c.mu.Lock()
+			delete(c.subs, cacheKey(name))
+			delete(c.sent, cacheKey(name))
+			c.mu.Unlock()
+		}
+	default:
+		c.queue(liveError{Type: "error", Error: "Unknown message type: " + req.Type})
+	}
+}
+
+// pump queued messages and heartbeats out to the client
+func (c *liveConn) writeLoop() {
+	ticker := time.NewTicker(livePingInterval)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if !ok {
+				c.mu.Lock()
+				slow := c.slow
+				c.mu.Unlock()
+				if slow {
+					c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"))
+				}
+				return
+			}
+			if err := c.ws.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read client messages until the connection goes away
+func (c *liveConn) readLoop() {
+	c.ws.SetReadLimit(64 * 1024)
+	c.ws.SetReadDeadline(time.Now().Add(liveReadTimeout))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(liveReadTimeout))
+	})
+
+	for {
+		_, body, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req liveRequest
+		if json.Unmarshal(body, &req) != nil {
+			c.queue(liveError{Type: "error", Error: "Malformed Request."})
+			continue
+		}
+
+		c.handle(req)
+	}
+}
+
+// drop every subscription and stop the writer
+func (c *liveConn) close() {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.subs))
+	for key := range c.subs {
+		names = append(names, key)
+	}
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+	c.mu.Unlock()
+
+	for _, name := range names {
+		live.unsubscribe(c, name)
+	}
+}
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// HTTP route that upgrades to a websocket for live star counts
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /ws route
+	if r.URL.Path != "/ws" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	// the upgrader writes its own error response
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	liveConnections.Inc()
+	c := newLiveConn(ws)
+	c.ctx = r.Context()
+	go c.writeLoop()
+	c.readLoop()
+	c.close()
+	c.pending.Wait()
+	liveConnections.Dec()
+}
+
+var live = newLiveHub()
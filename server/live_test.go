@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to open a websocket against the live handler
+func dialLive(t *testing.T) (*websocket.Conn, func()) {
+	// upgraded connections aren't tracked by the test server,
+	// so wait for the handler ourselves before the next test runs
+	wg := sync.WaitGroup{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		liveHandler(w, r)
+	}))
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, func() {
+		ws.Close()
+		wg.Wait()
+		ts.Close()
+	}
+}
+
+// helper to read the next message with a timeout so a broken test can't hang
+func readLive(t *testing.T, ws *websocket.Conn) map[string]interface{} {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg map[string]interface{}
+	err := ws.ReadJSON(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestLiveHandler(t *testing.T) {
+
+	resetCache()
+	live = newLiveHub()
+	cache.record("rdelpret/cartographer", 1, false)
+
+	ws, close := dialLive(t)
+	defer close()
+
+	// subscribing sends the current count straight away
+	ws.WriteJSON(liveRequest{Type: "subscribe", Repos: []string{"rdelpret/cartographer"}})
+	msg := readLive(t, ws)
+	assert.Equal(t, "stars", msg["type"])
+	assert.Equal(t, "rdelpret/cartographer", msg["name"])
+	assert.Equal(t, float64(1), msg["stars"])
+	assert.NotNil(t, msg["fetched_at"])
+
+	// new counts from anywhere get pushed
+	observeStars("rdelpret/cartographer", 2)
+	msg = readLive(t, ws)
+	assert.Equal(t, float64(2), msg["stars"])
+
+	// repos we aren't watching don't
+	observeStars("rdelpret/kfx", 7)
+
+	// bad messages get an error back, not a dropped connection
+	ws.WriteMessage(websocket.TextMessage, []byte("not json"))
+	msg = readLive(t, ws)
+	assert.Equal(t, map[string]interface{}{"type": "error", "error": "Malformed Request."}, msg)
+
+	ws.WriteJSON(liveRequest{Type: "bogus"})
+	msg = readLive(t, ws)
+	assert.Equal(t, "Unknown message type: bogus", msg["error"])
+
+	// invalid names aren't subscribed to
+	ws.WriteJSON(liveRequest{Type: "subscribe", Repos: []string{"rdelpret/kfx", ""}})
+	msg = readLive(t, ws)
+	assert.Equal(t, map[string]interface{}{"type": "error", "error": "Missing repo name. Hint: <org>/<repo-name>"}, msg)
+	observeStars("rdelpret/kfx", 8)
+	ws.WriteJSON(liveRequest{Type: "bogus"})
+	msg = readLive(t, ws)
+	assert.Equal(t, "error", msg["type"])
+
+	// after unsubscribing nothing else comes through
+	ws.WriteJSON(liveRequest{Type: "unsubscribe", Repos: []string{"rdelpret/cartographer"}})
+	ws.WriteJSON(liveRequest{Type: "bogus"})
+	readLive(t, ws)
+	observeStars("rdelpret/cartographer", 3)
+	ws.WriteJSON(liveRequest{Type: "bogus"})
+	msg = readLive(t, ws)
+	assert.Equal(t, "error", msg["type"])
+}
+
+func TestLiveSubscriptionLimit(t *testing.T) {
+
+	resetCache()
+	live = newLiveHub()
+	maxLiveSubscriptions = 2
+	defer func() { maxLiveSubscriptions = 100 }()
+
+	cache.record("a/a", 1, false)
+	cache.record("b/b", 1, false)
+
+	ws, close := dialLive(t)
+	defer close()
+
+	ws.WriteJSON(liveRequest{Type: "subscribe", Repos: []string{"a/a", "b/b", "c/c"}})
+	msg := readLive(t, ws)
+	assert.Equal(t, map[string]interface{}{"type": "error", "error": "Too many subscriptions. Limit is 2 repos per connection"}, msg)
+
+	// the same repo twice in a message is one subscription and one count
+	ws.WriteJSON(liveRequest{Type: "subscribe", Repos: []string{"a/a", "A/A", "b/b", "a/a"}})
+	first, second := readLive(t, ws), readLive(t, ws)
+	assert.ElementsMatch(t, []interface{}{"a/a", "b/b"}, []interface{}{first["name"], second["name"]})
+
+	// resubscribing to the same repo doesn't count twice
+	ws.WriteJSON(liveRequest{Type: "subscribe", Repos: []string{"a/a"}})
+	ws.WriteJSON(liveRequest{Type: "bogus"})
+	msg = readLive(t, ws)
+	assert.Equal(t, "Unknown message type: bogus", msg["error"])
+}
+
+func TestLiveUnknownRepo(t *testing.T) {
+
+	resetCache()
+	live = newLiveHub()
+
+	close := mockGithubAPI(`{"stargazers_count" : 5}`, 200)
+	defer close()
+
+	ws, closeWS := dialLive(t)
+	defer closeWS()
+
+	// repos we haven't seen are looked up
+	ws.WriteJSON(liveRequest{Type: "subscribe", Repos: []string{"rdelpret/cartographer"}})
+	msg := readLive(t, ws)
+	assert.Equal(t, float64(5), msg["stars"])
+
+	// and only sent once even though the lookup also goes through the hub
+	ws.WriteJSON(liveRequest{Type: "bogus"})
+	msg = readLive(t, ws)
+	assert.Equal(t, "error", msg["type"])
+}
+
+func TestLiveHandlerRoutes(t *testing.T) {
+
+	// Test using wrong HTTP Method
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/ws", nil)
+	http.HandlerFunc(liveHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/wrongroute", nil)
+	http.HandlerFunc(liveHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"net/http"
+)
+
+// ------------------------------ OPENAPI ------------------------------
+
+// OpenAPI 3 description of the stars api, served from /openapi.json.
+// Keep this in sync with the handlers, the tests check responses against it
+var openAPISpec = []byte(`{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Rainbow Road",
+    "description": "Star counts for GitHub, GitLab and Gitea repos",
+    "version": "2.0.0"
+  },
+  "security": [{"apiKey": []}],
+  "paths": {
+    "/v2/stars": {
+      "post": {
+        "summary": "Get star counts for a list of repos",
+        "operationId": "getStarsV2",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"$ref": "#/components/schemas/StarsRequest"}
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "One entry per requested repo, in request order",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/StarsResponseV2"}
+              }
+            }
+          },
+          "400": {"description": "Malformed request body"},
+          "401": {"description": "Auth is on and the API key is missing or invalid"},
+          "403": {"description": "The API key is missing the read scope"},
+          "429": {"description": "Rate limited, or the API key's daily quota is used up. See Retry-After"},
+          "413": {"description": "Request body or repo list over the server's limits"},
+          "422": {
+            "description": "One or more repo names are invalid, nothing was looked up",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/ValidationErrors"}
+              }
+            }
+          }
+        }
+      }
+    },
+    "/stars": {
+      "post": {
+        "summary": "Get star counts for a list of repos (v1)",
+        "description": "Kept for existing clients. New clients should use /v2/stars",
+        "operationId": "getStars",
+        "deprecated": true,
+        "parameters": [
+          {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["stars", "name", "forks"]}, "description": "Request order when left out"},
+          {"name": "order", "in": "query", "schema": {"type": "string", "enum": ["asc", "desc"]}, "description": "Defaults to desc for stars and forks, asc for name"},
+          {"name": "min_stars", "in": "query", "schema": {"type": "integer", "minimum": 0}, "description": "Only lookups that worked, with at least this many stars"},
+          {"name": "max_stars", "in": "query", "schema": {"type": "integer", "minimum": 0}, "description": "Only lookups that worked, with at most this many stars"},
+          {"name": "only_errors", "in": "query", "schema": {"type": "boolean"}, "description": "Only lookups that failed"},
+          {"name": "filter", "in": "query", "schema": {"type": "string", "maxLength": 1000}, "description": "Expression over name, owner, provider, status, stars, forks, open_issues, language, archived and days_since_push, ie stars > 1000 && language == \"Go\" && !archived"},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1}, "description": "Page size"},
+          {"name": "cursor", "in": "query", "schema": {"type": "string"}, "description": "next_cursor from the previous page. Later pages are cut from the first page's results, kept for 10 minutes on the replica that handed the cursor out, so nothing is looked up or charged again and the body, sort and filters are ignored"},
+          {"name": "aggregates", "in": "query", "schema": {"type": "boolean"}, "description": "Add statistics across every repo that matched, on every page. Not available as CSV"},
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json", "csv", "yaml", "msgpack"]}, "description": "Response format, takes priority over the Accept header"}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"$ref": "#/components/schemas/StarsRequest"}
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "One entry per requested repo, in request order",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/StarsResponseV1"}
+              },
+              "application/yaml": {
+                "schema": {"$ref": "#/components/schemas/StarsResponseV1"}
+              },
+              "application/msgpack": {
+                "schema": {"$ref": "#/components/schemas/StarsResponseV1"}
+              },
+              "text/csv": {
+                "schema": {"type": "string", "description": "name,stars,error header then one row per repo. Paged responses send X-Total-Count and X-Next-Cursor headers"}
+              }
+            }
+          },
+          "400": {"description": "Malformed request body or query parameters"},
+          "406": {"description": "None of the accepted types or the format parameter are supported"},
+          "401": {"description": "Auth is on and the API key is missing or invalid"},
+          "403": {"description": "The API key is missing the read scope"},
+          "429": {"description": "Rate limited, or the API key's daily quota is used up. See Retry-After"},
+          "413": {"description": "Request body or repo list over the server's limits"},
+          "422": {
+            "description": "One or more repo names are invalid, nothing was looked up",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/ValidationErrors"}
+              }
+            }
+          }
+        }
+      }
+    },
+    "/repos/{owner}/{repo}": {
+      "get": {
+        "summary": "Get the star count for a single repo (v1 entry)",
+        "operationId": "getRepo",
+        "parameters": [
+          {"name": "owner", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "repo", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The repo's star count",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/RepoV1"}
+              }
+            }
+          },
+          "304": {"description": "Not modified since the ETag in If-None-Match"},
+          "401": {"description": "Auth is on and the API key is missing or invalid"},
+          "403": {"description": "The API key is missing the read scope"},
+          "404": {"description": "The name isn't a valid repo, or the provider has no such repo. Not charged against the quota when the name is invalid"},
+          "429": {"description": "Rate limited, or the API key's daily quota is used up. See Retry-After"},
+          "502": {"description": "The provider failed or timed out, the repo may still exist"}
+        }
+      }
+    },
+    "/badge/{owner}/{repo}.svg": {
+      "get": {
+        "summary": "Get a shields style star count badge for a single repo",
+        "operationId": "getBadge",
+        "description": "Needs no key. With auth enabled only cached counts are served, a repo that isn't cached gets an unavailable badge",
+        "security": [],
+        "parameters": [
+          {"name": "owner", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "repo", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "style", "in": "query", "schema": {"type": "string", "enum": ["flat", "flat-square", "for-the-badge"], "default": "flat"}},
+          {"name": "color", "in": "query", "description": "A shields colour name or hex code, colour also works", "schema": {"type": "string", "default": "blue"}},
+          {"name": "label", "in": "query", "description": "Text on the left of the badge, empty for none", "schema": {"type": "string", "default": "stars"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The badge. Repos that could not be looked up get an uncached unavailable badge",
+            "content": {
+              "image/svg+xml": {
+                "schema": {"type": "string"}
+              }
+            }
+          },
+          "304": {"description": "Not modified since the ETag in If-None-Match"},
+          "400": {"description": "Invalid style or colour"},
+          "429": {"description": "Rate limited, see Retry-After"}
+        }
+      }
+    },
+    "/chart/{owner}/{repo}.svg": {
+      "get": {
+        "summary": "Get a line chart of star history for one or more repos",
+        "operationId": "getChart",
+        "description": "Needs no key. With auth enabled only cached counts are drawn, a repo that isn't cached has no data",
+        "security": [],
+        "parameters": [
+          {"name": "owner", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "repo", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "range", "in": "query", "description": "How far back to draw, ie 24h, 90d, 12w, 6m, 1y or all", "schema": {"type": "string", "default": "90d"}},
+          {"name": "repos", "in": "query", "description": "More repos to draw on the same chart, comma separated or repeated. Up to 10 repos per chart", "schema": {"type": "array", "items": {"type": "string"}}, "style": "form", "explode": true}
+        ],
+        "responses": {
+          "200": {
+            "description": "The chart, with a legend entry per repo",
+            "content": {
+              "image/svg+xml": {
+                "schema": {"type": "string"}
+              }
+            }
+          },
+          "304": {"description": "Not modified since the ETag in If-None-Match"},
+          "400": {"description": "Invalid range or too many repos"},
+          "429": {"description": "Rate limited, see Retry-After"},
+          "422": {
+            "description": "One or more repo names are invalid",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/ValidationErrors"}
+              }
+            }
+          }
+        }
+      }
+    },
+    "/keys": {
+      "get": {
+        "summary": "List API keys with how much of their quota they used today",
+        "operationId": "listKeys",
+        "responses": {
+          "200": {
+            "description": "Every key, oldest first. Revoked keys are included",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "required": ["keys"],
+                  "properties": {
+                    "keys": {"type": "array", "items": {"$ref": "#/components/schemas/APIKey"}}
+                  }
+                }
+              }
+            }
+          },
+          "401": {"description": "Auth is on and the API key is missing or invalid"},
+          "403": {"description": "The API key is missing the admin scope"}
+        }
+      },
+      "post": {
+        "summary": "Mint an API key",
+        "operationId": "mintKey",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"$ref": "#/components/schemas/MintRequest"}
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "The new key. This is the only time the key itself is shown",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/APIKey"}
+              }
+            }
+          },
+          "400": {"description": "Malformed request, missing name, unknown scope or a quota below 1"},
+          "401": {"description": "Auth is on and the API key is missing or invalid"},
+          "403": {"description": "The API key is missing the admin scope"}
+        }
+      }
+    },
+    "/keys/{id}": {
+      "parameters": [
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "Get an API key",
+        "operationId": "getKey",
+        "responses": {
+          "200": {
+            "description": "The key, without the key itself",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/APIKey"}
+              }
+            }
+          },
+          "404": {"description": "No such key"}
+        }
+      },
+      "delete": {
+        "summary": "Revoke an API key",
+        "operationId": "revokeKey",
+        "responses": {
+          "200": {
+            "description": "The revoked key. It stays in the list with revoked_at set",
+            "content": {
+              "application/json": {
+                "schema": {"$ref": "#/components/schemas/APIKey"}
+              }
+            }
+          },
+          "404": {"description": "No such key"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "apiKey": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "Only checked when the server runs with auth.enabled. Keys are minted with POST /keys"
+      }
+    },
+    "schemas": {
+      "MintRequest": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"type": "string", "enum": ["read", "jobs", "admin"]}, "description": "Defaults to read"},
+          "daily_quota": {"type": "integer", "minimum": 1, "description": "Upstream calls a day, defaults to auth.default_quota"}
+        }
+      },
+      "APIKey": {
+        "type": "object",
+        "required": ["id", "name", "scopes", "daily_quota", "created_at", "revoked_at"],
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"type": "string", "enum": ["read", "jobs", "admin"]}},
+          "daily_quota": {"type": "integer", "minimum": 1},
+          "created_at": {"type": "string", "format": "date-time"},
+          "revoked_at": {"type": "string", "format": "date-time", "nullable": true},
+          "key": {"type": "string", "description": "Only sent when the key is minted"},
+          "used_today": {"type": "integer", "minimum": 0, "description": "Upstream calls charged so far today, UTC"}
+        }
+      },
+      "StarsRequest": {
+        "type": "object",
+        "required": ["repos"],
+        "properties": {
+          "repos": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["name"],
+              "properties": {
+                "name": {
+                  "type": "string",
+                  "description": "owner/repo, optionally prefixed with a provider, ie gitlab:group/project"
+                }
+              }
+            }
+          }
+        }
+      },
+      "StarsResponseV2": {
+        "type": "object",
+        "required": ["repos"],
+        "additionalProperties": false,
+        "properties": {
+          "repos": {
+            "type": "array",
+            "items": {"$ref": "#/components/schemas/RepoV2"}
+          }
+        }
+      },
+      "RepoV2": {
+        "type": "object",
+        "required": ["name", "stars", "status", "error"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string"},
+          "stars": {"type": "integer", "nullable": true, "minimum": 0},
+          "status": {"type": "string", "enum": ["ok", "invalid", "not_found", "upstream_error"]},
+          "error": {"type": "string", "nullable": true}
+        }
+      },
+      "ValidationErrors": {
+        "type": "object",
+        "required": ["error", "errors"],
+        "additionalProperties": false,
+        "properties": {
+          "error": {"type": "string"},
+          "errors": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["index", "name", "error"],
+              "additionalProperties": false,
+              "properties": {
+                "index": {"type": "integer", "minimum": 0, "description": "Position of the repo in the request"},
+                "name": {"type": "string"},
+                "error": {"type": "string"}
+              }
+            }
+          }
+        }
+      },
+      "StarsResponseV1": {
+        "type": "object",
+        "required": ["repos"],
+        "additionalProperties": false,
+        "properties": {
+          "repos": {
+            "type": "array",
+            "items": {"$ref": "#/components/schemas/RepoV1"}
+          },
+          "meta": {"$ref": "#/components/schemas/ResultsMeta"},
+          "aggregates": {"$ref": "#/components/schemas/Aggregates"}
+        }
+      },
+      "Aggregates": {
+        "type": "object",
+        "description": "Only sent with ?aggregates=true. Covers every repo that matched the filters, not just the current page. Star figures are null if no lookup worked",
+        "required": ["count", "sum", "mean", "median", "min", "max", "percentiles", "errors"],
+        "additionalProperties": false,
+        "properties": {
+          "count": {"type": "integer", "minimum": 0, "description": "Lookups that worked"},
+          "sum": {"type": "integer", "minimum": 0},
+          "mean": {"type": "number", "nullable": true},
+          "median": {"type": "number", "nullable": true},
+          "min": {"type": "integer", "nullable": true, "minimum": 0},
+          "max": {"type": "integer", "nullable": true, "minimum": 0},
+          "percentiles": {
+            "type": "object",
+            "description": "p25, p50, p75, p90, p95 and p99",
+            "additionalProperties": {"type": "number"}
+          },
+          "errors": {
+            "type": "object",
+            "description": "Failed lookups by status",
+            "required": ["invalid", "not_found", "upstream_error"],
+            "additionalProperties": false,
+            "properties": {
+              "invalid": {"type": "integer", "minimum": 0},
+              "not_found": {"type": "integer", "minimum": 0},
+              "upstream_error": {"type": "integer", "minimum": 0}
+            }
+          }
+        }
+      },
+      "ResultsMeta": {
+        "type": "object",
+        "description": "Only sent when the results were sorted, filtered or paged",
+        "required": ["total", "returned", "next_cursor"],
+        "additionalProperties": false,
+        "properties": {
+          "total": {"type": "integer", "minimum": 0, "description": "Results matching the filters across every page"},
+          "returned": {"type": "integer", "minimum": 0},
+          "next_cursor": {"type": "string", "nullable": true, "description": "null on the last page"}
+        }
+      },
+      "RepoV1": {
+        "type": "object",
+        "required": ["name", "Stars", "Error"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string"},
+          "Stars": {"type": "integer", "description": "-1 when the lookup failed"},
+          "Error": {"type": "string", "description": "\"<nil>\" when the lookup worked"}
+        }
+      }
+    }
+  }
+}
+`)
+
+// HTTP route to serve the OpenAPI document
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /openapi.json route
+	if r.URL.Path != "/openapi.json" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to load the spec we serve
+func loadSpec(t *testing.T) map[string]interface{} {
+	var spec map[string]interface{}
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// helper to look up a #/components/schemas/... reference
+func resolveRef(spec map[string]interface{}, ref string) map[string]interface{} {
+	var node interface{} = spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		node = node.(map[string]interface{})[part]
+	}
+	return node.(map[string]interface{})
+}
+
+// Check a decoded json value against a schema from the spec. Only handles
+// the parts of OpenAPI the spec uses, which keeps the test honest about what it checks
+func checkSchema(spec map[string]interface{}, schema map[string]interface{}, value interface{}, path string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		return checkSchema(spec, resolveRef(spec, ref), value, path)
+	}
+
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{path + ": null but not nullable"}
+	}
+
+	var errs []string
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{path + ": not an object"}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required field %s", path, name))
+			}
+		}
+		for name, val := range obj {
+			prop, ok := props[name].(map[string]interface{})
+			if !ok {
+				if schema["additionalProperties"] == false {
+					errs = append(errs, fmt.Sprintf("%s: unexpected field %s", path, name))
+				}
+				continue
+			}
+			errs = append(errs, checkSchema(spec, prop, val, path+"."+name)...)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return []string{path + ": not an array"}
+		}
+		items := schema["items"].(map[string]interface{})
+		for i, val := range arr {
+			errs = append(errs, checkSchema(spec, items, val, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{path + ": not a string"}
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == str
+			}
+			if !found {
+				errs = append(errs, fmt.Sprintf("%s: %q not in enum", path, str))
+			}
+		}
+	case "integer":
+		num, ok := value.(float64)
+		if !ok || num != float64(int(num)) {
+			return []string{path + ": not an integer"}
+		}
+		if min, ok := schema["minimum"].(float64); ok && num < min {
+			errs = append(errs, fmt.Sprintf("%s: %v below minimum %v", path, num, min))
+		}
+	}
+
+	return errs
+}
+
+// helper to check a recorded response against the spec for an operation
+func assertMatchesSpec(t *testing.T, method string, route string, recorder *httptest.ResponseRecorder) {
+	spec := loadSpec(t)
+
+	paths := resolveRef(spec, "#/paths")
+	op := paths[route].(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+	response := op["responses"].(map[string]interface{})[fmt.Sprint(recorder.Code)]
+	if !assert.NotNil(t, response, "status %d not documented for %s %s", recorder.Code, method, route) {
+		return
+	}
+
+	content := response.(map[string]interface{})["content"].(map[string]interface{})
+	schema := content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+
+	var body interface{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Nil(t, err)
+
+	assert.Empty(t, checkSchema(spec, schema, body, "$"))
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+
+	// test happy path
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	http.HandlerFunc(openAPIHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var spec map[string]interface{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &spec))
+	assert.Equal(t, "3.0.3", spec["openapi"])
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/openapi.json", nil)
+	http.HandlerFunc(openAPIHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+}
+
+func TestCheckSchema(t *testing.T) {
+	// make sure the checker actually catches things
+	spec := loadSpec(t)
+	schema := resolveRef(spec, "#/components/schemas/RepoV2")
+
+	var good, bad interface{}
+	json.Unmarshal([]byte(`{"name":"a/b","stars":1,"status":"ok","error":null}`), &good)
+	json.Unmarshal([]byte(`{"name":"a/b","Stars":-1,"status":"broken","error":"x"}`), &bad)
+
+	assert.Empty(t, checkSchema(spec, schema, good, "$"))
+	assert.ElementsMatch(t, []string{
+		"$: missing required field stars",
+		"$: unexpected field Stars",
+		`$.status: "broken" not in enum`,
+	}, checkSchema(spec, schema, bad, "$"))
+}
+
+func TestHandlersMatchSpec(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	for _, body := range [][]byte{
+		[]byte(`{"repos": [{"name": "rdelpret/cartographer"}, {"name": "rdelpret/kfx"}]}`),
+		[]byte(`{"repos": [{"name": "rdelpret/cartographer"}, {"name": "invalid"}]}`),
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v2/stars", bytes.NewBuffer(body))
+		http.HandlerFunc(starsV2Handler).ServeHTTP(recorder, req)
+		assertMatchesSpec(t, "POST", "/v2/stars", recorder)
+
+		recorder = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/stars", bytes.NewBuffer(body))
+		http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+		assertMatchesSpec(t, "POST", "/stars", recorder)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/repos/rdelpret/cartographer", nil)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+	assertMatchesSpec(t, "GET", "/repos/{owner}/{repo}", recorder)
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/keys", bytes.NewBufferString(`{"name": "ci", "scopes": ["read", "jobs"]}`))
+	http.HandlerFunc(keysHandler).ServeHTTP(recorder, req)
+	assertMatchesSpec(t, "POST", "/keys", recorder)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/keys", nil)
+	http.HandlerFunc(keysHandler).ServeHTTP(recorder, req)
+	assertMatchesSpec(t, "GET", "/keys", recorder)
+}
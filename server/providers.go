@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------- PROVIDERS -----------------------------
+
+// Provider is a git host we know how to get star counts from.
+// Repos pick a provider with a prefix, ie gitlab:group/subgroup/project.
+// Repos without a prefix go to github.
+type Provider interface {
+	// name used as the repo prefix
+	Name() string
+	// api url describing a repo, validating the repo path on the way
+	RepoURL(path string) (string, error)
+	// api url for the repo's newest releases, at most limit of them
+	ReleasesURL(path string, limit int) (string, error)
+	// add credentials to an outgoing request if we have them
+	Authorize(req *http.Request)
+	// pull the star count out of the decoded api response
+	ParseStars(obj map[string]interface{}) (int, error)
+	// pull everything else we use out of the decoded api response
+	ParseMeta(obj map[string]interface{}) repoMeta
+	// when a release from the repo's releases api was published
+	ParseReleaseTime(obj map[string]interface{}) time.Time
+}
+
+// helper function to read a json number out of an api response
+func jsonInt(obj map[string]interface{}, field string) (int, error) {
+	val, ok := obj[field].(float64)
+	if !ok {
+		return -1, errors.New("Unexpected response, missing " + field)
+	}
+	return int(val), nil
+}
+
+// Everything else we know about a repo, pulled from the same api
+// response as its stars. Anything the provider didn't send is left
+// at -1, "" or the zero time
+type repoMeta struct {
+	Forks      int
+	OpenIssues int
+	Language   string
+	Archived   bool
+	PushedAt   time.Time
+}
+
+// read the fields every provider names the same way, the rest is up to each provider
+func parseCommonMeta(obj map[string]interface{}) repoMeta {
+	meta := repoMeta{Forks: -1, OpenIssues: -1}
+
+	if forks, err := jsonInt(obj, "forks_count"); err == nil {
+		meta.Forks = forks
+	}
+
+	if issues, err := jsonInt(obj, "open_issues_count"); err == nil {
+		meta.OpenIssues = issues
+	}
+
+	meta.Language, _ = obj["language"].(string)
+	meta.Archived, _ = obj["archived"].(bool)
+
+	return meta
+}
+
+// helper function to read an RFC 3339 timestamp out of an api response
+func jsonTime(obj map[string]interface{}, field string) time.Time {
+	val, _ := obj[field].(string)
+	t, _ := time.Parse(time.RFC3339, val)
+	return t
+}
+
+// make sure base urls always end in a slash so we can just append paths
+func normalizeBaseURL(base string) string {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base
+}
+
+// owner/repo style names, used by github and gitea
+var ownerRepoPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// gitlab projects can be in any number of nested groups
+var gitlabPathPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)+$`)
+
+// Check a repo path against a provider's pattern. . and .. would walk
+// the path we append it to up to other api endpoints
+func validRepoPath(pattern *regexp.Regexp, path string) bool {
+	if !pattern.MatchString(path) {
+		return false
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// escape each segment of a repo path, keeping the slashes between them
+func escapeRepoPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+type githubProvider struct {
+	baseURL string
+	token   string
+}
+
+func (p *githubProvider) Name() string { return "github" }
+
+func (p *githubProvider) RepoURL(path string) (string, error) {
+	if !validRepoPath(ownerRepoPattern, path) {
+		return p.baseURL + "repos/", errors.New("Recieved invalid repo name: " + path)
+	}
+	return p.baseURL + "repos/" + escapeRepoPath(path), nil
+}
+
+func (p *githubProvider) ReleasesURL(path string, limit int) (string, error) {
+	url, err := p.RepoURL(path)
+	return url + "/releases?per_page=" + strconv.Itoa(limit), err
+}
+
+func (p *githubProvider) Authorize(req *http.Request) {
+	if p.token != "" {
+		req.Header.Set("Authorization", "token "+p.token)
+	}
+}
+
+func (p *githubProvider) ParseStars(obj map[string]interface{}) (int, error) {
+	return jsonInt(obj, "stargazers_count")
+}
+
+func (p *githubProvider) ParseMeta(obj map[string]interface{}) repoMeta {
+	meta := parseCommonMeta(obj)
+	meta.PushedAt = jsonTime(obj, "pushed_at")
+	return meta
+}
+
+func (p *githubProvider) ParseReleaseTime(obj map[string]interface{}) time.Time {
+	return jsonTime(obj, "published_at")
+}
+
+// gitlab projects can live in nested groups, ie group/subgroup/project
+type gitlabProvider struct {
+	baseURL string
+	token   string
+}
+
+func (p *gitlabProvider) Name() string { return "gitlab" }
+
+func (p *gitlabProvider) RepoURL(path string) (string, error) {
+	if !validRepoPath(gitlabPathPattern, path) {
+		return p.baseURL + "api/v4/projects/", errors.New("Recieved invalid repo name: " + path)
+	}
+	// the api wants the full project path as a single url encoded segment
+	id := strings.ReplaceAll(url.PathEscape(path), "/", "%2F")
+	return p.baseURL + "api/v4/projects/" + id, nil
+}
+
+func (p *gitlabProvider) ReleasesURL(path string, limit int) (string, error) {
+	url, err := p.RepoURL(path)
+	return url + "/releases?per_page=" + strconv.Itoa(limit), err
+}
+
+func (p *gitlabProvider) Authorize(req *http.Request) {
+	if p.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", p.token)
+	}
+}
+
+func (p *gitlabProvider) ParseStars(obj map[string]interface{}) (int, error) {
+	return jsonInt(obj, "star_count")
+}
+
+func (p *gitlabProvider) ParseMeta(obj map[string]interface{}) repoMeta {
+	meta := parseCommonMeta(obj)
+	meta.PushedAt = jsonTime(obj, "last_activity_at")
+	return meta
+}
+
+func (p *gitlabProvider) ParseReleaseTime(obj map[string]interface{}) time.Time {
+	return jsonTime(obj, "released_at")
+}
+
+type giteaProvider struct {
+	baseURL string
+	token   string
+}
+
+func (p *giteaProvider) Name() string { return "gitea" }
+
+func (p *giteaProvider) RepoURL(path string) (string, error) {
+	if !validRepoPath(ownerRepoPattern, path) {
+		return p.baseURL + "api/v1/repos/", errors.New("Recieved invalid repo name: " + path)
+	}
+	return p.baseURL + "api/v1/repos/" + escapeRepoPath(path), nil
+}
+
+// gitea pages with limit, not per_page
+func (p *giteaProvider) ReleasesURL(path string, limit int) (string, error) {
+	url, err := p.RepoURL(path)
+	return url + "/releases?limit=" + strconv.Itoa(limit), err
+}
+
+func (p *giteaProvider) Authorize(req *http.Request) {
+	if p.token != "" {
+		req.Header.Set("Authorization", "token "+p.token)
+	}
+}
+
+func (p *giteaProvider) ParseStars(obj map[string]interface{}) (int, error) {
+	return jsonInt(obj, "stars_count")
+}
+
+func (p *giteaProvider) ParseMeta(obj map[string]interface{}) repoMeta {
+	meta := parseCommonMeta(obj)
+	meta.PushedAt = jsonTime(obj, "updated_at")
+	return meta
+}
+
+func (p *giteaProvider) ParseReleaseTime(obj map[string]interface{}) time.Time {
+	return jsonTime(obj, "published_at")
+}
+
+// set up every provider from the upstream config
+func newProviders(cfg upstreamConfig) map[string]Provider {
+	list := []Provider{
+		&githubProvider{baseURL: normalizeBaseURL(cfg.githubURL), token: cfg.githubToken},
+		&gitlabProvider{baseURL: normalizeBaseURL(cfg.gitlabURL), token: cfg.gitlabToken},
+		&giteaProvider{baseURL: normalizeBaseURL(cfg.giteaURL), token: cfg.giteaToken},
+	}
+
+	res := make(map[string]Provider)
+	for _, p := range list {
+		res[p.Name()] = p
+	}
+	return res
+}
+
+// split a repo name into its provider and the path the provider understands
+func resolveProvider(repoName string) (Provider, string, error) {
+	prefix := "github"
+	path := repoName
+
+	if i := strings.Index(repoName, ":"); i != -1 {
+		prefix = repoName[:i]
+		path = repoName[i+1:]
+	}
+
+	provider, ok := currentProviders()[prefix]
+	if !ok {
+		return nil, path, errors.New("Recieved unknown provider: " + prefix)
+	}
+
+	return provider, path, nil
+}
+
+var providers = newProviders(defaultConfig().upstream)
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveProvider(t *testing.T) {
+	provider, path, err := resolveProvider("rdelpret/cartographer")
+	assert.Nil(t, err)
+	assert.Equal(t, "github", provider.Name())
+	assert.Equal(t, "rdelpret/cartographer", path)
+
+	provider, path, err = resolveProvider("gitlab:group/subgroup/project")
+	assert.Nil(t, err)
+	assert.Equal(t, "gitlab", provider.Name())
+	assert.Equal(t, "group/subgroup/project", path)
+
+	provider, path, err = resolveProvider("gitea:owner/repo")
+	assert.Nil(t, err)
+	assert.Equal(t, "gitea", provider.Name())
+	assert.Equal(t, "owner/repo", path)
+
+	_, _, err = resolveProvider("bitbucket:owner/repo")
+	assert.EqualError(t, err, "Recieved unknown provider: bitbucket")
+}
+
+func TestProviderRepoURL(t *testing.T) {
+	github := &githubProvider{baseURL: "https://github.example.com/api/v3/"}
+	url, err := github.RepoURL("rdelpret/cartographer")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/repos/rdelpret/cartographer", url)
+
+	gitlab := &gitlabProvider{baseURL: "https://gitlab.example.com/"}
+	url, err = gitlab.RepoURL("group/subgroup/project")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gitlab.example.com/api/v4/projects/group%2Fsubgroup%2Fproject", url)
+
+	gitea := &giteaProvider{baseURL: "https://gitea.example.com/"}
+	url, err = gitea.RepoURL("owner/repo")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gitea.example.com/api/v1/repos/owner/repo", url)
+
+	for _, p := range []Provider{github, gitlab, gitea} {
+		for _, name := range []string{"invalid", "/", "owner/", "/repo", "../../user/x", "owner/..", "./repo", "owner/repo?x=1", "owner/re po"} {
+			_, err = p.RepoURL(name)
+			assert.EqualError(t, err, "Recieved invalid repo name: "+name)
+		}
+	}
+
+	// only gitlab has nested groups
+	for _, p := range []Provider{github, gitea} {
+		_, err = p.RepoURL("a/b/c")
+		assert.EqualError(t, err, "Recieved invalid repo name: a/b/c")
+	}
+
+	// dots are fine inside a name
+	url, err = github.RepoURL("rdelpret/rainbow-road.go")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/repos/rdelpret/rainbow-road.go", url)
+}
+
+func TestProviderReleasesURL(t *testing.T) {
+	url, err := (&githubProvider{baseURL: "https://api.github.com/"}).ReleasesURL("rdelpret/cartographer", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.github.com/repos/rdelpret/cartographer/releases?per_page=10", url)
+
+	url, err = (&gitlabProvider{baseURL: "https://gitlab.com/"}).ReleasesURL("group/project", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gitlab.com/api/v4/projects/group%2Fproject/releases?per_page=10", url)
+
+	url, err = (&giteaProvider{baseURL: "https://gitea.com/"}).ReleasesURL("owner/repo", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gitea.com/api/v1/repos/owner/repo/releases?limit=10", url)
+
+	_, err = (&giteaProvider{baseURL: "https://gitea.com/"}).ReleasesURL("../repo", 10)
+	assert.EqualError(t, err, "Recieved invalid repo name: ../repo")
+}
+
+func TestProviderAuthorize(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	(&githubProvider{token: "gh"}).Authorize(req)
+	assert.Equal(t, "token gh", req.Header.Get("Authorization"))
+
+	req, _ = http.NewRequest("GET", "http://localhost", nil)
+	(&gitlabProvider{token: "gl"}).Authorize(req)
+	assert.Equal(t, "gl", req.Header.Get("PRIVATE-TOKEN"))
+
+	req, _ = http.NewRequest("GET", "http://localhost", nil)
+	(&giteaProvider{token: "gt"}).Authorize(req)
+	assert.Equal(t, "token gt", req.Header.Get("Authorization"))
+
+	// no token, no header
+	req, _ = http.NewRequest("GET", "http://localhost", nil)
+	(&githubProvider{}).Authorize(req)
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+}
+
+func TestProviderParseStars(t *testing.T) {
+	stars, err := (&githubProvider{}).ParseStars(map[string]interface{}{"stargazers_count": float64(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stars)
+
+	stars, err = (&gitlabProvider{}).ParseStars(map[string]interface{}{"star_count": float64(2)})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stars)
+
+	stars, err = (&giteaProvider{}).ParseStars(map[string]interface{}{"stars_count": float64(3)})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stars)
+
+	_, err = (&gitlabProvider{}).ParseStars(map[string]interface{}{"stargazers_count": float64(1)})
+	assert.EqualError(t, err, "Unexpected response, missing star_count")
+}
+
+func TestProviderParseMeta(t *testing.T) {
+	obj := map[string]interface{}{
+		"forks_count":       float64(4),
+		"open_issues_count": float64(5),
+		"language":          "Go",
+		"archived":          true,
+		"pushed_at":         "2021-06-01T10:00:00Z",
+		"last_activity_at":  "2021-06-02T10:00:00Z",
+		"updated_at":        "2021-06-03T10:00:00Z",
+	}
+
+	meta := (&githubProvider{}).ParseMeta(obj)
+	assert.Equal(t, repoMeta{Forks: 4, OpenIssues: 5, Language: "Go", Archived: true, PushedAt: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)}, meta)
+
+	meta = (&gitlabProvider{}).ParseMeta(obj)
+	assert.Equal(t, time.Date(2021, 6, 2, 10, 0, 0, 0, time.UTC), meta.PushedAt)
+
+	meta = (&giteaProvider{}).ParseMeta(obj)
+	assert.Equal(t, time.Date(2021, 6, 3, 10, 0, 0, 0, time.UTC), meta.PushedAt)
+
+	// anything missing is left unknown
+	assert.Equal(t, repoMeta{Forks: -1, OpenIssues: -1}, (&githubProvider{}).ParseMeta(map[string]interface{}{}))
+}
+
+func TestProviderParseReleaseTime(t *testing.T) {
+	published := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, published, (&githubProvider{}).ParseReleaseTime(map[string]interface{}{"published_at": "2021-06-01T10:00:00Z"}))
+	assert.Equal(t, published, (&gitlabProvider{}).ParseReleaseTime(map[string]interface{}{"released_at": "2021-06-01T10:00:00Z"}))
+	assert.Equal(t, published, (&giteaProvider{}).ParseReleaseTime(map[string]interface{}{"published_at": "2021-06-01T10:00:00Z"}))
+
+	// drafts don't have a publish date yet
+	assert.True(t, (&githubProvider{}).ParseReleaseTime(map[string]interface{}{"published_at": nil}).IsZero())
+}
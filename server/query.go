@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ------------------------- SORTING AND PAGING -------------------------
+
+// How a client wants a list of results sliced, read from the query string, ie
+// /stars?sort=stars&order=desc&min_stars=100&limit=50&cursor=...
+type resultQuery struct {
+	// stars, name or forks. Empty keeps request order
+	sort string
+	desc bool
+	// only successful lookups inside these bounds, nil for no bound
+	minStars *int
+	maxStars *int
+	// only failed lookups
+	onlyErrors bool
+	// only repos matching an expression, nil for everything
+	filter *repoFilter
+	// page size, 0 for everything
+	limit int
+	// where this page starts and what it is cut from, from the cursor.
+	// nil snapshot for the first page
+	snapshot *resultSnapshot
+	offset   int
+}
+
+// Summary sent back with a sorted, filtered or paged response
+type ResultsMeta struct {
+	// results that matched the filters, across every page
+	Total    int `json:"total"`
+	Returned int `json:"returned"`
+	// pass back as ?cursor= to get the next page, null on the last page
+	NextCursor *string `json:"next_cursor"`
+}
+
+// every query parameter that slices results
+var resultQueryParams = []string{"sort", "order", "min_stars", "max_stars", "only_errors", "filter", "limit", "cursor"}
+
+// ---- CURSORS ----
+
+// how long a cursor is good for after the page that handed it out
+const cursorTTL = 10 * time.Minute
+
+// most cursors kept at once, the ones closest to expiring go first
+const maxCursors = 1000
+
+// The results of a paged request, filtered and sorted once. Every page
+// after the first is cut from here, so repos aren't looked up or charged
+// again and counts that move between pages can't reorder them
+type resultSnapshot struct {
+	results []repoResult
+}
+
+// what a cursor points at
+type cursorEntry struct {
+	snapshot *resultSnapshot
+	offset   int
+	expires  time.Time
+}
+
+// Cursors are random ids for a spot in a snapshot, kept in memory on
+// the replica that handed them out
+type cursorCache struct {
+	mu      sync.Mutex
+	entries map[string]cursorEntry
+}
+
+func newCursorCache() *cursorCache {
+	return &cursorCache{entries: make(map[string]cursorEntry)}
+}
+
+// hand out a cursor for offset into a snapshot
+func (c *cursorCache) add(snapshot *resultSnapshot, offset int, now time.Time) (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	for len(c.entries) >= maxCursors {
+		oldest := ""
+		for key, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(c.entries, oldest)
+	}
+
+	c.entries[id] = cursorEntry{snapshot: snapshot, offset: offset, expires: now.Add(cursorTTL)}
+	return id, nil
+}
+
+func (c *cursorCache) get(id string, now time.Time) (cursorEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok || !now.Before(entry.expires) {
+		return cursorEntry{}, false
+	}
+	return entry, true
+}
+
+var cursors = newCursorCache()
+
+// helper function to read a whole number query parameter
+func queryInt(values url.Values, param string, min int) (int, error) {
+	val := values.Get(param)
+	num, err := strconv.Atoi(val)
+	if err != nil || num < min {
+		return 0, errors.New("Recieved invalid " + param + ": " + val + ". Hint: a whole number, at least " + strconv.Itoa(min))
+	}
+	return num, nil
+}
+
+// Read how the client wants results sliced. Returns nil if they
+// didn't ask for anything so the response can stay as it was
+func parseResultQuery(values url.Values) (*resultQuery, error) {
+	used := false
+	for _, param := range resultQueryParams {
+		if _, ok := values[param]; ok {
+			used = true
+		}
+	}
+
+	if !used {
+		return nil, nil
+	}
+
+	q := &resultQuery{sort: values.Get("sort")}
+
+	switch q.sort {
+	case "", "stars", "name", "forks":
+	default:
+		return nil, errors.New("Recieved invalid sort: " + q.sort + ". Hint: stars, name or forks")
+	}
+
+	// biggest first is what people want from numbers, a to z from names
+	q.desc = q.sort == "stars" || q.sort == "forks"
+
+	switch order := values.Get("order"); order {
+	case "":
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	default:
+		return nil, errors.New("Recieved invalid order: " + order + ". Hint: asc or desc")
+	}
+
+	if values.Get("min_stars") != "" {
+		min, err := queryInt(values, "min_stars", 0)
+		if err != nil {
+			return nil, err
+		}
+		q.minStars = &min
+	}
+
+	if values.Get("max_stars") != "" {
+		max, err := queryInt(values, "max_stars", 0)
+		if err != nil {
+			return nil, err
+		}
+		q.maxStars = &max
+	}
+
+	if val := values.Get("only_errors"); val != "" {
+		onlyErrors, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.New("Recieved invalid only_errors: " + val + ". Hint: true or false")
+		}
+		q.onlyErrors = onlyErrors
+	}
+
+	if expr := values.Get("filter"); expr != "" {
+		filter, err := parseFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		q.filter = filter
+	}
+
+	if values.Get("limit") != "" {
+		limit, err := queryInt(values, "limit", 1)
+		if err != nil {
+			return nil, err
+		}
+		q.limit = limit
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		entry, ok := cursors.get(cursor, time.Now())
+		if !ok {
+			return nil, errors.New("Recieved invalid cursor: " + cursor + ". Hint: cursors expire " + cursorTTL.String() + " after their page, start again without one")
+		}
+		q.snapshot, q.offset = entry.snapshot, entry.offset
+	}
+
+	return q, nil
+}
+
+// check a result against the filters
+func (q *resultQuery) matches(res repoResult) bool {
+	if q.filter != nil && !q.filter.matches(res) {
+		return false
+	}
+
+	if q.onlyErrors {
+		return res.Err != nil
+	}
+
+	if q.minStars == nil && q.maxStars == nil {
+		return true
+	}
+
+	// star bounds only make sense for lookups that worked
+	if res.Err != nil {
+		return false
+	}
+
+	return (q.minStars == nil || res.Stars >= *q.minStars) &&
+		(q.maxStars == nil || res.Stars <= *q.maxStars)
+}
+
+// check if a should come before b. Counts we don't have always go last
+func (q *resultQuery) less(a repoResult, b repoResult) bool {
+	if q.sort == "name" {
+		if q.desc {
+			return cacheKey(a.Name) > cacheKey(b.Name)
+		}
+		return cacheKey(a.Name) < cacheKey(b.Name)
+	}
+
+	x, y := a.Stars, b.Stars
+	if q.sort == "forks" {
+		x, y = a.Meta.Forks, b.Meta.Forks
+	}
+
+	if a.Err != nil || x < 0 {
+		x = -1
+	}
+	if b.Err != nil || y < 0 {
+		y = -1
+	}
+
+	if x < 0 || y < 0 {
+		return y < 0 && x >= 0
+	}
+
+	if q.desc {
+		return x > y
+	}
+	return x < y
+}
+
+// Filter, sort and page a list of results
+func (q *resultQuery) apply(results []repoResult) ([]repoResult, ResultsMeta, error) {
+	return q.page(q.match(results))
+}
+
+// the results that match, sorted
+func (q *resultQuery) match(results []repoResult) []repoResult {
+	matched := make([]repoResult, 0, len(results))
+	for _, res := range results {
+		if q.matches(res) {
+			matched = append(matched, res)
+		}
+	}
+
+	if q.sort != "" {
+		// stable so ties stay in request order
+		sort.SliceStable(matched, func(i, j int) bool {
+			return q.less(matched[i], matched[j])
+		})
+	}
+
+	return matched
+}
+
+// Cut one page out of filtered results. If there is more to come the
+// results are kept as a snapshot for the next page's cursor
+func (q *resultQuery) page(matched []repoResult) ([]repoResult, ResultsMeta, error) {
+	meta := ResultsMeta{Total: len(matched)}
+
+	start := q.offset
+	if start > len(matched) {
+		start = len(matched)
+	}
+
+	end := len(matched)
+	if q.limit > 0 && start+q.limit < end {
+		end = start + q.limit
+
+		snapshot := q.snapshot
+		if snapshot == nil {
+			snapshot = &resultSnapshot{results: matched}
+		}
+
+		next, err := cursors.add(snapshot, end, time.Now())
+		if err != nil {
+			return nil, ResultsMeta{}, err
+		}
+		meta.NextCursor = &next
+	}
+
+	page := matched[start:end]
+	meta.Returned = len(page)
+
+	return page, meta, nil
+}
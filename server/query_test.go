@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorCache(t *testing.T) {
+	c := newCursorCache()
+	now := time.Now()
+	snapshot := &resultSnapshot{results: []repoResult{{Name: "a/one"}}}
+
+	id, err := c.add(snapshot, 42, now)
+	assert.Nil(t, err)
+	entry, ok := c.get(id, now)
+	assert.True(t, ok)
+	assert.Equal(t, 42, entry.offset)
+	assert.Equal(t, snapshot, entry.snapshot)
+
+	_, ok = c.get("not-a-cursor", now)
+	assert.False(t, ok)
+
+	// cursors expire, and are dropped when the next one is added
+	_, ok = c.get(id, now.Add(cursorTTL))
+	assert.False(t, ok)
+	c.add(snapshot, 1, now.Add(cursorTTL))
+	assert.Len(t, c.entries, 1)
+
+	// the one closest to expiring goes first when there are too many
+	c = newCursorCache()
+	first, _ := c.add(snapshot, 0, now)
+	for i := 1; i <= maxCursors; i++ {
+		c.add(snapshot, i, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	assert.Len(t, c.entries, maxCursors)
+	_, ok = c.get(first, now)
+	assert.False(t, ok)
+}
+
+func TestParseResultQuery(t *testing.T) {
+	// nothing asked for, nothing to do
+	q, err := parseResultQuery(url.Values{"other": {"1"}})
+	assert.Nil(t, err)
+	assert.Nil(t, q)
+
+	snapshot := &resultSnapshot{}
+	cursor, _ := cursors.add(snapshot, 5, time.Now())
+	q, err = parseResultQuery(url.Values{"sort": {"stars"}, "min_stars": {"10"}, "limit": {"5"}, "cursor": {cursor}})
+	assert.Nil(t, err)
+	assert.Equal(t, "stars", q.sort)
+	assert.True(t, q.desc)
+	assert.Equal(t, 10, *q.minStars)
+	assert.Nil(t, q.maxStars)
+	assert.Equal(t, 5, q.limit)
+	assert.Equal(t, 5, q.offset)
+	assert.Equal(t, snapshot, q.snapshot)
+
+	_, err = parseResultQuery(url.Values{"cursor": {"not-a-cursor"}})
+	assert.EqualError(t, err, "Recieved invalid cursor: not-a-cursor. Hint: cursors expire 10m0s after their page, start again without one")
+
+	// names default to a to z
+	q, err = parseResultQuery(url.Values{"sort": {"name"}})
+	assert.Nil(t, err)
+	assert.False(t, q.desc)
+
+	q, err = parseResultQuery(url.Values{"sort": {"forks"}, "order": {"asc"}, "only_errors": {"true"}})
+	assert.Nil(t, err)
+	assert.False(t, q.desc)
+	assert.True(t, q.onlyErrors)
+
+	_, err = parseResultQuery(url.Values{"sort": {"watchers"}})
+	assert.EqualError(t, err, "Recieved invalid sort: watchers. Hint: stars, name or forks")
+
+	_, err = parseResultQuery(url.Values{"order": {"up"}})
+	assert.EqualError(t, err, "Recieved invalid order: up. Hint: asc or desc")
+
+	_, err = parseResultQuery(url.Values{"max_stars": {"-1"}})
+	assert.EqualError(t, err, "Recieved invalid max_stars: -1. Hint: a whole number, at least 0")
+
+	_, err = parseResultQuery(url.Values{"limit": {"0"}})
+	assert.EqualError(t, err, "Recieved invalid limit: 0. Hint: a whole number, at least 1")
+
+	_, err = parseResultQuery(url.Values{"only_errors": {"maybe"}})
+	assert.EqualError(t, err, "Recieved invalid only_errors: maybe. Hint: true or false")
+}
+
+// helper to pull the names out of a list of results
+func resultNames(results []repoResult) []string {
+	names := make([]string, len(results))
+	for i, res := range results {
+		names[i] = res.Name
+	}
+	return names
+}
+
+func TestResultQueryApply(t *testing.T) {
+	results := []repoResult{
+		{Name: "b/two", Stars: 20, Meta: repoMeta{Forks: 1}},
+		{Name: "a/one", Stars: 10, Meta: repoMeta{Forks: 5}},
+		{Name: "c/broken", Stars: -1, Meta: repoMeta{Forks: -1}, Err: errors.New("Repo Not found: c/broken")},
+		{Name: "D/three", Stars: 30, Meta: repoMeta{Forks: -1}},
+	}
+
+	// sorting, failures always last
+	page, meta, _ := (&resultQuery{sort: "stars", desc: true}).apply(results)
+	assert.Equal(t, []string{"D/three", "b/two", "a/one", "c/broken"}, resultNames(page))
+	assert.Equal(t, ResultsMeta{Total: 4, Returned: 4}, meta)
+
+	page, _, _ = (&resultQuery{sort: "stars"}).apply(results)
+	assert.Equal(t, []string{"a/one", "b/two", "D/three", "c/broken"}, resultNames(page))
+
+	page, _, _ = (&resultQuery{sort: "forks", desc: true}).apply(results)
+	assert.Equal(t, []string{"a/one", "b/two", "c/broken", "D/three"}, resultNames(page))
+
+	page, _, _ = (&resultQuery{sort: "name"}).apply(results)
+	assert.Equal(t, []string{"a/one", "b/two", "c/broken", "D/three"}, resultNames(page))
+
+	// filtering
+	min, max := 15, 25
+	page, meta, _ = (&resultQuery{minStars: &min, maxStars: &max}).apply(results)
+	assert.Equal(t, []string{"b/two"}, resultNames(page))
+	assert.Equal(t, 1, meta.Total)
+
+	page, _, _ = (&resultQuery{onlyErrors: true}).apply(results)
+	assert.Equal(t, []string{"c/broken"}, resultNames(page))
+
+	// paging
+	page, meta, _ = (&resultQuery{sort: "name", limit: 3}).apply(results)
+	assert.Equal(t, []string{"a/one", "b/two", "c/broken"}, resultNames(page))
+	assert.Equal(t, 4, meta.Total)
+	assert.Equal(t, 3, meta.Returned)
+	entry, ok := cursors.get(*meta.NextCursor, time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, 3, entry.offset)
+
+	page, meta, _ = (&resultQuery{sort: "name", limit: 3, snapshot: entry.snapshot, offset: entry.offset}).page(entry.snapshot.results)
+	assert.Equal(t, []string{"D/three"}, resultNames(page))
+	assert.Nil(t, meta.NextCursor)
+
+	page, meta, _ = (&resultQuery{offset: 10}).apply(results)
+	assert.Empty(t, page)
+	assert.Equal(t, ResultsMeta{Total: 4, Returned: 0}, meta)
+}
+
+func TestStarsHandlerQuery(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1, "forks_count": 2}`, 200)
+	defer close()
+
+	post := func(query string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/stars"+query, bytes.NewBufferString(body))
+		http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	body := `{"repos": [{"name": "rdelpret/kfx"}, {"name": "rdelpret/cartographer"}]}`
+
+	// first page
+	recorder := post("?sort=name&limit=1", body)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assertMatchesSpec(t, "POST", "/stars", recorder)
+
+	var repos Repos
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &repos))
+	assert.Equal(t, []Repo{{Name: "rdelpret/cartographer", Stars: 1, Error: "<nil>"}}, repos.Repos)
+	assert.Equal(t, 2, repos.Meta.Total)
+	assert.Equal(t, 1, repos.Meta.Returned)
+
+	// second and last page comes from the first page's lookups, the body
+	// isn't looked at again
+	recorder = post("?sort=name&limit=1&cursor="+*repos.Meta.NextCursor, "")
+	assert.Equal(t, `{"repos":[{"name":"rdelpret/kfx","Stars":1,"Error":"\u003cnil\u003e"}],"meta":{"total":2,"returned":1,"next_cursor":null}}`+"\n", recorder.Body.String())
+
+	recorder = post("?limit=1&cursor=expired", body)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// bad query parameters
+	recorder = post("?sort=watchers", body)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Recieved invalid sort: watchers. Hint: stars, name or forks\n", recorder.Body.String())
+
+	// no slicing while streaming
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/stars?limit=1", bytes.NewBufferString(body))
+	req.Header.Set("Accept", "application/x-ndjson")
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
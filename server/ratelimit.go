@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ---------------------------- RATE LIMITS ----------------------------
+
+var rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rate_limited_requests",
+	Help: "The total number of requests turned away with a 429, by route"}, []string{"route"})
+
+// A token bucket that holds requests tokens and refills all of them over
+// per, ie 600/1m. Zero requests means no limit
+type rateLimit struct {
+	requests int
+	per      time.Duration
+}
+
+// tokens added back per second
+func (l rateLimit) rate() float64 {
+	return float64(l.requests) / l.per.Seconds()
+}
+
+const (
+	rateLimitHint  = "<requests>/<duration> or off, ie 600/1m"
+	routeLimitHint = "<route>=<requests>/<duration> or <route>=off, ie /stars=60/1m"
+)
+
+// parse a limit like 600/1m, 10/s or off
+func parseRateLimit(val string) (rateLimit, error) {
+	val = strings.TrimSpace(val)
+	if val == "off" {
+		return rateLimit{}, nil
+	}
+
+	parts := strings.SplitN(val, "/", 2)
+	if len(parts) != 2 {
+		return rateLimit{}, errors.New(rateLimitHint)
+	}
+
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests <= 0 {
+		return rateLimit{}, errors.New(rateLimitHint)
+	}
+
+	// 10/s reads better than 10/1s
+	unit := parts[1]
+	if unit == "s" || unit == "m" || unit == "h" {
+		unit = "1" + unit
+	}
+
+	per, err := time.ParseDuration(unit)
+	if err != nil || per <= 0 {
+		return rateLimit{}, errors.New(rateLimitHint)
+	}
+
+	return rateLimit{requests: requests, per: per}, nil
+}
+
+// A limit for part of the api. Routes match like the mux, a trailing
+// slash matches everything under it
+type routeLimit struct {
+	route string
+	limit rateLimit
+}
+
+func (r routeLimit) matches(path string) bool {
+	if strings.HasSuffix(r.route, "/") {
+		return strings.HasPrefix(path, r.route)
+	}
+	return path == r.route
+}
+
+// parse a route limit like /stars=60/1m
+func parseRouteLimit(val string) (routeLimit, error) {
+	parts := strings.SplitN(strings.TrimSpace(val), "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return routeLimit{}, errors.New(routeLimitHint)
+	}
+
+	limit, err := parseRateLimit(parts[1])
+	if err != nil {
+		return routeLimit{}, errors.New(routeLimitHint)
+	}
+
+	return routeLimit{route: parts[0], limit: limit}, nil
+}
+
+// the limit for a path, the most specific route wins
+func (s rateLimitSettings) limitFor(path string) (string, rateLimit) {
+	route, limit := "*", s.defaultLimit
+	for _, r := range s.routes {
+		if r.matches(path) && (route == "*" || len(r.route) > len(route)) {
+			route, limit = r.route, r.limit
+		}
+	}
+	return route, limit
+}
+
+// ---- BUCKETS ----
+
+// A bucket as it is kept between requests
+type bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// What taking a token from a bucket came to
+type bucketState struct {
+	allowed   bool
+	remaining int
+	// until the bucket is full again
+	reset time.Duration
+	// until the next token, only when not allowed
+	retryAfter time.Duration
+}
+
+// Refill a bucket for the time since it was last used and take a token
+// if there is one. A bucket we haven't seen before starts full
+func takeToken(b *bucket, limit rateLimit, now time.Time) bucketState {
+	capacity := float64(limit.requests)
+
+	if b.Updated.IsZero() {
+		b.Tokens = capacity
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*limit.rate())
+	}
+	b.Updated = now
+
+	state := bucketState{allowed: b.Tokens >= 1}
+	if state.allowed {
+		b.Tokens--
+	} else {
+		state.retryAfter = time.Duration((1 - b.Tokens) / limit.rate() * float64(time.Second))
+	}
+
+	state.remaining = int(b.Tokens)
+	state.reset = time.Duration((capacity - b.Tokens) / limit.rate() * float64(time.Second))
+
+	return state
+}
+
+// Where buckets live. In memory each replica limits on its own, in a
+// store replicas that share it share their limits too
+type bucketStore interface {
+	take(key string, limit rateLimit, now time.Time) bucketState
+}
+
+// how often idle buckets are thrown away
+const bucketSweepInterval = time.Minute
+
+// a bucket that has been full for a while is the same as no bucket
+func idle(b bucket, limit rateLimit, now time.Time) bool {
+	return now.Sub(b.Updated) > limit.per
+}
+
+type memoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	limits  map[string]rateLimit
+	swept   time.Time
+}
+
+func newMemoryBuckets() *memoryBuckets {
+	return &memoryBuckets{buckets: make(map[string]*bucket), limits: make(map[string]rateLimit)}
+}
+
+func (m *memoryBuckets) take(key string, limit rateLimit, now time.Time) bucketState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.swept) > bucketSweepInterval {
+		for k, b := range m.buckets {
+			if idle(*b, m.limits[k], now) {
+				delete(m.buckets, k)
+				delete(m.limits, k)
+			}
+		}
+		m.swept = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{}
+		m.buckets[key] = b
+	}
+	m.limits[key] = limit
+
+	return takeToken(b, limit, now)
+}
+
+const rateLimitPrefix = "ratelimit/"
+
+// lock stripes for store buckets, so one busy client doesn't hold up
+// everyone else's read, refill, write
+const bucketLocks = 64
+
+// Buckets kept in the store. The store has no compare and swap so two
+// replicas taking from the same bucket at the same instant can both get
+// a token, which is close enough for keeping one client from hogging us.
+// When the store fails a bucket is taken from memory instead, so a
+// broken store limits per replica rather than taking the api down
+type storeBuckets struct {
+	locks    [bucketLocks]sync.Mutex
+	fallback *memoryBuckets
+
+	sweepMu sync.Mutex
+	swept   time.Time
+}
+
+func newStoreBuckets() *storeBuckets {
+	return &storeBuckets{fallback: newMemoryBuckets()}
+}
+
+func (s *storeBuckets) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.locks[h.Sum32()%bucketLocks]
+}
+
+func (s *storeBuckets) take(key string, limit rateLimit, now time.Time) bucketState {
+	s.sweepMu.Lock()
+	sweep := now.Sub(s.swept) > bucketSweepInterval
+	if sweep {
+		s.swept = now
+	}
+	s.sweepMu.Unlock()
+
+	if sweep {
+		s.sweep(now)
+	}
+
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var b bucket
+	body, ok, err := store.Get(rateLimitPrefix + key)
+	if err == nil && ok {
+		err = json.Unmarshal(body, &b)
+	}
+	if err != nil {
+		log.Printf("Could not read rate limit bucket, limiting in memory: %v", err)
+		return s.fallback.take(key, limit, now)
+	}
+
+	state := takeToken(&b, limit, now)
+
+	body, err = json.Marshal(b)
+	if err == nil {
+		err = store.Put(rateLimitPrefix+key, body)
+	}
+	if err != nil {
+		log.Printf("Could not write rate limit bucket, limiting in memory: %v", err)
+		return s.fallback.take(key, limit, now)
+	}
+
+	return state
+}
+
+// drop buckets nobody has used for an hour. Limits aren't stored with
+// them, so this is longer than any sensible window
+func (s *storeBuckets) sweep(now time.Time) {
+	entries, err := store.List(rateLimitPrefix)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for key, body := range entries {
+		var b bucket
+		if json.Unmarshal(body, &b) != nil || idle(b, rateLimit{per: time.Hour}, now) {
+			store.Delete(key)
+		}
+	}
+}
+
+// replaced in main once the config is loaded
+var rateLimitConfig = defaultConfig().rateLimits
+
+// replaced in main when ratelimit.shared is set
+var buckets bucketStore = newMemoryBuckets()
+
+// ---- MIDDLEWARE ----
+
+// Who a request is limited as: its API key when auth is on and the key
+// is good, otherwise the address it came from. A made up key can't get
+// a fresh bucket this way
+func rateLimitClient(r *http.Request) string {
+	return rateLimitClientFor(r.Header.Get("Authorization"), r.RemoteAddr)
+}
+
+// rateLimitClient from an authorization header and a remote address,
+// for grpc too
+func rateLimitClientFor(header string, remoteAddr string) string {
+	auth := currentAuth()
+	if auth.enabled && header != "" {
+		if c := authenticate(auth, header, ""); c != nil {
+			if c.key != nil {
+				return "key:" + c.key.ID
+			}
+			return "key:" + c.name
+		}
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// Take a token for a client on a path. Returns false when the path isn't
+// limited, along with the route and limit the token came from
+func takeRateLimit(path string, client string) (string, rateLimit, bucketState, bool) {
+	settings := currentRateLimits()
+	if !settings.enabled {
+		return "", rateLimit{}, bucketState{}, false
+	}
+
+	route, limit := settings.limitFor(path)
+	if limit.requests == 0 {
+		return "", rateLimit{}, bucketState{}, false
+	}
+
+	return route, limit, buckets.take(route+" "+client, limit, time.Now()), true
+}
+
+// whole seconds, rounded up so clients never come back too early
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func tooManyRequestsMessage(state bucketState) string {
+	return "Too Many Requests. Hint: try again in " + ceilSeconds(state.retryAfter) + "s"
+}
+
+// Token bucket rate limiting in front of every route. Each client gets a
+// bucket per limited route, routes without their own limit share the
+// default one. Headers follow the IETF RateLimit header fields draft
+func rateLimiter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, limit, state, limited := takeRateLimit(r.URL.Path, rateLimitClient(r))
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(state.reset))
+		w.Header().Set("RateLimit-Policy", strconv.Itoa(limit.requests)+";w="+ceilSeconds(limit.per))
+
+		if !state.allowed {
+			rateLimitedRequests.WithLabelValues(route).Inc()
+			w.Header().Set("Retry-After", ceilSeconds(state.retryAfter))
+			http.Error(w, tooManyRequestsMessage(state), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
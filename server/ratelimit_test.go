@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"rdelpret/rainbow-road/server/starspb"
+)
+
+// helper to set rate limits for a test, returns a func to put them back
+func setRateLimits(settings rateLimitSettings) func() {
+	settingsMu.Lock()
+	old := rateLimitConfig
+	rateLimitConfig = settings
+	settingsMu.Unlock()
+
+	oldBuckets := buckets
+	buckets = newMemoryBuckets()
+
+	return func() {
+		settingsMu.Lock()
+		rateLimitConfig = old
+		settingsMu.Unlock()
+		buckets = oldBuckets
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("600/1m")
+	assert.Nil(t, err)
+	assert.Equal(t, rateLimit{requests: 600, per: time.Minute}, limit)
+	assert.Equal(t, 10.0, limit.rate())
+
+	limit, err = parseRateLimit("10/s")
+	assert.Nil(t, err)
+	assert.Equal(t, rateLimit{requests: 10, per: time.Second}, limit)
+
+	limit, err = parseRateLimit("off")
+	assert.Nil(t, err)
+	assert.Equal(t, rateLimit{}, limit)
+
+	for _, val := range []string{"", "10", "0/1m", "-1/1m", "ten/1m", "10/forever", "10/0s"} {
+		_, err = parseRateLimit(val)
+		assert.EqualError(t, err, rateLimitHint, val)
+	}
+
+	route, err := parseRouteLimit(" /repos/=5/1s ")
+	assert.Nil(t, err)
+	assert.Equal(t, routeLimit{route: "/repos/", limit: rateLimit{requests: 5, per: time.Second}}, route)
+
+	for _, val := range []string{"/stars", "stars=1/s", "/stars=fast"} {
+		_, err = parseRouteLimit(val)
+		assert.EqualError(t, err, routeLimitHint, val)
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	loaded, err := loadConfig([]string{"--ratelimit.routes=/repos/=5/1s,/repos/kubernetes/=1/1s,/stars=2/1s"}, testEnv(nil))
+	assert.Nil(t, err)
+	settings := loaded.cfg.rateLimits
+
+	for path, want := range map[string]string{
+		"/stars":                         "/stars",
+		"/stars/extra":                   "*",
+		"/repos/istio/istio":             "/repos/",
+		"/repos/kubernetes/kubernetes":   "/repos/kubernetes/",
+		"/compare":                       "*",
+		"/repos/kubernetes-sigs/kind":    "/repos/",
+		"/repos/kubernetes/":             "/repos/kubernetes/",
+		"/repos/kubernetes/test-infra/x": "/repos/kubernetes/",
+	} {
+		route, _ := settings.limitFor(path)
+		assert.Equal(t, want, route, path)
+	}
+
+	// health checks and metrics are off by default
+	_, limit := defaultConfig().rateLimits.limitFor("/livez")
+	assert.Equal(t, 0, limit.requests)
+	_, limit = defaultConfig().rateLimits.limitFor("/stars")
+	assert.Equal(t, rateLimit{requests: 600, per: time.Minute}, limit)
+
+	_, err = loadConfig([]string{"--ratelimit.default=fast"}, testEnv(nil))
+	assert.EqualError(t, err, "Recieved invalid --ratelimit.default: fast. Hint: "+rateLimitHint)
+}
+
+func TestTakeToken(t *testing.T) {
+	limit := rateLimit{requests: 2, per: 2 * time.Second}
+	now := time.Now()
+	var b bucket
+
+	state := takeToken(&b, limit, now)
+	assert.Equal(t, bucketState{allowed: true, remaining: 1, reset: time.Second}, state)
+
+	state = takeToken(&b, limit, now)
+	assert.Equal(t, bucketState{allowed: true, remaining: 0, reset: 2 * time.Second}, state)
+
+	state = takeToken(&b, limit, now.Add(500*time.Millisecond))
+	assert.False(t, state.allowed)
+	assert.Equal(t, 500*time.Millisecond, state.retryAfter)
+
+	// a token a second comes back, but never more than the bucket holds
+	state = takeToken(&b, limit, now.Add(time.Second))
+	assert.True(t, state.allowed)
+	state = takeToken(&b, limit, now.Add(time.Hour))
+	assert.Equal(t, 1, state.remaining)
+}
+
+func TestMemoryBuckets(t *testing.T) {
+	limit := rateLimit{requests: 1, per: time.Minute}
+	now := time.Now()
+
+	b := newMemoryBuckets()
+	assert.True(t, b.take("* ip:10.0.0.1", limit, now).allowed)
+	assert.False(t, b.take("* ip:10.0.0.1", limit, now).allowed)
+	assert.True(t, b.take("* ip:10.0.0.2", limit, now).allowed)
+
+	// idle buckets are swept
+	b.take("* ip:10.0.0.3", limit, now.Add(2*time.Minute))
+	assert.Len(t, b.buckets, 1)
+}
+
+func TestStoreBuckets(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	limit := rateLimit{requests: 1, per: time.Minute}
+	now := time.Now()
+
+	// two replicas on the same store share a bucket
+	a, b := newStoreBuckets(), newStoreBuckets()
+	assert.True(t, a.take("* ip:10.0.0.1", limit, now).allowed)
+	assert.False(t, b.take("* ip:10.0.0.1", limit, now).allowed)
+	assert.True(t, b.take("* ip:10.0.0.2", limit, now).allowed)
+
+	// idle buckets are swept
+	a.sweep(now.Add(2 * time.Hour))
+	entries, _ := store.List(rateLimitPrefix)
+	assert.Empty(t, entries)
+
+	// a broken store falls back to limiting in memory
+	store = &brokenStore{newMemoryStore()}
+	assert.True(t, a.take("* ip:10.0.0.3", limit, now).allowed)
+	assert.False(t, a.take("* ip:10.0.0.3", limit, now).allowed)
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	handler := rateLimiter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(path string, remoteAddr string, key string) *httptest.ResponseRecorder {
+		req := authedRequest("GET", path, "", key)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// off by default
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, request("/stars", "10.0.0.1:1234", "").Code)
+	}
+
+	defer setRateLimits(rateLimitSettings{
+		enabled:      true,
+		defaultLimit: rateLimit{requests: 2, per: time.Minute},
+		routes:       []routeLimit{{route: "/livez", limit: rateLimit{}}, {route: "/compare", limit: rateLimit{requests: 1, per: time.Minute}}},
+	})()
+
+	rr := request("/stars", "10.0.0.1:1234", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rr.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", rr.Header().Get("RateLimit-Policy"))
+
+	// the default bucket is shared by every route without its own limit,
+	// ports don't matter
+	assert.Equal(t, http.StatusOK, request("/repos/a/b", "10.0.0.1:5678", "").Code)
+	rr = request("/stars", "10.0.0.1:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "Too Many Requests. Hint: try again in 30s\n", rr.Body.String())
+
+	// routes with their own limit have their own bucket
+	assert.Equal(t, http.StatusOK, request("/compare", "10.0.0.1:1234", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("/compare", "10.0.0.1:1234", "").Code)
+
+	// other clients and unlimited routes are unaffected
+	assert.Equal(t, http.StatusOK, request("/stars", "10.0.0.2:1234", "").Code)
+	rr = request("/livez", "10.0.0.1:1234", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("RateLimit-Limit"))
+
+	// with auth on a good key gets its own bucket wherever it comes from,
+	// a made up one is limited by address
+	defer enableAuth(authSettings{})()
+	key, _ := mintAPIKey("ci", []string{scopeRead}, 10)
+
+	assert.Equal(t, http.StatusOK, request("/stars", "10.0.0.1:1234", key.Key).Code)
+	assert.Equal(t, http.StatusOK, request("/stars", "10.0.0.3:1234", key.Key).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("/stars", "10.0.0.4:1234", key.Key).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("/stars", "10.0.0.1:1234", "rr_made_up").Code)
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	defer setRateLimits(rateLimitSettings{
+		enabled:      true,
+		defaultLimit: rateLimit{requests: 1, per: time.Minute},
+	})()
+
+	conn, closeConn := dialGRPC(t)
+	defer closeConn()
+
+	client := starspb.NewStarsClient(conn)
+	req := &starspb.GetStarsRequest{Repos: []string{"rdelpret/cartographer"}}
+
+	var header metadata.MD
+	_, err := client.GetStars(context.Background(), req, grpc.Header(&header))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1"}, header.Get("ratelimit-limit"))
+	assert.Equal(t, []string{"0"}, header.Get("ratelimit-remaining"))
+
+	var trailer metadata.MD
+	_, err = client.GetStars(context.Background(), req, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, "Too Many Requests. Hint: try again in 60s", status.Convert(err).Message())
+	assert.Equal(t, []string{"60"}, trailer.Get("retry-after"))
+
+	// streams take from the same limits
+	stream, err := client.StreamStars(context.Background(), req)
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// health checks aren't limited
+	health := healthpb.NewHealthClient(conn)
+	for i := 0; i < 3; i++ {
+		_, err = health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ------------------------------ RELOAD ------------------------------
+
+// Guards every setting that can change while we run. A reload swaps
+// them all under the write lock, readers take a copy under the read
+// lock so a request never sees half of one config and half of another
+var settingsMu sync.RWMutex
+
+var configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "config_reloads",
+	Help: "The total number of config reloads, by whether they were applied"}, []string{"result"})
+
+func currentProviders() map[string]Provider {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return providers
+}
+
+func currentLimits() requestLimits {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return limits
+}
+
+func currentCacheMaxAge() time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return repoCacheMaxAge
+}
+
+func currentHistorySize() int {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return historySize
+}
+
+func currentHistoryInterval() time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return historyInterval
+}
+
+func currentGithubWebhookSecret() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return githubWebhookSecret
+}
+
+func currentShutdownConfig() shutdownConfig {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return shutdownSettings
+}
+
+func currentAuth() authSettings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return authConfig
+}
+
+func currentRateLimits() rateLimitSettings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return rateLimitConfig
+}
+
+// client and slots for upstream calls, taken together so a request
+// always gives its slot back to the channel it took it from
+func currentUpstream() (*http.Client, chan struct{}) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return upstreamClient, upstreamSlots
+}
+
+// Point everything at a config. Used at startup and by every reload,
+// settings that need a restart are applied by main instead
+func applyConfig(cfg serverConfig) {
+	settingsMu.Lock()
+	providers = newProviders(cfg.upstream)
+	upstreamClient = &http.Client{Timeout: cfg.upstream.timeout}
+	// requests already waiting hold the old channel, a new one would let
+	// both sets through at once
+	if cap(upstreamSlots) != cfg.upstream.concurrency {
+		upstreamSlots = make(chan struct{}, cfg.upstream.concurrency)
+	}
+	repoCacheMaxAge = cfg.cacheMaxAge
+	historySize = cfg.historySize
+	historyInterval = cfg.historyInterval
+	limits = cfg.limits
+	githubWebhookSecret = cfg.webhooks.githubSecret
+	shutdownSettings = cfg.shutdown
+	authConfig = cfg.auth
+	rateLimitConfig = cfg.rateLimits
+	settingsMu.Unlock()
+
+	// these have their own locks
+	jobs.configure(cfg.jobs.retention, cfg.jobs.concurrency)
+	webhooks.configure(cfg.webhooks.url, cfg.webhooks.secret, cfg.webhooks.format)
+	watched.alerts.configure(cfg.watchlist.alertURL, cfg.watchlist.alertSecret)
+
+	// a new token may fix (or break) github, don't wait out the cache
+	upstream.reset()
+}
+
+// Reloads the config when asked to or when one of its files changes
+type configReloader struct {
+	args      []string
+	lookupEnv func(key string) (string, bool)
+
+	mu          sync.Mutex
+	current     *loadedConfig
+	fingerprint string
+}
+
+func newConfigReloader(args []string, lookupEnv func(key string) (string, bool), current *loadedConfig) *configReloader {
+	r := &configReloader{args: args, lookupEnv: lookupEnv, current: current}
+	r.fingerprint = fingerprintFiles(current.files())
+	return r
+}
+
+// hash of every watched file so we can tell when one changes. Kubernetes
+// swaps secret files with a symlink so looking at the contents is the
+// only reliable way to notice
+func fingerprintFiles(files []string) string {
+	h := sha256.New()
+	for _, file := range files {
+		h.Write([]byte(file))
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			h.Write([]byte("missing"))
+			continue
+		}
+		sum := sha256.Sum256(body)
+		h.Write(sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Describe what changed between two configs. Secrets only say that
+// they changed, settings that need a restart say so
+func configChanges(old, new *loadedConfig) []string {
+	var changes []string
+	for _, s := range settings {
+		before, after := old.values[s.key].val, new.values[s.key].val
+
+		// secrets read from a file change without the setting changing
+		if s.secret {
+			before, after = secretValue(old.cfg, s.key), secretValue(new.cfg, s.key)
+		}
+
+		if before == after {
+			continue
+		}
+
+		change := s.key + " changed"
+		if !s.secret {
+			change = s.key + " " + quoteSetting(before) + " -> " + quoteSetting(after)
+		}
+		if s.restart {
+			change += " (restart to apply)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// the value of a secret setting in a config
+func secretValue(cfg serverConfig, key string) string {
+	switch key {
+	case "upstream.github_token":
+		return cfg.upstream.githubToken
+	case "upstream.gitlab_token":
+		return cfg.upstream.gitlabToken
+	case "upstream.gitea_token":
+		return cfg.upstream.giteaToken
+	case "webhooks.secret":
+		return cfg.webhooks.secret
+	case "webhooks.github_secret":
+		return cfg.webhooks.githubSecret
+	case "watchlist.alert_secret":
+		return cfg.watchlist.alertSecret
+	case "auth.admin_key":
+		return cfg.auth.adminKey
+	}
+	return ""
+}
+
+func quoteSetting(val string) string {
+	if val == "" {
+		return `""`
+	}
+	return val
+}
+
+// Load the config again and apply it. Settings that need a restart keep
+// their old value. A bad config is logged and the old one stays in place
+func (r *configReloader) reload(trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loaded, err := loadConfig(r.args, r.lookupEnv)
+	if err != nil {
+		// don't try again until something changes
+		r.fingerprint = fingerprintFiles(r.current.files())
+		configReloads.WithLabelValues("failure").Inc()
+		log.Printf("Config reload (%s) failed, keeping the current config:\n%v", trigger, err)
+		return err
+	}
+
+	changes := configChanges(r.current, loaded)
+
+	for _, s := range settings {
+		if s.restart {
+			loaded.values[s.key] = r.current.values[s.key]
+			s.set(&loaded.cfg, r.current.values[s.key].val)
+		}
+	}
+
+	applyConfig(loaded.cfg)
+	r.current = loaded
+	r.fingerprint = fingerprintFiles(loaded.files())
+
+	configReloads.WithLabelValues("success").Inc()
+	if len(changes) == 0 {
+		log.Printf("Config reloaded (%s), nothing changed", trigger)
+	} else {
+		log.Printf("Config reloaded (%s): %s", trigger, strings.Join(changes, ", "))
+	}
+
+	return nil
+}
+
+// reload if any watched file changed since the last load
+func (r *configReloader) check() {
+	r.mu.Lock()
+	changed := fingerprintFiles(r.current.files()) != r.fingerprint
+	r.mu.Unlock()
+
+	if changed {
+		r.reload("file changed")
+	}
+}
+
+// check the watched files every interval
+func (r *configReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			r.check()
+		}
+	}()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to capture log lines while a test runs
+func captureLogs() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	return &buf, func() { log.SetOutput(ioutil.Discard) }
+}
+
+func TestConfigChanges(t *testing.T) {
+	old, err := loadConfig(nil, testEnv(map[string]string{"GITHUB_TOKEN": "old"}))
+	assert.Nil(t, err)
+	new, err := loadConfig([]string{"--cache.max-age=2m", "--listen=:8000"}, testEnv(map[string]string{"GITHUB_TOKEN": "new"}))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"listen :9999 -> :8000 (restart to apply)",
+		"upstream.github_token changed",
+		"cache.max_age 60s -> 2m",
+	}, configChanges(old, new))
+
+	assert.Empty(t, configChanges(old, old))
+}
+
+func TestConfigReload(t *testing.T) {
+	defer applyConfig(defaultConfig())
+
+	tokenPath, cleanup := writeConfigFile(t, "token", "first")
+	defer cleanup()
+	configPath := filepath.Join(filepath.Dir(tokenPath), "server.yaml")
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte("cache:\n  max_age: 60s\n"), 0600))
+
+	args := []string{"--config", configPath, "--upstream.github-token-file", tokenPath}
+	loaded, err := loadConfig(args, testEnv(nil))
+	assert.Nil(t, err)
+	applyConfig(loaded.cfg)
+	assert.Equal(t, "first", currentProviders()["github"].(*githubProvider).token)
+
+	r := newConfigReloader(args, testEnv(nil), loaded)
+	logs, restore := captureLogs()
+	defer restore()
+
+	// nothing changed, nothing to do
+	before := testutil.ToFloat64(configReloads.WithLabelValues("success"))
+	r.check()
+	assert.Equal(t, before, testutil.ToFloat64(configReloads.WithLabelValues("success")))
+
+	// a rotated secret and an edited config file are both picked up
+	assert.Nil(t, ioutil.WriteFile(tokenPath, []byte("second\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte("listen: \":8000\"\ncache:\n  max_age: 2m\n"), 0600))
+	r.check()
+
+	assert.Equal(t, before+1, testutil.ToFloat64(configReloads.WithLabelValues("success")))
+	assert.Equal(t, "second", currentProviders()["github"].(*githubProvider).token)
+	assert.Equal(t, 2*time.Minute, currentCacheMaxAge())
+	assert.Contains(t, logs.String(), "Config reloaded (file changed): listen :9999 -> :8000 (restart to apply), upstream.github_token changed, cache.max_age 60s -> 2m")
+	assert.NotContains(t, logs.String(), "second")
+
+	// settings that need a restart keep their old value
+	assert.Equal(t, ":9999", r.current.cfg.listen)
+	assert.Equal(t, ":9999", r.current.values["listen"].val)
+
+	// a bad config is reported once and the last good one stays
+	failures := testutil.ToFloat64(configReloads.WithLabelValues("failure"))
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte("cache:\n  max_age: soon\n"), 0600))
+	r.check()
+	r.check()
+	assert.Equal(t, failures+1, testutil.ToFloat64(configReloads.WithLabelValues("failure")))
+	assert.Equal(t, 2*time.Minute, currentCacheMaxAge())
+	assert.Contains(t, logs.String(), "Recieved invalid cache.max_age in "+configPath+": soon")
+
+	// SIGHUP reloads even when nothing changed
+	assert.NotNil(t, r.reload("SIGHUP"))
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte("cache:\n  max_age: 2m\n"), 0600))
+	assert.Nil(t, r.reload("SIGHUP"))
+	assert.Contains(t, logs.String(), "Config reloaded (SIGHUP), nothing changed")
+}
+
+func TestConfigReloadUnderLoad(t *testing.T) {
+	defer applyConfig(defaultConfig())
+
+	closeMock := mockGithubAPI(`{"stargazers_count" : 5}`, 200)
+	defer closeMock()
+
+	// lookups keep working while the config is swapped under them
+	stop := make(chan struct{})
+	failures := make(chan error, 100)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := GetStars(Repo{Name: "rdelpret/cartographer"})
+				if err != nil {
+					failures <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		cfg := defaultConfig()
+		cfg.upstream.concurrency = i%3 + 1
+		cfg.upstream.githubToken = "token"
+		applyConfig(cfg)
+	}
+
+	close(stop)
+	wg.Wait()
+	assert.Empty(t, failures)
+}
+
+func TestApplyConfigKeepsUpstreamSlots(t *testing.T) {
+	defer applyConfig(defaultConfig())
+
+	cfg := defaultConfig()
+	applyConfig(cfg)
+	_, slots := currentUpstream()
+
+	// requests waiting on the old channel would get a second set of slots
+	cfg.cacheMaxAge = 2 * time.Minute
+	applyConfig(cfg)
+	_, same := currentUpstream()
+	assert.True(t, slots == same)
+
+	cfg.upstream.concurrency = 10
+	applyConfig(cfg)
+	_, resized := currentUpstream()
+	assert.Equal(t, 10, cap(resized))
+}
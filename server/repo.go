@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ------------------------- SINGLE REPO ROUTE -------------------------
+
+// how long a fetched count is served from the cache and how long
+// clients and proxies are told to keep it
+var repoCacheMaxAge = 60 * time.Second
+
+// Look up a single repo, reusing the cached count if it is fresh enough.
+// Returns the repo like a /stars entry, when the count was fetched and
+// how the lookup went, ie not_found or upstream_error
+func lookupRepo(name string) (Repo, time.Time, string) {
+	if obs, ok := cache.get(name); ok && isFresh(obs) {
+		return Repo{Name: name, Stars: obs.Stars, Error: fmt.Sprint(nil)}, obs.FetchedAt, StatusOK
+	}
+
+	res := fetchRepo(name)
+
+	obs, _ := cache.get(name)
+	return newRepoV1(res), obs.FetchedAt, lookupStatus(res.Err)
+}
+
+// lookupRepo for the routes anyone can reach. With auth on nobody could
+// be charged for their lookups, so they only serve what is already
+// cached, however old, and a repo we haven't seen is unavailable
+func lookupOpenRepo(name string) (Repo, time.Time) {
+	if !currentAuth().enabled {
+		repo, fetchedAt, _ := lookupRepo(name)
+		return repo, fetchedAt
+	}
+
+	if obs, ok := cache.get(name); ok {
+		return Repo{Name: name, Stars: obs.Stars, Error: fmt.Sprint(nil)}, obs.FetchedAt
+	}
+
+	return Repo{Name: name, Stars: -1, Error: "Repo not cached: " + name}, time.Time{}
+}
+
+// whether a cached count can still be served without a lookup
+func isFresh(obs starObservation) bool {
+	return time.Since(obs.FetchedAt) < currentCacheMaxAge()
+}
+
+// strong etag over the exact response body
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// check an If-None-Match header against our etag. Uses the weak
+// comparison from RFC 7232 so W/ prefixed tags still match
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP route to get stars for a single repo, ie GET /repos/kubernetes/kubernetes
+func repoHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /repos/ routes
+	if !strings.HasPrefix(r.URL.Path, "/repos/") {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/repos/")
+
+	// a name that can't be a repo is never looked up or charged for
+	if err := validateRepoName(name); err != nil {
+		writeRepoError(w, Repo{Name: name, Stars: -1, Error: err.Error()}, http.StatusNotFound)
+		return
+	}
+
+	// only a lookup counts against the caller's quota, not the cache
+	if obs, ok := cache.get(name); !ok || !isFresh(obs) {
+		if !chargeRequest(w, r, 1) {
+			return
+		}
+	}
+
+	repo, fetchedAt, status := lookupRepo(name)
+
+	switch status {
+	case StatusOK:
+	case StatusNotFound, StatusInvalid:
+		writeRepoError(w, repo, http.StatusNotFound)
+		return
+	default:
+		// the provider failed us, the repo may well be there
+		writeRepoError(w, repo, http.StatusBadGateway)
+		return
+	}
+
+	body, err := json.Marshal(repo)
+
+	if err != nil {
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeCacheable(w, r, append(body, '\n'), fetchedAt)
+}
+
+// answer with a failed lookup. Nobody gets to hold on to errors
+func writeRepoError(w http.ResponseWriter, repo Repo, code int) {
+	body, err := json.Marshal(repo)
+
+	if err != nil {
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
+
+// Write a response built from a count fetched at fetchedAt, with
+// caching headers and a 304 if the client already has it
+func writeCacheable(w http.ResponseWriter, r *http.Request, body []byte, fetchedAt time.Time) {
+
+	// whatever is left of the cache window is how long the client can keep it
+	maxAge := currentCacheMaxAge() - time.Since(fetchedAt)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	etag := etagFor(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("Last-Modified", fetchedAt.UTC().Format(http.TimeFormat))
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
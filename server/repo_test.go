@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`W/"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`"xyz", "abc"`, `"abc"`))
+	assert.True(t, etagMatches(`*`, `"abc"`))
+	assert.False(t, etagMatches(`"xyz"`, `"abc"`))
+	assert.False(t, etagMatches(``, `"abc"`))
+}
+
+func TestLookupRepo(t *testing.T) {
+
+	resetCache()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	repo, fetchedAt, status := lookupRepo("rdelpret/cartographer")
+	assert.Equal(t, Repo{Name: "rdelpret/cartographer", Stars: 1, Error: "<nil>"}, repo)
+	assert.False(t, fetchedAt.IsZero())
+	assert.Equal(t, StatusOK, status)
+
+	// fresh counts come from the cache, so the new mock value is not seen
+	mockGithubAPI(`{"stargazers_count" : 2}`, 200)
+	repo, cachedAt, _ := lookupRepo("rdelpret/cartographer")
+	assert.Equal(t, 1, repo.Stars)
+	assert.Equal(t, fetchedAt, cachedAt)
+
+	// stale counts are fetched again
+	repoCacheMaxAge = 0
+	defer func() { repoCacheMaxAge = 60 * time.Second }()
+	repo, _, _ = lookupRepo("rdelpret/cartographer")
+	assert.Equal(t, 2, repo.Stars)
+}
+
+func TestRepoHandler(t *testing.T) {
+
+	resetCache()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	// test happy path
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/repos/rdelpret/cartographer", nil)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "{\"name\":\"rdelpret/cartographer\",\"Stars\":1,\"Error\":\"\\u003cnil\\u003e\"}\n", recorder.Body.String())
+	assert.Regexp(t, `^max-age=\d+$`, recorder.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, recorder.Header().Get("Last-Modified"))
+
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// matching etag gets a 304 with no body
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/repos/rdelpret/cartographer", nil)
+	req.Header.Set("If-None-Match", etag)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, "", recorder.Body.String())
+	assert.Equal(t, etag, recorder.Header().Get("ETag"))
+
+	// errors are not cached
+	mockGithubAPI(`{}`, 404)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/repos/rdelpret/missing", nil)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, "", recorder.Header().Get("ETag"))
+
+	// an upstream outage isn't a missing repo
+	mockGithubAPI(`{}`, 503)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/repos/rdelpret/kfx", nil)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+
+	// malformed names are turned away before anything is looked up
+	for _, name := range []string{"invalid", "a/b/c", "../../user/x"} {
+		recorder = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/repos/"+name, nil)
+		http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, `{"name":"`+name+`","Stars":-1,"Error":"Recieved invalid repo name: `+name+`"}`+"\n", recorder.Body.String())
+	}
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/repos/rdelpret/cartographer", nil)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/wrongroute", nil)
+	http.HandlerFunc(repoHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
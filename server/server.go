@@ -3,25 +3,35 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // ----------------------- GITHUB REQUEST CODE -----------------------
 
-// Struct that represents a /stars request
+// Struct that represents a /stars request and response. Meta is only
+// sent back when the client sorts, filters or pages the results, and
+// Aggregates when it asks for them
 type Repos struct {
-	Repos []Repo `json:"repos"`
+	Repos      []Repo       `json:"repos"`
+	Meta       *ResultsMeta `json:"meta,omitempty"`
+	Aggregates *Aggregates  `json:"aggregates,omitempty"`
 }
 
 // Struct that represents a repo, used in both request and response
@@ -31,38 +41,109 @@ type Repo struct {
 	Error string
 }
 
-// helper function to pull a git token if it exists. Print warning if it doesnt
-func getAuth() (string, error) {
-	val, ok := os.LookupEnv("GITHUB_TOKEN")
-	if !ok {
-		return val, errors.New("WARNING: GITHUB_TOKEN environment variable not set. API requests to github will be rate limited")
+// Every way a repo lookup can end, reported per repo by the v2 api
+const (
+	StatusOK            = "ok"
+	StatusInvalid       = "invalid"
+	StatusNotFound      = "not_found"
+	StatusUpstreamError = "upstream_error"
+)
+
+// error from a repo lookup, tagged with the status it maps to
+type lookupError struct {
+	status string
+	err    error
+}
+
+func (e *lookupError) Error() string {
+	return e.err.Error()
+}
+
+// helper function to get the status of a finished lookup
+func lookupStatus(err error) string {
+	if err == nil {
+		return StatusOK
 	}
-	return val, nil
+
+	var lerr *lookupError
+	if errors.As(err, &lerr) {
+		return lerr.status
+	}
+
+	return StatusUpstreamError
 }
 
 // helper function to validate repo name and return api url to make request
 func assembleURL(repoName string) (string, error) {
-	base := "https://api.github.com/"
-	api := "repos/"
+	provider, path, err := resolveProvider(repoName)
 
-	match, _ := regexp.MatchString("(.*)/(.*)", repoName)
-
-	if !match {
-		return base + api, errors.New("Recieved invalid repo name: " + repoName)
+	if err != nil {
+		return "", err
 	}
 
-	return base + api + repoName, nil
+	return provider.RepoURL(path)
 }
 
-// Function to call github api and get star count
+// Function to call the repo's provider api and get star count
 // return error and -1 for bad requests
 func GetStars(repo Repo) (int, error) {
+	stars, _, err := lookupStars(repo)
+	return stars, err
+}
+
+// client every upstream api call goes through
+var upstreamClient = &http.Client{Timeout: 10 * time.Second}
+
+// caps how many upstream requests are in flight at once, so a big
+// request can't open thousands of connections to github
+var upstreamSlots = make(chan struct{}, 100)
+
+// response body that gives its upstream slot back once it is closed
+type upstreamBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Send a request upstream, waiting for a free slot first. The slot is
+// held until the response body is closed
+func doUpstream(req *http.Request) (*http.Response, error) {
+	client, slots := currentUpstream()
+	slots <- struct{}{}
+	release := func() { <-slots }
+
+	resp, err := client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	resp.Body = &upstreamBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
 
-	githubApiReqAll.Inc()
-	client := &http.Client{}
+// Call the repo's provider api and get the star count along with
+// whatever else the provider told us about the repo
+func lookupStars(repo Repo) (int, repoMeta, error) {
 
-	// validate repo name and generate github api url
-	url, err := assembleURL(repo.Name)
+	// figure out which git host this repo lives on
+	provider, path, err := resolveProvider(repo.Name)
+
+	if err != nil {
+		log.Println(err)
+		return -1, repoMeta{}, &lookupError{StatusInvalid, err}
+	}
+
+	countUpstreamRequest(provider.Name())
+
+	// validate repo name and generate provider api url
+	url, err := provider.RepoURL(path)
 
 	// this is for testing so we can setup a mock http server
 	if serverURLOverride != "" {
@@ -71,7 +152,7 @@ func GetStars(repo Repo) (int, error) {
 
 	if err != nil {
 		log.Println(err)
-		return -1, err
+		return -1, repoMeta{}, &lookupError{StatusInvalid, err}
 	}
 
 	// setup request
@@ -79,19 +160,17 @@ func GetStars(repo Repo) (int, error) {
 
 	if err != nil {
 		log.Println(err)
-		return -1, err
+		return -1, repoMeta{}, &lookupError{StatusUpstreamError, err}
 	}
 
-	// use github token if we have it
-	if gitToken != "" {
-		req.Header.Set("Authorization", "token "+gitToken)
-	}
+	// use the provider token if we have it
+	provider.Authorize(req)
 
-	resp, err := client.Do(req)
+	resp, err := doUpstream(req)
 
 	if err != nil {
 		log.Println(err)
-		return -1, err
+		return -1, repoMeta{}, &lookupError{StatusUpstreamError, err}
 	}
 
 	// close body stream when we are done with it
@@ -105,40 +184,101 @@ func GetStars(repo Repo) (int, error) {
 			log.Println(err)
 		}
 
-		// load into interface, pull out stargazers and convert to int
+		// load into interface and let the provider pull out the stars
 		var obj map[string]interface{}
 		json.Unmarshal([]byte(body), &obj)
-		stars := int(obj["stargazers_count"].(float64))
-		githubApiReq200.Inc()
-		return stars, nil
+		stars, err := provider.ParseStars(obj)
+
+		if err != nil {
+			log.Println(err)
+			return -1, repoMeta{}, &lookupError{StatusUpstreamError, err}
+		}
+
+		countUpstreamRequest200(provider.Name())
+		return stars, provider.ParseMeta(obj), nil
 	}
 
-	return -1, errors.New("Repo Not found: " + repo.Name)
+	// anything but a 404 means the provider is having trouble, not that
+	// the repo is missing. The message stays the same for the v1 api
+	status := StatusNotFound
+	if resp.StatusCode != http.StatusNotFound {
+		status = StatusUpstreamError
+	}
+
+	return -1, repoMeta{}, &lookupError{status, errors.New("Repo Not found: " + repo.Name)}
 }
 
-// Handle Bulk requests for stars concurrently
-func GetStarsForRepos(repos Repos) Repos {
+// Result of looking up one repo, before it gets shaped for an api version
+type repoResult struct {
+	Name  string
+	Stars int
+	Meta  repoMeta
+	Err   error
+}
 
-	wg := sync.WaitGroup{}
-	for i, repo := range repos.Repos {
-		r := &repos.Repos[i]
-		wg.Add(1)
-		go func(repo Repo) {
-			var err error
-			r.Stars, err = GetStars(repo)
+// Look up stars for a list of repos concurrently.
+// Results come back in the same order as the names
+func fetchRepos(names []string) []repoResult {
+
+	results := make([]repoResult, len(names))
 
-			// Convert the error to a string so we can
-			// json encode and pass to the client
-			// not every request will have an error so
-			// we don't want to block good data
-			r.Error = fmt.Sprint(err)
+	fetchReposEach(names, func(index int, res repoResult) {
+		results[index] = res
+	})
 
+	return results
+}
+
+// Look up stars for a list of repos concurrently, calling done with each
+// result as soon as its lookup finishes. done is called from many
+// goroutines at once. Returns once every lookup has finished
+func fetchReposEach(names []string, done func(index int, res repoResult)) {
+
+	wg := sync.WaitGroup{}
+	for i, name := range names {
+		wg.Add(1)
+		go func(index int, name string) {
+			done(index, fetchRepo(name))
 			wg.Done()
-		}(repo)
+		}(i, name)
 	}
 	wg.Wait()
+}
+
+// Look up stars for one repo and remember the count if it worked
+func fetchRepo(name string) repoResult {
+	stars, meta, err := lookupStars(Repo{Name: name})
+
+	if err == nil {
+		observeStars(name, stars)
+	}
+
+	return repoResult{Name: name, Stars: stars, Meta: meta, Err: err}
+}
+
+// shape a lookup result for the v1 api
+func newRepoV1(res repoResult) Repo {
+
+	// Convert the error to a string so we can
+	// json encode and pass to the client
+	// not every request will have an error so
+	// we don't want to block good data
+	return Repo{Name: res.Name, Stars: res.Stars, Error: fmt.Sprint(res.Err)}
+}
+
+// Handle Bulk requests for stars concurrently
+func GetStarsForRepos(repos Repos) Repos {
+
+	names := make([]string, len(repos.Repos))
+	for i, repo := range repos.Repos {
+		names[i] = repo.Name
+	}
+
+	for i, res := range fetchRepos(names) {
+		repos.Repos[i] = newRepoV1(res)
+	}
 
-	// return repos object with stars and errors after wg has finished
+	// return repos object with stars and errors after every lookup has finished
 	return repos
 }
 
@@ -161,56 +301,125 @@ func starsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read body
-	body, err := ioutil.ReadAll(r.Body)
+	// sorting, filtering and paging
+	query, err := parseResultQuery(r.URL.Query())
 
 	if err != nil {
-		http.Error(w, "Malformed Request.", http.StatusBadRequest)
-		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// statistics across every repo in the request
+	withAggregates, err := wantAggregates(r.URL.Query())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// stream results as they finish if the client asked for it
+	if format := streamFormat(r); format != "" {
+		if query != nil || withAggregates {
+			http.Error(w, "Sorting, filtering, paging and aggregates are not supported when streaming.", http.StatusBadRequest)
+			return
+		}
+		streamStars(w, r, format)
+		return
+	}
+
+	// json, csv, yaml or msgpack, from ?format= or the Accept header
+	format := negotiateFormat(r)
+
+	if format == "" {
+		http.Error(w, notAcceptableMessage, http.StatusNotAcceptable)
+		return
+	}
+
+	// csv is one row per repo so there is nowhere to put aggregates
+	if format == formatCSV && withAggregates {
+		http.Error(w, "Aggregates are not supported with CSV.", http.StatusBadRequest)
 		return
+	}
+
+	var results []repoResult
+
+	if query != nil && query.snapshot != nil {
+		// later pages come from what the first one looked up, the body
+		// isn't read again and nothing is charged
+		results = query.snapshot.results
+	} else {
+		// Read and validate body
+		names, ok := readRepoNames(w, r, currentLimits().maxRepos)
+
+		if !ok {
+			return
+		}
 
+		// get stars and errors
+		results = fetchRepos(names)
+
+		if query != nil {
+			results = query.match(results)
+		}
 	}
 
-	// unmarshal request into repos obj
 	var repos Repos
 
-	err = json.Unmarshal([]byte(body), &repos)
+	// aggregates cover every repo that matched, not just this page
+	if withAggregates {
+		repos.Aggregates = aggregate(results)
+	}
+
+	if query != nil {
+		var meta ResultsMeta
+		results, meta, err = query.page(results)
+
+		if err != nil {
+			http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		repos.Meta = &meta
+	}
+
+	repos.Repos = make([]Repo, len(results))
+	for i, res := range results {
+		repos.Repos[i] = newRepoV1(res)
+	}
+
+	body, err := encodeResults(format, repos)
 
 	if err != nil {
-		http.Error(w, "Malformed Request.", http.StatusBadRequest)
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	// get stars and errors
-	repos = GetStarsForRepos(repos)
+	// csv has no room for paging info so it goes in headers instead
+	if format == formatCSV && repos.Meta != nil {
+		w.Header().Set("X-Total-Count", strconv.Itoa(repos.Meta.Total))
+		if repos.Meta.NextCursor != nil {
+			w.Header().Set("X-Next-Cursor", *repos.Meta.NextCursor)
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", format)
+	w.Header().Set("Vary", "Accept")
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(repos)
+	w.Write(body)
 	starsApiReq200.Inc()
 
 }
 
-// HTTP route to handle health checks
+// HTTP route to handle health checks. Kept for anything still pointed
+// at it, it is the same as /livez
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-
-	// Ensure this handler can only be called from /stars route
-	if r.URL.Path != "/health" {
-		http.Error(w, "404 not found.", http.StatusNotFound)
+	if !healthRoute(w, r, "/health") {
 		return
 	}
-
-	// Ensure POST is the only method used
-	if r.Method != "GET" {
-		http.Error(w, "Method is not supported.", http.StatusNotFound)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-
-	json.NewEncoder(w).Encode(`{"status":"green"}`)
+	writeHealthReport(w, HealthReport{Status: CheckOK})
 }
 
 // http logger middleware
@@ -221,11 +430,18 @@ func httpLogger(targetMux http.Handler) http.Handler {
 		targetMux.ServeHTTP(w, r)
 		requesterIP := r.RemoteAddr
 
+		// who the client cert says they are, with mutual tls
+		identity := clientIdentity(r)
+		if identity == "" {
+			identity = "-"
+		}
+
 		log.Printf(
-			"%-20s%-20s%-20s%-20v",
+			"%-20s%-20s%-20s%-20s%-20v",
 			r.Method,
 			r.RequestURI,
 			requesterIP,
+			identity,
 			time.Since(start),
 		)
 	})
@@ -249,22 +465,174 @@ var githubApiReq200 = promauto.NewCounter(prometheus.CounterOpts{
 	Name: "api_requests_github_200",
 	Help: "The total number of 200 requests to github"})
 
+var providerApiReqAll = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "api_requests_provider_all",
+	Help: "The total number of outgoing requests to each git provider"}, []string{"provider"})
+
+var providerApiReq200 = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "api_requests_provider_200",
+	Help: "The total number of 200 requests to each git provider"}, []string{"provider"})
+
+// github keeps its own counters so existing dashboards keep working
+func countUpstreamRequest(provider string) {
+	providerApiReqAll.WithLabelValues(provider).Inc()
+	if provider == "github" {
+		githubApiReqAll.Inc()
+	}
+}
+
+func countUpstreamRequest200(provider string) {
+	providerApiReq200.WithLabelValues(provider).Inc()
+	if provider == "github" {
+		githubApiReq200.Inc()
+	}
+}
+
+var webhookDeliveriesAll = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "webhook_deliveries_all",
+	Help: "The total number of outgoing webhook delivery attempts"})
+
+var webhookDeliveries2xx = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "webhook_deliveries_2xx",
+	Help: "The total number of webhook delivery attempts that got a 2xx"})
+
+var webhookDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "webhook_dead_letters",
+	Help: "The total number of webhook events moved to the dead letter queue"})
+
+var githubWebhookEvents = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "github_webhook_events",
+	Help: "The total number of star and watch events received from github"})
+
+var liveConnections = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "live_connections",
+	Help: "The number of open websocket connections"})
+
 // ------------------------------ MAIN -------------------------------
 
-var gitToken, gitTokenErr = getAuth()
+var githubWebhookSecret string = ""
 var serverURLOverride string = ""
+var store Store = newMemoryStore()
 
 func main() {
 
-	if gitTokenErr != nil {
-		log.Println(gitTokenErr)
+	loaded, err := loadConfig(os.Args[1:], os.LookupEnv)
+
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if loaded.print {
+		loaded.write(os.Stdout)
+		os.Exit(0)
+	}
+
+	cfg := loaded.cfg
+	for _, warning := range cfg.warnings() {
+		log.Println(warning)
+	}
+
+	store, err = openStore(cfg.storePath)
+
+	if err != nil {
+		log.Fatalf("Could not open store: %v", err)
+	}
+
+	// without a store path there is nothing to share
+	if cfg.rateLimits.shared && cfg.storePath != "" {
+		buckets = newStoreBuckets()
+	}
+
+	webhooks = newWebhookDispatcher(cfg.webhooks.url, cfg.webhooks.secret, cfg.webhooks.format)
+	jobs = newJobManager(cfg.jobs.retention)
+	applyConfig(cfg)
+
+	// the config and secret files are watched from here on, SIGHUP
+	// reloads them straight away
+	reloader := newConfigReloader(os.Args[1:], os.LookupEnv, loaded)
+	reloader.watch(cfg.reloadInterval)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reloader.reload("SIGHUP")
+		}
+	}()
+
+	webhooks.start()
+
+	// pick up any jobs that were running when we last stopped
+	err = jobs.restore()
+
+	if err != nil {
+		log.Fatalf("Could not restore jobs: %v", err)
+	}
+
+	jobs.start(cfg.jobs.workers)
+	jobs.startJanitor(time.Minute)
+
+	// both servers share the cert, it is reloaded when the files change
+	var certs *certReloader
+	var grpcOpts []grpc.ServerOption
+	scheme := "http"
+
+	if cfg.tls.certFile != "" {
+		certs, err = newCertReloader(cfg.tls)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Serving TLS with certificate %s", certSummary(certs.current()))
+		certs.watch(cfg.reloadInterval)
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(certs.serverConfig())))
+		scheme = "https"
 	}
 
+	// watched repos are polled in the background and their alerts checked
+	watched.start(cfg.watchlist.pollInterval)
+
+	// grpc gets its own port next to the http mux
+	grpcServer := newGRPCServer(grpcOpts...)
+	go func() {
+		log.Printf("gRPC listening on %s", cfg.grpcListen)
+		err := serveGRPC(grpcServer, cfg.grpcListen)
+		if err != nil {
+			log.Fatalf("gRPC server exited with: %v", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/stars", starsHandler)
+	// badges and charts stay open, they are embedded in pages that
+	// can't send a key
+	mux.HandleFunc("/stars", requireScope(scopeRead, starsHandler))
+	mux.HandleFunc("/repos/", requireScope(scopeRead, repoHandler))
+	mux.HandleFunc("/v2/stars", requireScope(scopeRead, starsV2Handler))
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	mux.HandleFunc("/compare", requireScope(scopeRead, compareHandler))
+	mux.HandleFunc("/badge/", badgeHandler)
+	mux.HandleFunc("/chart/", chartHandler)
+	mux.HandleFunc("/ws", requireScope(scopeRead, liveHandler))
+	mux.HandleFunc("/jobs", requireScope(scopeJobs, jobsHandler))
+	mux.HandleFunc("/jobs/", requireScope(scopeJobs, jobHandler))
+	mux.HandleFunc("/keys", requireScope(scopeAdmin, keysHandler))
+	mux.HandleFunc("/keys/", requireScope(scopeAdmin, keyHandler))
+	mux.HandleFunc("/watchlist", requireScope(scopeAdmin, watchlistHandler))
+	mux.HandleFunc("/watchlist/", requireScope(scopeAdmin, watchlistHandler))
 	mux.HandleFunc("/health", healthCheckHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
 	mux.Handle("/metrics", promhttp.Handler())
-	fmt.Println(`
+	mux.HandleFunc("/webhooks/github", githubWebhookHandler)
+	mux.HandleFunc("/webhooks/deliveries", requireScope(scopeAdmin, webhookDeliveriesHandler))
+	mux.HandleFunc("/webhooks/dead-letters", requireScope(scopeAdmin, deadLettersHandler))
+	mux.HandleFunc("/webhooks/dead-letters/replay", requireScope(scopeAdmin, replayDeadLettersHandler))
+	fmt.Printf(`
 
 Starting Rainbow Road Server!
             .
@@ -277,15 +645,31 @@ Starting Rainbow Road Server!
        OOO'   'OOO
       O'         'O
   
- Listening on port: 9999
+ Listening on: %s (%s)
  
- `)
+ `, cfg.listen, scheme)
 
-	err := http.ListenAndServe(":9999", httpLogger(mux))
+	srv := &http.Server{Addr: cfg.listen, Handler: httpLogger(rateLimiter(mux))}
 
-	if err != nil {
-		log.Fatalf("Server exited with: %v", err)
-	}
+	go func() {
+		var err error
+		if certs != nil {
+			srv.TLSConfig = certs.serverConfig()
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server exited with: %v", err)
+		}
+	}()
+
+	// wait for k8s (or ctrl-c) to tell us to stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+
+	shutdown(currentShutdownConfig(), srv, grpcServer)
 }
 
 // things I would impliment if I had more time:
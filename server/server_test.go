@@ -43,35 +43,6 @@ func TestAssembleURL(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
-func TestGetAuth(t *testing.T) {
-
-	// Get original token so we can put it back after
-	originalToken, _ := os.LookupEnv("GITHUB_TOKEN")
-
-	// set token to test value
-	err := os.Setenv("GITHUB_TOKEN", "test")
-	assert.Nil(t, err)
-
-	// test that we can get the token
-	token, err := getAuth()
-	assert.Nil(t, err)
-	assert.Equal(t, "test", token)
-
-	// unset the test token
-	err = os.Unsetenv("GITHUB_TOKEN")
-	assert.Nil(t, err)
-
-	// assert we get the correct error message
-	_, err = getAuth()
-
-	assert.EqualError(t, err, "WARNING: GITHUB_TOKEN environment variable not set. API requests to github will be rate limited")
-
-	// put it back the way it was
-	err = os.Setenv("GITHUB_TOKEN", originalToken)
-	assert.Nil(t, err)
-
-}
-
 func TestGetStars(t *testing.T) {
 	// Test error handling for our calls to github.
 
@@ -94,6 +65,18 @@ func TestGetStars(t *testing.T) {
 	_, err = GetStars(r)
 	assert.EqualError(t, err, "Repo Not found: lkajef023093i2sdfaj09cff/9dieadf09ejd92d23")
 
+	// other providers read their own star field
+	mockGithubAPI(`{"star_count" : 7}`, 200)
+
+	r.Name = "gitlab:group/subgroup/project"
+	stars, err = GetStars(r)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, stars)
+
+	r.Name = "bitbucket:owner/repo"
+	_, err = GetStars(r)
+	assert.EqualError(t, err, "Recieved unknown provider: bitbucket")
+
 	serverURLOverride = ""
 
 }
@@ -241,7 +224,7 @@ func TestHealthCheckHandler(t *testing.T) {
 	handler.ServeHTTP(recorder, req)
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
-	expected := "\"{\\\"status\\\":\\\"green\\\"}\"\n"
+	expected := "{\"status\":\"ok\"}\n"
 	assert.Equal(t, expected, recorder.Body.String())
 
 	// Test using wrong HTTP Method
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ----------------------------- SHUTDOWN -----------------------------
+
+// How long a shutdown waits before it stops taking connections, and
+// how long everything in flight then gets to finish
+type shutdownConfig struct {
+	// time for load balancers to see /readyz fail and stop sending traffic
+	delay time.Duration
+	grace time.Duration
+}
+
+// these have to fit inside the pod's terminationGracePeriodSeconds
+var defaultShutdownConfig = shutdownConfig{delay: 5 * time.Second, grace: 25 * time.Second}
+
+// what the next shutdown uses, can change on reload
+var shutdownSettings = defaultShutdownConfig
+
+// set once a shutdown starts, /readyz fails from then on
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// stop grpc, letting in flight calls finish until ctx is done
+func stopGRPC(ctx context.Context, s *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// Shut the server down without dropping work. Marks us not ready, waits
+// for traffic to move elsewhere, then gives in flight requests, running
+// jobs, queued webhooks and the watchlist poll until the grace period is
+// up before flushing the store. Anything still going after that is cut off
+func shutdown(cfg shutdownConfig, srv *http.Server, grpcServer *grpc.Server) {
+	atomic.StoreInt32(&draining, 1)
+
+	// grpc health probes and clients see it too, not just /readyz
+	if grpcHealth != nil {
+		grpcHealth.Shutdown()
+	}
+
+	log.Printf("Shutting down, waiting %s for traffic to drain", cfg.delay)
+	time.Sleep(cfg.delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.grace)
+	defer cancel()
+
+	// stops accepting connections and waits on requests already going
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("HTTP requests still running at the end of the grace period: %v", err)
+	}
+
+	err = stopGRPC(ctx, grpcServer)
+	if err != nil {
+		log.Printf("gRPC calls still running at the end of the grace period: %v", err)
+	}
+
+	err = jobs.shutdown(ctx)
+	if err != nil {
+		log.Printf("Jobs still running at the end of the grace period will resume on the next start: %v", err)
+	}
+
+	// after http so events from the last requests are included
+	err = webhooks.stop(ctx)
+	if err != nil {
+		log.Printf("Undelivered webhooks were moved to the dead letters: %v", err)
+	}
+
+	// stopped before the flush so its last writes make it to the store
+	err = watched.stop(ctx)
+	if err != nil {
+		log.Printf("Watchlist poll still running at the end of the grace period: %v", err)
+	}
+
+	err = store.Flush()
+	if err != nil {
+		log.Printf("Could not flush store: %v", err)
+	}
+
+	log.Println("Shutdown complete")
+}
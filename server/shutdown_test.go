@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func() {
+		draining = 0
+		jobs = newJobManager(24 * time.Hour)
+		webhooks = newWebhookDispatcher("", "", "json")
+	}()
+
+	jobs = newJobManager(time.Hour)
+	jobs.start(1)
+	webhooks = newWebhookDispatcher("", "", "json")
+
+	// a slow request that is already running when the shutdown starts
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(lis)
+
+	type result struct {
+		code int
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + lis.Addr().String() + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		results <- result{code: resp.StatusCode}
+	}()
+	<-started
+
+	shutdown(shutdownConfig{delay: 0, grace: 5 * time.Second}, srv, newGRPCServer())
+
+	// the request in flight finished
+	res := <-results
+	assert.Nil(t, res.err)
+	assert.Equal(t, http.StatusOK, res.code)
+
+	// we are out of rotation and not taking anything new
+	assert.True(t, isDraining())
+	assert.Equal(t, CheckFail, readiness().Status)
+	assert.Equal(t, "Server is shutting down", readiness().Checks["shutdown"].Message)
+
+	for _, service := range []string{"", "rainbowroad.v1.Stars"} {
+		health, err := grpcHealth.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		assert.Nil(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, health.Status)
+	}
+
+	_, err = jobs.submit([]string{"rdelpret/cartographer"})
+	assert.Equal(t, errJobQueueStopped, err)
+
+	_, err = http.Get("http://" + lis.Addr().String() + "/slow")
+	assert.NotNil(t, err)
+}
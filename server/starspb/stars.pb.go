@@ -0,0 +1,396 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.26.0
+// 	protoc        (unknown)
+// source: stars.proto
+
+package starspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// How a repo lookup ended. Same values as the v2 api status field.
+type Status int32
+
+const (
+	Status_STATUS_UNSPECIFIED    Status = 0
+	Status_STATUS_OK             Status = 1
+	Status_STATUS_INVALID        Status = 2
+	Status_STATUS_NOT_FOUND      Status = 3
+	Status_STATUS_UPSTREAM_ERROR Status = 4
+)
+
+// Enum value maps for Status.
+var (
+	Status_name = map[int32]string{
+		0: "STATUS_UNSPECIFIED",
+		1: "STATUS_OK",
+		2: "STATUS_INVALID",
+		3: "STATUS_NOT_FOUND",
+		4: "STATUS_UPSTREAM_ERROR",
+	}
+	Status_value = map[string]int32{
+		"STATUS_UNSPECIFIED":    0,
+		"STATUS_OK":             1,
+		"STATUS_INVALID":        2,
+		"STATUS_NOT_FOUND":      3,
+		"STATUS_UPSTREAM_ERROR": 4,
+	}
+)
+
+func (x Status) Enum() *Status {
+	p := new(Status)
+	*p = x
+	return p
+}
+
+func (x Status) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Status) Descriptor() protoreflect.EnumDescriptor {
+	return file_stars_proto_enumTypes[0].Descriptor()
+}
+
+func (Status) Type() protoreflect.EnumType {
+	return &file_stars_proto_enumTypes[0]
+}
+
+func (x Status) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Status.Descriptor instead.
+func (Status) EnumDescriptor() ([]byte, []int) {
+	return file_stars_proto_rawDescGZIP(), []int{0}
+}
+
+type GetStarsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// owner/repo, optionally prefixed with a provider, ie gitlab:group/project
+	Repos []string `protobuf:"bytes,1,rep,name=repos,proto3" json:"repos,omitempty"`
+}
+
+func (x *GetStarsRequest) Reset() {
+	*x = GetStarsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_stars_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetStarsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStarsRequest) ProtoMessage() {}
+
+func (x *GetStarsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_stars_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStarsRequest.ProtoReflect.Descriptor instead.
+func (*GetStarsRequest) Descriptor() ([]byte, []int) {
+	return file_stars_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GetStarsRequest) GetRepos() []string {
+	if x != nil {
+		return x.Repos
+	}
+	return nil
+}
+
+type GetStarsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Repos []*RepoResult `protobuf:"bytes,1,rep,name=repos,proto3" json:"repos,omitempty"`
+}
+
+func (x *GetStarsResponse) Reset() {
+	*x = GetStarsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_stars_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetStarsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStarsResponse) ProtoMessage() {}
+
+func (x *GetStarsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_stars_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStarsResponse.ProtoReflect.Descriptor instead.
+func (*GetStarsResponse) Descriptor() ([]byte, []int) {
+	return file_stars_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GetStarsResponse) GetRepos() []*RepoResult {
+	if x != nil {
+		return x.Repos
+	}
+	return nil
+}
+
+type RepoResult struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// position of the repo in the request
+	Index int32  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Name  string `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	// only meaningful when status is STATUS_OK
+	Stars  int64  `protobuf:"varint,3,opt,name=stars,proto3" json:"stars,omitempty"`
+	Status Status `protobuf:"varint,4,opt,name=status,proto3,enum=rainbowroad.v1.Status" json:"status,omitempty"`
+	// empty when status is STATUS_OK
+	Error string `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *RepoResult) Reset() {
+	*x = RepoResult{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_stars_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RepoResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RepoResult) ProtoMessage() {}
+
+func (x *RepoResult) ProtoReflect() protoreflect.Message {
+	mi := &file_stars_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RepoResult.ProtoReflect.Descriptor instead.
+func (*RepoResult) Descriptor() ([]byte, []int) {
+	return file_stars_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RepoResult) GetIndex() int32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *RepoResult) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *RepoResult) GetStars() int64 {
+	if x != nil {
+		return x.Stars
+	}
+	return 0
+}
+
+func (x *RepoResult) GetStatus() Status {
+	if x != nil {
+		return x.Status
+	}
+	return Status_STATUS_UNSPECIFIED
+}
+
+func (x *RepoResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_stars_proto protoreflect.FileDescriptor
+
+var file_stars_proto_rawDesc = []byte{
+	0x0a, 0x0b, 0x73, 0x74, 0x61, 0x72, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0e, 0x72,
+	0x61, 0x69, 0x6e, 0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76, 0x31, 0x22, 0x27, 0x0a,
+	0x0f, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x72, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x14, 0x0a, 0x05, 0x72, 0x65, 0x70, 0x6f, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52,
+	0x05, 0x72, 0x65, 0x70, 0x6f, 0x73, 0x22, 0x44, 0x0a, 0x10, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61,
+	0x72, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x30, 0x0a, 0x05, 0x72, 0x65,
+	0x70, 0x6f, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x72, 0x61, 0x69, 0x6e,
+	0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x52,
+	0x65, 0x73, 0x75, 0x6c, 0x74, 0x52, 0x05, 0x72, 0x65, 0x70, 0x6f, 0x73, 0x22, 0x92, 0x01, 0x0a,
+	0x0a, 0x52, 0x65, 0x70, 0x6f, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x69,
+	0x6e, 0x64, 0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x05, 0x69, 0x6e, 0x64, 0x65,
+	0x78, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x72, 0x73, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x73, 0x74, 0x61, 0x72, 0x73, 0x12, 0x2e, 0x0a, 0x06, 0x73,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x16, 0x2e, 0x72, 0x61,
+	0x69, 0x6e, 0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x65,
+	0x72, 0x72, 0x6f, 0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f,
+	0x72, 0x2a, 0x74, 0x0a, 0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x16, 0x0a, 0x12, 0x53,
+	0x54, 0x41, 0x54, 0x55, 0x53, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45,
+	0x44, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x53, 0x54, 0x41, 0x54, 0x55, 0x53, 0x5f, 0x4f, 0x4b,
+	0x10, 0x01, 0x12, 0x12, 0x0a, 0x0e, 0x53, 0x54, 0x41, 0x54, 0x55, 0x53, 0x5f, 0x49, 0x4e, 0x56,
+	0x41, 0x4c, 0x49, 0x44, 0x10, 0x02, 0x12, 0x14, 0x0a, 0x10, 0x53, 0x54, 0x41, 0x54, 0x55, 0x53,
+	0x5f, 0x4e, 0x4f, 0x54, 0x5f, 0x46, 0x4f, 0x55, 0x4e, 0x44, 0x10, 0x03, 0x12, 0x19, 0x0a, 0x15,
+	0x53, 0x54, 0x41, 0x54, 0x55, 0x53, 0x5f, 0x55, 0x50, 0x53, 0x54, 0x52, 0x45, 0x41, 0x4d, 0x5f,
+	0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x04, 0x32, 0xa4, 0x01, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x72,
+	0x73, 0x12, 0x4d, 0x0a, 0x08, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x72, 0x73, 0x12, 0x1f, 0x2e,
+	0x72, 0x61, 0x69, 0x6e, 0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76, 0x31, 0x2e, 0x47,
+	0x65, 0x74, 0x53, 0x74, 0x61, 0x72, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x20,
+	0x2e, 0x72, 0x61, 0x69, 0x6e, 0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76, 0x31, 0x2e,
+	0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x72, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x12, 0x4c, 0x0a, 0x0b, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x53, 0x74, 0x61, 0x72, 0x73, 0x12,
+	0x1f, 0x2e, 0x72, 0x61, 0x69, 0x6e, 0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76, 0x31,
+	0x2e, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x72, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x1a, 0x2e, 0x72, 0x61, 0x69, 0x6e, 0x62, 0x6f, 0x77, 0x72, 0x6f, 0x61, 0x64, 0x2e, 0x76,
+	0x31, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x30, 0x01, 0x42, 0x26,
+	0x5a, 0x24, 0x72, 0x64, 0x65, 0x6c, 0x70, 0x72, 0x65, 0x74, 0x2f, 0x72, 0x61, 0x69, 0x6e, 0x62,
+	0x6f, 0x77, 0x2d, 0x72, 0x6f, 0x61, 0x64, 0x2f, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2f, 0x73,
+	0x74, 0x61, 0x72, 0x73, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_stars_proto_rawDescOnce sync.Once
+	file_stars_proto_rawDescData = file_stars_proto_rawDesc
+)
+
+func file_stars_proto_rawDescGZIP() []byte {
+	file_stars_proto_rawDescOnce.Do(func() {
+		file_stars_proto_rawDescData = protoimpl.X.CompressGZIP(file_stars_proto_rawDescData)
+	})
+	return file_stars_proto_rawDescData
+}
+
+var file_stars_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_stars_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_stars_proto_goTypes = []interface{}{
+	(Status)(0),              // 0: rainbowroad.v1.Status
+	(*GetStarsRequest)(nil),  // 1: rainbowroad.v1.GetStarsRequest
+	(*GetStarsResponse)(nil), // 2: rainbowroad.v1.GetStarsResponse
+	(*RepoResult)(nil),       // 3: rainbowroad.v1.RepoResult
+}
+var file_stars_proto_depIdxs = []int32{
+	3, // 0: rainbowroad.v1.GetStarsResponse.repos:type_name -> rainbowroad.v1.RepoResult
+	0, // 1: rainbowroad.v1.RepoResult.status:type_name -> rainbowroad.v1.Status
+	1, // 2: rainbowroad.v1.Stars.GetStars:input_type -> rainbowroad.v1.GetStarsRequest
+	1, // 3: rainbowroad.v1.Stars.StreamStars:input_type -> rainbowroad.v1.GetStarsRequest
+	2, // 4: rainbowroad.v1.Stars.GetStars:output_type -> rainbowroad.v1.GetStarsResponse
+	3, // 5: rainbowroad.v1.Stars.StreamStars:output_type -> rainbowroad.v1.RepoResult
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_stars_proto_init() }
+func file_stars_proto_init() {
+	if File_stars_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_stars_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetStarsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_stars_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetStarsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_stars_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RepoResult); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_stars_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_stars_proto_goTypes,
+		DependencyIndexes: file_stars_proto_depIdxs,
+		EnumInfos:         file_stars_proto_enumTypes,
+		MessageInfos:      file_stars_proto_msgTypes,
+	}.Build()
+	File_stars_proto = out.File
+	file_stars_proto_rawDesc = nil
+	file_stars_proto_goTypes = nil
+	file_stars_proto_depIdxs = nil
+}
@@ -0,0 +1,171 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package starspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// StarsClient is the client API for Stars service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StarsClient interface {
+	// Look up a batch of repos and return them all at once, in request order.
+	GetStars(ctx context.Context, in *GetStarsRequest, opts ...grpc.CallOption) (*GetStarsResponse, error)
+	// Look up a batch of repos and send each one back as soon as its lookup
+	// finishes. Results arrive in completion order, use index to match them up.
+	StreamStars(ctx context.Context, in *GetStarsRequest, opts ...grpc.CallOption) (Stars_StreamStarsClient, error)
+}
+
+type starsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStarsClient(cc grpc.ClientConnInterface) StarsClient {
+	return &starsClient{cc}
+}
+
+func (c *starsClient) GetStars(ctx context.Context, in *GetStarsRequest, opts ...grpc.CallOption) (*GetStarsResponse, error) {
+	out := new(GetStarsResponse)
+	err := c.cc.Invoke(ctx, "/rainbowroad.v1.Stars/GetStars", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *starsClient) StreamStars(ctx context.Context, in *GetStarsRequest, opts ...grpc.CallOption) (Stars_StreamStarsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Stars_ServiceDesc.Streams[0], "/rainbowroad.v1.Stars/StreamStars", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &starsStreamStarsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Stars_StreamStarsClient interface {
+	Recv() (*RepoResult, error)
+	grpc.ClientStream
+}
+
+type starsStreamStarsClient struct {
+	grpc.ClientStream
+}
+
+func (x *starsStreamStarsClient) Recv() (*RepoResult, error) {
+	m := new(RepoResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StarsServer is the server API for Stars service.
+// All implementations must embed UnimplementedStarsServer
+// for forward compatibility
+type StarsServer interface {
+	// Look up a batch of repos and return them all at once, in request order.
+	GetStars(context.Context, *GetStarsRequest) (*GetStarsResponse, error)
+	// Look up a batch of repos and send each one back as soon as its lookup
+	// finishes. Results arrive in completion order, use index to match them up.
+	StreamStars(*GetStarsRequest, Stars_StreamStarsServer) error
+	mustEmbedUnimplementedStarsServer()
+}
+
+// UnimplementedStarsServer must be embedded to have forward compatible implementations.
+type UnimplementedStarsServer struct {
+}
+
+func (UnimplementedStarsServer) GetStars(context.Context, *GetStarsRequest) (*GetStarsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStars not implemented")
+}
+func (UnimplementedStarsServer) StreamStars(*GetStarsRequest, Stars_StreamStarsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamStars not implemented")
+}
+func (UnimplementedStarsServer) mustEmbedUnimplementedStarsServer() {}
+
+// UnsafeStarsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StarsServer will
+// result in compilation errors.
+type UnsafeStarsServer interface {
+	mustEmbedUnimplementedStarsServer()
+}
+
+func RegisterStarsServer(s grpc.ServiceRegistrar, srv StarsServer) {
+	s.RegisterService(&Stars_ServiceDesc, srv)
+}
+
+func _Stars_GetStars_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStarsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StarsServer).GetStars(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rainbowroad.v1.Stars/GetStars",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StarsServer).GetStars(ctx, req.(*GetStarsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stars_StreamStars_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetStarsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StarsServer).StreamStars(m, &starsStreamStarsServer{stream})
+}
+
+type Stars_StreamStarsServer interface {
+	Send(*RepoResult) error
+	grpc.ServerStream
+}
+
+type starsStreamStarsServer struct {
+	grpc.ServerStream
+}
+
+func (x *starsStreamStarsServer) Send(m *RepoResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Stars_ServiceDesc is the grpc.ServiceDesc for Stars service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Stars_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rainbowroad.v1.Stars",
+	HandlerType: (*StarsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStars",
+			Handler:    _Stars_GetStars_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamStars",
+			Handler:       _Stars_StreamStars_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "stars.proto",
+}
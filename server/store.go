@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ----------------------------- STORAGE -----------------------------
+
+// Store is a small key/value interface used for anything the server
+// needs to keep around (dead letters, etc). Values are raw bytes so
+// callers can json encode whatever they want.
+type Store interface {
+	Get(key string) ([]byte, bool, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	List(prefix string) (map[string][]byte, error)
+	// make sure everything written so far is persisted, ie before exiting
+	Flush() error
+}
+
+// in memory store, used by default and in tests
+type memoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.data[key]
+	return val, ok, nil
+}
+
+func (s *memoryStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+func (s *memoryStore) List(prefix string) (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[string][]byte)
+	for key, val := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			res[key] = val
+		}
+	}
+	return res, nil
+}
+
+// nothing to persist when everything lives in memory
+func (s *memoryStore) Flush() error {
+	return nil
+}
+
+// file backed store. Keeps everything in memory and rewrites the whole
+// file on every change, which is plenty for the amount of data we keep.
+type fileStore struct {
+	*memoryStore
+	path string
+	// serialize writes so an older snapshot never replaces a newer one
+	writeMu sync.Mutex
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+
+	body, err := ioutil.ReadFile(path)
+
+	// a missing file just means we are starting fresh
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &s.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) Put(key string, value []byte) error {
+	s.memoryStore.Put(key, value)
+	return s.save()
+}
+
+func (s *fileStore) Delete(key string) error {
+	s.memoryStore.Delete(key)
+	return s.save()
+}
+
+// writes already go straight to disk, this covers anything a failed
+// write left behind and syncs the file
+func (s *fileStore) Flush() error {
+	return s.save()
+}
+
+// write to a temp file and rename so we never leave a half written file
+func (s *fileStore) save() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.RLock()
+	body, err := json.Marshal(s.data)
+	s.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".rainbow-road-store-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// helper function to pick a store based on STORE_PATH.
+// no path means we keep everything in memory
+func openStore(path string) (Store, error) {
+	if path == "" {
+		return newMemoryStore(), nil
+	}
+	return newFileStore(path)
+}
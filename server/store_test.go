@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore()
+
+	assert.Nil(t, s.Put("a/1", []byte("one")))
+	assert.Nil(t, s.Put("b/1", []byte("two")))
+
+	val, ok, err := s.Get("a/1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("one"), val)
+
+	list, err := s.List("a/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"a/1": []byte("one")}, list)
+
+	assert.Nil(t, s.Delete("a/1"))
+	_, ok, _ = s.Get("a/1")
+	assert.False(t, ok)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rainbow-road")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.json")
+
+	// missing file is fine
+	s, err := openStore(path)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Put("a/1", []byte("\"one\"")))
+	assert.Nil(t, s.Put("a/2", []byte("\"two\"")))
+	assert.Nil(t, s.Delete("a/2"))
+	assert.Nil(t, s.Flush())
+
+	// reopen and make sure it survived
+	s, err = openStore(path)
+	assert.Nil(t, err)
+	list, err := s.List("a/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"a/1": []byte("\"one\"")}, list)
+
+	// garbage in the file is an error
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	_, err = openStore(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------- STREAMING ----------------------------
+
+// One repo result in a streamed response. Index is the repo's position
+// in the request since results come back in the order they finish
+type streamedRepo struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	RepoV2
+}
+
+// Last record in a streamed response
+type streamSummary struct {
+	Type       string `json:"type"`
+	Total      int    `json:"total"`
+	OK         int    `json:"ok"`
+	Failed     int    `json:"failed"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+const (
+	streamNDJSON = "application/x-ndjson"
+	streamSSE    = "text/event-stream"
+)
+
+// helper function to pick a streaming format from the Accept header.
+// Returns an empty string if the client didn't ask for one
+func streamFormat(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if mediaType == streamNDJSON || mediaType == streamSSE {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// Decode a {"repos": [...]} body one entry at a time, calling found for
+// every repo name as soon as it is read so we never hold the whole body.
+// Decoding stops at the first error found returns
+func decodeRepoNames(body io.Reader, found func(name string) error) error {
+	strict := currentLimits().strict
+	dec := json.NewDecoder(body)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		// skip anything that isn't the repo list
+		if key != "repos" {
+			if strict {
+				return fmt.Errorf("json: unknown field %q", key)
+			}
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		// "repos": null is just an empty list
+		if token == nil {
+			continue
+		}
+
+		if token != json.Delim('[') {
+			return fmt.Errorf("expected [ but got %v", token)
+		}
+
+		for dec.More() {
+			var repo repoRequest
+			err = dec.Decode(&repo)
+			if err != nil {
+				return err
+			}
+			err = found(repo.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = expectDelim(dec, ']')
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// helper function to read a json delimiter and fail if we get anything else
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v but got %v", delim, token)
+	}
+	return nil
+}
+
+// write one record in the requested format and push it to the client
+func writeStreamRecord(w http.ResponseWriter, format string, event string, record interface{}) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if format == streamSSE {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", body)
+	}
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return err
+}
+
+// Stream results back one repo at a time as each lookup finishes,
+// followed by a summary record.
+//
+// Lookups start as soon as each repo is decoded from the body, but
+// nothing is written until the whole body has been read. HTTP/1.x
+// doesn't let a handler keep reading the request once it has started
+// writing the response. That also means a request that turns out to
+// be too big or to have bad repos in it still gets a proper 413 or 422.
+//
+// Callers with a quota are charged for the whole request once it has all
+// been read, so their lookups wait for the body like readRepoNames does.
+func streamStars(w http.ResponseWriter, r *http.Request, format string) {
+
+	start := time.Now()
+	results := make(chan streamedRepo)
+	wg := sync.WaitGroup{}
+	total := 0
+	var invalid []validationError
+
+	lookup := func(index int, name string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- streamedRepo{Type: "repo", Index: index, RepoV2: newRepoV2(fetchRepo(name))}
+		}()
+	}
+
+	// repos held back until the quota has been charged
+	c := callerFrom(r.Context())
+	metered := c != nil && c.key != nil
+	var pending []string
+
+	// don't bother reading a body we already know is too big
+	lim := currentLimits()
+	var err error
+	if r.ContentLength > lim.maxBytes {
+		err = errRequestTooLarge
+	} else {
+		err = decodeRepoNames(newLimitedBody(r.Body), func(name string) error {
+			if total >= lim.maxRepos {
+				return &tooManyReposError{lim.maxRepos}
+			}
+
+			index := total
+			total++
+
+			if err := validateRepoName(name); err != nil {
+				invalid = append(invalid, validationError{Index: index, Name: name, Error: err.Error()})
+			}
+
+			// the request is getting rejected, don't start any more lookups
+			if len(invalid) > 0 {
+				return nil
+			}
+
+			if metered {
+				pending = append(pending, name)
+			} else {
+				lookup(index, name)
+			}
+			return nil
+		})
+	}
+
+	// all or nothing, like readRepoNames
+	if err == nil && len(invalid) == 0 && metered {
+		if !chargeRequest(w, r, total) {
+			return
+		}
+		for i, name := range pending {
+			lookup(i, name)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if err != nil || len(invalid) > 0 {
+		// let anything we already started finish in the background
+		go func() {
+			for range results {
+			}
+		}()
+
+		if err != nil {
+			writeRequestError(w, err)
+		} else {
+			writeValidationErrors(w, invalid)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", format)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	summary := streamSummary{Type: "summary", Total: total}
+
+	for res := range results {
+		if res.Status == StatusOK {
+			summary.OK++
+		} else {
+			summary.Failed++
+		}
+
+		// if the client went away this fails, but we keep
+		// draining so every lookup goroutine can finish
+		writeStreamRecord(w, format, "repo", res)
+	}
+
+	summary.DurationMS = time.Since(start).Milliseconds()
+	writeStreamRecord(w, format, "summary", summary)
+	starsApiReq200.Inc()
+}
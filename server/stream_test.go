@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamFormat(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/stars", nil)
+	assert.Equal(t, "", streamFormat(req))
+
+	req.Header.Set("Accept", "application/json")
+	assert.Equal(t, "", streamFormat(req))
+
+	req.Header.Set("Accept", "application/x-ndjson")
+	assert.Equal(t, streamNDJSON, streamFormat(req))
+
+	req.Header.Set("Accept", "text/html, text/event-stream;q=0.9")
+	assert.Equal(t, streamSSE, streamFormat(req))
+}
+
+func TestDecodeRepoNames(t *testing.T) {
+	var names []string
+	found := func(name string) error {
+		names = append(names, name)
+		return nil
+	}
+
+	err := decodeRepoNames(strings.NewReader(`{"other": {"a": [1]}, "repos": [{"name": "a/b"}, {"name": "c/d"}]}`), found)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/b", "c/d"}, names)
+
+	names = nil
+	err = decodeRepoNames(strings.NewReader(`{"repos": null}`), found)
+	assert.Nil(t, err)
+	assert.Nil(t, names)
+
+	// entries before the error are still reported
+	names = nil
+	err = decodeRepoNames(strings.NewReader(`{"repos": [{"name": "a/b"}, {"name" "c/d"}]}`), found)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"a/b"}, names)
+
+	err = decodeRepoNames(strings.NewReader(`["a/b"]`), found)
+	assert.EqualError(t, err, "expected { but got [")
+
+	err = decodeRepoNames(strings.NewReader(`{"repos": "a/b"}`), found)
+	assert.EqualError(t, err, "expected [ but got a/b")
+
+	// decoding stops as soon as found fails
+	names = nil
+	err = decodeRepoNames(strings.NewReader(`{"repos": [{"name": "a/b"}, {"name": "c/d"}]}`), func(name string) error {
+		names = append(names, name)
+		return errors.New("stop")
+	})
+	assert.EqualError(t, err, "stop")
+	assert.Equal(t, []string{"a/b"}, names)
+
+	// strict mode rejects fields we don't know about
+	limits.strict = true
+	defer func() { limits = defaultRequestLimits }()
+
+	err = decodeRepoNames(strings.NewReader(`{"other": 1, "repos": []}`), found)
+	assert.EqualError(t, err, `json: unknown field "other"`)
+
+	err = decodeRepoNames(strings.NewReader(`{"repos": [{"name": "a/b", "Stars": 1}]}`), found)
+	assert.EqualError(t, err, `json: unknown field "Stars"`)
+}
+
+func TestStreamStarsNDJSON(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	recorder := httptest.NewRecorder()
+	body := []byte(`{"repos": [{"name": "rdelpret/cartographer"}, {"name": "rdelpret/kfx"}]}`)
+	req, _ := http.NewRequest("POST", "/stars", bytes.NewBuffer(body))
+	req.Header.Set("Accept", "application/x-ndjson")
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, streamNDJSON, recorder.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	// repo records can come back in any order
+	records := map[int]map[string]interface{}{}
+	for _, line := range lines[:2] {
+		var record map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, "repo", record["type"])
+		records[int(record["index"].(float64))] = record
+	}
+	assert.Equal(t, "rdelpret/cartographer", records[0]["name"])
+	assert.Equal(t, float64(1), records[0]["stars"])
+	assert.Equal(t, "rdelpret/kfx", records[1]["name"])
+	assert.Equal(t, StatusOK, records[1]["status"])
+
+	var summary streamSummary
+	assert.Nil(t, json.Unmarshal([]byte(lines[2]), &summary))
+	assert.Equal(t, "summary", summary.Type)
+	assert.Equal(t, 2, summary.Total)
+	assert.Equal(t, 2, summary.OK)
+	assert.Equal(t, 0, summary.Failed)
+}
+
+func TestStreamStarsSSE(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	recorder := httptest.NewRecorder()
+	body := []byte(`{"repos": [{"name": "rdelpret/cartographer"}]}`)
+	req, _ := http.NewRequest("POST", "/v2/stars", bytes.NewBuffer(body))
+	req.Header.Set("Accept", "text/event-stream")
+	http.HandlerFunc(starsV2Handler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, streamSSE, recorder.Header().Get("Content-Type"))
+
+	events := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n\n")
+	assert.Len(t, events, 2)
+	assert.Equal(t,
+		`event: repo`+"\n"+`data: {"type":"repo","index":0,"name":"rdelpret/cartographer","stars":1,"status":"ok","error":null}`,
+		events[0])
+	assert.True(t, strings.HasPrefix(events[1], "event: summary\ndata: {\"type\":\"summary\",\"total\":1,\"ok\":1,\"failed\":0,"))
+}
+
+func TestStreamStarsMalformed(t *testing.T) {
+
+	// the first repo is decoded before the body turns out to be bad.
+	// Use a name that fails validation so no lookup can outlive the test
+	recorder := httptest.NewRecorder()
+	body := []byte(`{"repos": [{"name": "bitbucket:rdelpret/cartographer"}, {"name" "invalid"}]}`)
+	req, _ := http.NewRequest("POST", "/stars", bytes.NewBuffer(body))
+	req.Header.Set("Accept", "application/x-ndjson")
+	http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Malformed Request.\n", recorder.Body.String())
+}
+
+func TestStreamStarsRejected(t *testing.T) {
+	defer func() { limits = defaultRequestLimits }()
+
+	// bad repos are all reported up front, and nothing is looked up
+	recorder := httptest.NewRecorder()
+	body := []byte(`{"repos": [{"name": "invalid"}, {"name": "bitbucket:a/b"}, {}]}`)
+	req, _ := http.NewRequest("POST", "/v2/stars", bytes.NewBuffer(body))
+	req.Header.Set("Accept", "application/x-ndjson")
+	http.HandlerFunc(starsV2Handler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	var res validationErrors
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	assert.Equal(t, []int{0, 1, 2}, []int{res.Errors[0].Index, res.Errors[1].Index, res.Errors[2].Index})
+
+	// too many repos
+	limits.maxRepos = 1
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", bytes.NewBuffer([]byte(`{"repos": [{"name": "bitbucket:a/b"}, {"name": "bitbucket:c/d"}]}`)))
+	req.Header.Set("Accept", "application/x-ndjson")
+	http.HandlerFunc(starsV2Handler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, "Too many repos. Limit is 1 per request.\n", recorder.Body.String())
+
+	// body too big, even without a content length
+	limits.maxBytes = 10
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", strings.NewReader(`{"repos": []}`))
+	req.ContentLength = -1
+	req.Header.Set("Accept", "application/x-ndjson")
+	http.HandlerFunc(starsV2Handler).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, "Request Too Large.\n", recorder.Body.String())
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// ------------------------------- TLS --------------------------------
+
+var tlsReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tls_reloads",
+	Help: "The total number of certificate reloads, by whether they were applied"}, []string{"result"})
+
+// Keeps the serving certificate and client CAs in memory and loads them
+// again when the files change, so rotating a cert never needs a restart.
+// Connections already open keep the cert they shook hands with
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	clientCAs   *x509.CertPool
+	fingerprint string
+}
+
+func newCertReloader(cfg tlsSettings) (*certReloader, error) {
+	c := &certReloader{
+		certFile:     cfg.certFile,
+		keyFile:      cfg.keyFile,
+		clientCAFile: cfg.clientCAFile,
+		clientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	if cfg.clientAuth == "verify_if_given" {
+		c.clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return c, c.load()
+}
+
+func (c *certReloader) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.clientCAFile != "" {
+		files = append(files, c.clientCAFile)
+	}
+	return files
+}
+
+// read the cert, key and client CAs and swap them in together
+func (c *certReloader) load() error {
+	fingerprint := fingerprintFiles(c.files())
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.New("Could not load TLS certificate: " + err.Error())
+	}
+
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		body, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return errors.New("Could not load TLS client CAs: " + err.Error())
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(body) {
+			return errors.New("Recieved invalid tls.client_ca_file: " + c.clientCAFile + ". Hint: one or more PEM encoded CA certificates")
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.fingerprint = fingerprint
+	c.mu.Unlock()
+
+	return nil
+}
+
+// reload if the cert, key or CAs changed since the last load. A bad
+// cert is logged and the last good one keeps being served
+func (c *certReloader) check() {
+	c.mu.RLock()
+	changed := fingerprintFiles(c.files()) != c.fingerprint
+	c.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	err := c.load()
+	if err != nil {
+		// don't try again until something changes
+		c.mu.Lock()
+		c.fingerprint = fingerprintFiles(c.files())
+		c.mu.Unlock()
+
+		tlsReloads.WithLabelValues("failure").Inc()
+		log.Printf("TLS reload failed, keeping the current certificate: %v", err)
+		return
+	}
+
+	tlsReloads.WithLabelValues("success").Inc()
+	log.Printf("Reloaded TLS certificate %s", certSummary(c.current()))
+}
+
+// check the files every interval. Kubernetes and cert-manager rewrite
+// them in place so there is nothing to signal
+func (c *certReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			c.check()
+		}
+	}()
+}
+
+func (c *certReloader) current() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+// helper function to describe a cert for the logs
+func certSummary(cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "(unparseable)"
+	}
+	return leaf.Subject.String() + ", expires " + leaf.NotAfter.UTC().Format(time.RFC3339)
+}
+
+// TLS config for the http and grpc servers. Each handshake gets whatever
+// is loaded at the time
+func (c *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// never used for handshakes, but http.Server wants to see a cert
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.current(), nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+				// grpc only speaks http2
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+
+			if c.clientCAs != nil {
+				cfg.ClientCAs = c.clientCAs
+				cfg.ClientAuth = c.clientAuth
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// Who a client is going by its verified certificate: the first URI SAN
+// (ie a SPIFFE id), then the common name, then the first DNS SAN. Empty
+// when the client didn't present a cert or it wasn't checked against
+// tls.client_ca_file
+func certIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+
+	return cert.Subject.String()
+}
+
+// identity of the client behind an http request, see certIdentity
+func clientIdentity(r *http.Request) string {
+	return certIdentity(r.TLS)
+}
+
+// identity of the client behind a grpc call, see certIdentity
+func grpcClientIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+
+	return certIdentity(&info.State)
+}
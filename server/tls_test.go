@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// a cert and its key, signed by parent or self signed if parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+}
+
+func newTestServerCert(t *testing.T, ca *testCert, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func newTestClientCert(t *testing.T, ca *testCert, template *x509.Certificate) *testCert {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return newTestCert(t, template, ca)
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	assert.Nil(t, err)
+	return cert
+}
+
+// helper to write a server cert, key and client CA to disk
+func writeTestCerts(t *testing.T, dir string, server *testCert, clientCA *testCert) tlsSettings {
+	cfg := tlsSettings{
+		certFile:   filepath.Join(dir, "tls.crt"),
+		keyFile:    filepath.Join(dir, "tls.key"),
+		clientAuth: "require",
+	}
+	assert.Nil(t, ioutil.WriteFile(cfg.certFile, server.certPEM(), 0600))
+	assert.Nil(t, ioutil.WriteFile(cfg.keyFile, server.keyPEM(t), 0600))
+
+	if clientCA != nil {
+		cfg.clientCAFile = filepath.Join(dir, "ca.crt")
+		assert.Nil(t, ioutil.WriteFile(cfg.clientCAFile, clientCA.certPEM(), 0600))
+	}
+
+	return cfg
+}
+
+// helper to serve something over tls with a cert reloader
+func serveTestTLS(t *testing.T, certs *certReloader, handler http.Handler) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &http.Server{Handler: handler, TLSConfig: certs.serverConfig()}
+	go srv.ServeTLS(lis, "", "")
+
+	return "https://" + lis.Addr().String(), func() { srv.Close() }
+}
+
+// helper to get an https client that trusts ca and presents cert if given
+func testTLSClient(ca *testCert, cert *tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	cfg := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+func TestCertIdentity(t *testing.T) {
+	ca := newTestCA(t, "clients")
+	spiffe, _ := url.Parse("spiffe://example.org/ns/prod/sa/dashboard")
+
+	identity := func(template *x509.Certificate) string {
+		cert := newTestClientCert(t, ca, template)
+		return certIdentity(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.cert, ca.cert}}})
+	}
+
+	assert.Equal(t, "spiffe://example.org/ns/prod/sa/dashboard", identity(&x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}, URIs: []*url.URL{spiffe}}))
+	assert.Equal(t, "dashboard", identity(&x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}, DNSNames: []string{"dashboard.internal"}}))
+	assert.Equal(t, "dashboard.internal", identity(&x509.Certificate{DNSNames: []string{"dashboard.internal"}}))
+
+	// nothing verified, nobody to speak of
+	assert.Equal(t, "", certIdentity(nil))
+	assert.Equal(t, "", certIdentity(&tls.ConnectionState{}))
+}
+
+func TestTLSServing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCA := newTestCA(t, "servers")
+	clientCA := newTestCA(t, "clients")
+	cfg := writeTestCerts(t, dir, newTestServerCert(t, serverCA, "first"), clientCA)
+
+	certs, err := newCertReloader(cfg)
+	assert.Nil(t, err)
+
+	addr, stop := serveTestTLS(t, certs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientIdentity(r)))
+	}))
+	defer stop()
+
+	get := func(client *http.Client) (string, string, error) {
+		resp, err := client.Get(addr)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	// the client cert identity makes it through to handlers
+	clientCert := newTestClientCert(t, clientCA, &x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}}).tlsCert(t)
+	identity, served, err := get(testTLSClient(serverCA, &clientCert))
+	assert.Nil(t, err)
+	assert.Equal(t, "dashboard", identity)
+	assert.Equal(t, "first", served)
+
+	// mutual tls turns away clients without a cert, or with one from elsewhere
+	_, _, err = get(testTLSClient(serverCA, nil))
+	assert.NotNil(t, err)
+
+	stranger := newTestClientCert(t, newTestCA(t, "elsewhere"), &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}}).tlsCert(t)
+	_, _, err = get(testTLSClient(serverCA, &stranger))
+	assert.NotNil(t, err)
+
+	// a rotated cert is served to new connections without a restart
+	reloads := testutil.ToFloat64(tlsReloads.WithLabelValues("success"))
+	writeTestCerts(t, dir, newTestServerCert(t, serverCA, "second"), clientCA)
+	certs.check()
+	assert.Equal(t, reloads+1, testutil.ToFloat64(tlsReloads.WithLabelValues("success")))
+
+	_, served, err = get(testTLSClient(serverCA, &clientCert))
+	assert.Nil(t, err)
+	assert.Equal(t, "second", served)
+
+	// a broken cert is ignored and the last good one stays
+	assert.Nil(t, ioutil.WriteFile(cfg.certFile, []byte("not a cert"), 0600))
+	certs.check()
+	_, served, err = get(testTLSClient(serverCA, &clientCert))
+	assert.Nil(t, err)
+	assert.Equal(t, "second", served)
+}
+
+func TestTLSVerifyIfGiven(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "ca")
+	cfg := writeTestCerts(t, dir, newTestServerCert(t, ca, "server"), ca)
+	cfg.clientAuth = "verify_if_given"
+
+	certs, err := newCertReloader(cfg)
+	assert.Nil(t, err)
+
+	addr, stop := serveTestTLS(t, certs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientIdentity(r)))
+	}))
+	defer stop()
+
+	// no cert is fine, there just isn't an identity
+	resp, err := testTLSClient(ca, nil).Get(addr)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "", string(body))
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "ca")
+	cfg := writeTestCerts(t, dir, newTestServerCert(t, ca, "server"), nil)
+
+	cfg.clientCAFile = filepath.Join(dir, "bad-ca.crt")
+	assert.Nil(t, ioutil.WriteFile(cfg.clientCAFile, []byte("nope"), 0600))
+	_, err = newCertReloader(cfg)
+	assert.EqualError(t, err, "Recieved invalid tls.client_ca_file: "+cfg.clientCAFile+". Hint: one or more PEM encoded CA certificates")
+
+	cfg.keyFile = filepath.Join(dir, "missing.key")
+	_, err = newCertReloader(cfg)
+	assert.Contains(t, err.Error(), "Could not load TLS certificate: open "+cfg.keyFile)
+}
+
+func TestGRPCOverMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "ca")
+	certs, err := newCertReloader(writeTestCerts(t, dir, newTestServerCert(t, ca, "server"), ca))
+	assert.Nil(t, err)
+
+	s := newGRPCServer(grpc.Creds(credentials.NewTLS(certs.serverConfig())))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	clientCert := newTestClientCert(t, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}}).tlsCert(t)
+	creds := credentials.NewTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	logs, restore := captureLogs()
+	defer restore()
+
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	// the client identity shows up in the logs
+	assert.Contains(t, logs.String(), "/grpc.health.v1.Health/Check")
+	assert.Contains(t, logs.String(), "dashboard")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ------------------------------ V2 API ------------------------------
+
+// Struct that represents a repo in a /v2/stars response.
+// Stars and Error are null when they don't apply instead of -1 and "<nil>"
+type RepoV2 struct {
+	Name   string  `json:"name"`
+	Stars  *int    `json:"stars"`
+	Status string  `json:"status"`
+	Error  *string `json:"error"`
+}
+
+// Struct that represents a /v2/stars response
+type ReposV2 struct {
+	Repos []RepoV2 `json:"repos"`
+}
+
+// shape a lookup result for the v2 api
+func newRepoV2(res repoResult) RepoV2 {
+	repo := RepoV2{Name: res.Name, Status: lookupStatus(res.Err)}
+
+	if res.Err != nil {
+		msg := res.Err.Error()
+		repo.Error = &msg
+	} else {
+		stars := res.Stars
+		repo.Stars = &stars
+	}
+
+	return repo
+}
+
+// HTTP route to handle v2 stars requests. Takes the same body as /stars
+func starsV2Handler(w http.ResponseWriter, r *http.Request) {
+
+	starsApiReqAll.Inc()
+
+	// Ensure this handler can only be called from /v2/stars route
+	if r.URL.Path != "/v2/stars" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure POST is the only method used
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	// stream results as they finish if the client asked for it
+	if format := streamFormat(r); format != "" {
+		streamStars(w, r, format)
+		return
+	}
+
+	// Read and validate body
+	names, ok := readRepoNames(w, r, currentLimits().maxRepos)
+
+	if !ok {
+		return
+	}
+
+	res := ReposV2{Repos: make([]RepoV2, 0, len(names))}
+	for _, result := range fetchRepos(names) {
+		res.Repos = append(res.Repos, newRepoV2(result))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+	starsApiReq200.Inc()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupStatus(t *testing.T) {
+	assert.Equal(t, StatusOK, lookupStatus(nil))
+	assert.Equal(t, StatusNotFound, lookupStatus(&lookupError{StatusNotFound, errors.New("x")}))
+	assert.Equal(t, StatusUpstreamError, lookupStatus(errors.New("x")))
+}
+
+func TestNewRepoV2(t *testing.T) {
+	stars := 1
+	assert.Equal(t,
+		RepoV2{Name: "rdelpret/kfx", Stars: &stars, Status: StatusOK},
+		newRepoV2(repoResult{Name: "rdelpret/kfx", Stars: 1}))
+
+	msg := "Recieved invalid repo name: invalid"
+	assert.Equal(t,
+		RepoV2{Name: "invalid", Status: StatusInvalid, Error: &msg},
+		newRepoV2(repoResult{Name: "invalid", Stars: -1, Err: &lookupError{StatusInvalid, errors.New(msg)}}))
+}
+
+func TestStarsV2Handler(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+
+	// test happy path
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(starsV2Handler)
+
+	json := []byte(`{"repos": [{"name": "rdelpret/cartographer"}, {"name": "rdelpret/kfx"}]}`)
+
+	req, err := http.NewRequest("POST", "/v2/stars", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	expected := `{"repos":[{"name":"rdelpret/cartographer","stars":1,"status":"ok","error":null},` +
+		`{"name":"rdelpret/kfx","stars":1,"status":"ok","error":null}]}` + "\n"
+	assert.Equal(t, expected, recorder.Body.String())
+
+	// invalid repos reject the whole request
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", bytes.NewBuffer([]byte(`{"repos": [{"name": "rdelpret/cartographer"}, {"name": "invalid"}]}`)))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, `{"error":"Invalid Request.","errors":[{"index":1,"name":"invalid","error":"Recieved invalid repo name: invalid"}]}`+"\n", recorder.Body.String())
+
+	// missing repos are not_found
+	mockGithubAPI(`{}`, 404)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", bytes.NewBuffer([]byte(`{"repos": [{"name": "rdelpret/missing"}]}`)))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, `{"repos":[{"name":"rdelpret/missing","stars":null,"status":"not_found","error":"Repo Not found: rdelpret/missing"}]}`+"\n", recorder.Body.String())
+
+	// other upstream failures are upstream_error
+	mockGithubAPI(`{}`, 403)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", bytes.NewBuffer([]byte(`{"repos": [{"name": "rdelpret/limited"}]}`)))
+	handler.ServeHTTP(recorder, req)
+	assert.Contains(t, recorder.Body.String(), `"status":"upstream_error"`)
+
+	// empty request gets an empty list, not null
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", bytes.NewBuffer([]byte(`{}`)))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, "{\"repos\":[]}\n", recorder.Body.String())
+
+	// test malformed json
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v2/stars", bytes.NewBuffer([]byte(`{"repos": [{"name" "rdelpret/cartographer"}]}`)))
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Malformed Request.\n", recorder.Body.String())
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v2/stars", nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/wrongroute", nil)
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
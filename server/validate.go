@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---------------------------- VALIDATION ----------------------------
+
+// How big a request we are willing to take on
+type requestLimits struct {
+	// largest request body in bytes
+	maxBytes int64
+	// most repos in one /stars or /v2/stars request
+	maxRepos int
+	// most repos in one job, jobs exist for the big lookups so this is higher
+	maxJobRepos int
+	// reject unknown json fields instead of ignoring them
+	strict bool
+}
+
+var defaultRequestLimits = requestLimits{
+	maxBytes:    1 << 20,
+	maxRepos:    1000,
+	maxJobRepos: 10000,
+	strict:      false,
+}
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// too many repos in one request
+type tooManyReposError struct {
+	limit int
+}
+
+func (e *tooManyReposError) Error() string {
+	return "Too many repos. Limit is " + strconv.Itoa(e.limit) + " per request"
+}
+
+// Reader that fails with errRequestTooLarge once more than remaining
+// bytes come through, so we never buffer more than the limit
+type limitedBody struct {
+	r         io.Reader
+	remaining int64
+}
+
+func newLimitedBody(r io.Reader) *limitedBody {
+	return &limitedBody{r: r, remaining: currentLimits().maxBytes}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// read one byte past the limit so we can tell if there is more
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.r.Read(p)
+
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, errRequestTooLarge
+	}
+
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// Struct that represents a repo in a request. Only used for decoding
+// so strict mode can tell the response only fields apart
+type repoRequest struct {
+	Name string `json:"name"`
+}
+
+type starsRequest struct {
+	Repos []repoRequest `json:"repos"`
+}
+
+// Problem with one repo in a request. Index is the repo's position in the request
+type validationError struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Body of a 422 response
+type validationErrors struct {
+	Error  string            `json:"error"`
+	Errors []validationError `json:"errors"`
+}
+
+// check a repo name without looking it up
+func validateRepoName(name string) error {
+	if name == "" {
+		return errors.New("Missing repo name. Hint: <org>/<repo-name>")
+	}
+
+	_, err := assembleURL(name)
+	return err
+}
+
+// check every repo in a request, returning every problem rather than just the first
+func validateRepoNames(names []string) []validationError {
+	var errs []validationError
+
+	for i, name := range names {
+		err := validateRepoName(name)
+		if err != nil {
+			errs = append(errs, validationError{Index: i, Name: name, Error: err.Error()})
+		}
+	}
+
+	return errs
+}
+
+// decode a stars request, rejecting unknown fields in strict mode
+func decodeStarsRequest(body []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if currentLimits().strict {
+		dec.DisallowUnknownFields()
+	}
+
+	var req starsRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	// same as json.Unmarshal, nothing allowed after the body
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after request body")
+	}
+
+	names := make([]string, len(req.Repos))
+	for i, repo := range req.Repos {
+		names[i] = repo.Name
+	}
+
+	return names, nil
+}
+
+// answer a request we couldn't read with the right status code
+func writeRequestError(w http.ResponseWriter, err error) {
+	var tooMany *tooManyReposError
+	var quota *quotaExceededError
+
+	switch {
+	case errors.Is(err, errRequestTooLarge):
+		http.Error(w, "Request Too Large.", http.StatusRequestEntityTooLarge)
+	case errors.As(err, &tooMany):
+		http.Error(w, tooMany.Error()+".", http.StatusRequestEntityTooLarge)
+	case errors.As(err, &quota):
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(quota.reset).Seconds())+1))
+		http.Error(w, quota.Error()+".", http.StatusTooManyRequests)
+	default:
+		http.Error(w, "Malformed Request.", http.StatusBadRequest)
+	}
+
+	log.Println(err)
+}
+
+// answer a request with bad repos in it, listing every problem
+func writeValidationErrors(w http.ResponseWriter, errs []validationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(validationErrors{Error: "Invalid Request.", Errors: errs})
+}
+
+// Read and check the repo names in a stars request, answering the client
+// ourselves if anything is wrong. Returns false if the request was rejected
+func readRepoNames(w http.ResponseWriter, r *http.Request, maxRepos int) ([]string, bool) {
+
+	// don't bother reading a body we already know is too big
+	if r.ContentLength > currentLimits().maxBytes {
+		writeRequestError(w, errRequestTooLarge)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(newLimitedBody(r.Body))
+
+	if err != nil {
+		writeRequestError(w, err)
+		return nil, false
+	}
+
+	names, err := decodeStarsRequest(body)
+
+	if err != nil {
+		writeRequestError(w, err)
+		return nil, false
+	}
+
+	if len(names) > maxRepos {
+		writeRequestError(w, &tooManyReposError{maxRepos})
+		return nil, false
+	}
+
+	if errs := validateRepoNames(names); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return nil, false
+	}
+
+	// every repo is a lookup against the caller's quota
+	if !chargeRequest(w, r, len(names)) {
+		return nil, false
+	}
+
+	return names, true
+}
+
+// replaced in main once the environment is loaded
+var limits = defaultRequestLimits
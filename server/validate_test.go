@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitedBody(t *testing.T) {
+	defer func() { limits = defaultRequestLimits }()
+	limits.maxBytes = 5
+
+	body, err := ioutil.ReadAll(newLimitedBody(strings.NewReader("12345")))
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", string(body))
+
+	body, err = ioutil.ReadAll(newLimitedBody(strings.NewReader("123456")))
+	assert.Equal(t, errRequestTooLarge, err)
+	assert.Equal(t, "12345", string(body))
+}
+
+func TestValidateRepoNames(t *testing.T) {
+	assert.Nil(t, validateRepoNames([]string{"rdelpret/kfx", "gitlab:group/subgroup/project"}))
+
+	assert.Equal(t, []validationError{
+		{Index: 1, Name: "", Error: "Missing repo name. Hint: <org>/<repo-name>"},
+		{Index: 2, Name: "invalid", Error: "Recieved invalid repo name: invalid"},
+		{Index: 3, Name: "bitbucket:a/b", Error: "Recieved unknown provider: bitbucket"},
+	}, validateRepoNames([]string{"rdelpret/kfx", "", "invalid", "bitbucket:a/b"}))
+}
+
+func TestDecodeStarsRequest(t *testing.T) {
+	defer func() { limits = defaultRequestLimits }()
+
+	body := []byte(`{"repos": [{"name": "a/b", "Stars": 1}], "other": true}`)
+
+	names, err := decodeStarsRequest(body)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/b"}, names)
+
+	_, err = decodeStarsRequest([]byte(`{"repos": []} {}`))
+	assert.EqualError(t, err, "unexpected data after request body")
+
+	// strict mode only takes the fields we document
+	limits.strict = true
+
+	_, err = decodeStarsRequest(body)
+	assert.EqualError(t, err, `json: unknown field "Stars"`)
+
+	names, err = decodeStarsRequest([]byte(`{"repos": [{"name": "a/b"}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/b"}, names)
+}
+
+func TestStarsHandlerLimits(t *testing.T) {
+
+	close := mockGithubAPI(`{"stargazers_count" : 1}`, 200)
+	defer close()
+	defer func() { limits = defaultRequestLimits }()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/stars", bytes.NewBufferString(body))
+		http.HandlerFunc(starsHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// every bad repo is reported with its position
+	recorder := post(`{"repos": [{"name": "rdelpret/kfx"}, {"name": ""}, {"name": "invalid"}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var res validationErrors
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	assert.Equal(t, "Invalid Request.", res.Error)
+	assert.Equal(t, []validationError{
+		{Index: 1, Name: "", Error: "Missing repo name. Hint: <org>/<repo-name>"},
+		{Index: 2, Name: "invalid", Error: "Recieved invalid repo name: invalid"},
+	}, res.Errors)
+
+	// too many repos
+	limits.maxRepos = 1
+	recorder = post(`{"repos": [{"name": "rdelpret/kfx"}, {"name": "rdelpret/cartographer"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, "Too many repos. Limit is 1 per request.\n", recorder.Body.String())
+
+	// body too big
+	limits.maxBytes = 10
+	recorder = post(`{"repos": [{"name": "rdelpret/kfx"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, "Request Too Large.\n", recorder.Body.String())
+
+	// unknown fields are fine unless we are in strict mode
+	limits = defaultRequestLimits
+	recorder = post(`{"repos": [{"name": "rdelpret/kfx"}], "extra": 1}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	limits.strict = true
+	recorder = post(`{"repos": [{"name": "rdelpret/kfx"}], "extra": 1}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Malformed Request.\n", recorder.Body.String())
+}
+
+func TestJobsHandlerLimits(t *testing.T) {
+	defer func() { limits = defaultRequestLimits }()
+
+	// jobs get their own, higher, repo limit
+	limits.maxRepos = 1
+	limits.maxJobRepos = 2
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jobs", bytes.NewBufferString(`{"repos": [{"name": "a/b"}, {"name": "c/d"}, {"name": "e/f"}]}`))
+	http.HandlerFunc(jobsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, "Too many repos. Limit is 2 per request.\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/jobs", bytes.NewBufferString(`{"repos": [{"name": "a/b"}, {"name": "invalid"}]}`))
+	http.HandlerFunc(jobsHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+}
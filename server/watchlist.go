@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------ WATCHLIST ------------------------------
+
+const watchPrefix = "watchlist/"
+
+// a count the poller saw
+type watchSample struct {
+	Stars int       `json:"stars"`
+	At    time.Time `json:"at"`
+}
+
+// A repo the server polls on its own, with the alert rules to check
+// after every poll
+type watchEntry struct {
+	Name   string      `json:"name"`
+	Alerts []alertRule `json:"alerts"`
+	// -1 until the first successful poll
+	Stars    int        `json:"stars"`
+	PolledAt *time.Time `json:"polled_at,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// What goes in the store for an entry. Fired state lives next to the
+// entry so a restart, or another replica on the same store, doesn't
+// send the same alert again
+type storedWatchEntry struct {
+	watchEntry
+	// polls from the last day, and the one before that, for daily gains
+	Samples []watchSample `json:"samples,omitempty"`
+	// rules that already fired, daily gains map to the day they fired on
+	Fired map[string]string `json:"fired,omitempty"`
+}
+
+// an alert waiting to be sent, marked fired once it is delivered
+type pendingAlert struct {
+	key   string
+	day   string
+	alert Alert
+}
+
+// The watchlist itself is in the store, mu only keeps this replica's
+// read, change, write of an entry from racing with itself
+type watchlist struct {
+	mu     sync.Mutex
+	alerts *alertWebhook
+
+	stopOnce sync.Once
+	stopping chan struct{}
+	// closed when run returns
+	done chan struct{}
+}
+
+func newWatchlist(alerts *alertWebhook) *watchlist {
+	return &watchlist{alerts: alerts, stopping: make(chan struct{})}
+}
+
+// github names are case insensitive so the watchlist is too
+func watchKey(name string) string {
+	return watchPrefix + strings.ToLower(name)
+}
+
+// an entry from the store, nil if there isn't one
+func loadWatchEntry(name string) (*storedWatchEntry, error) {
+	body, ok, err := store.Get(watchKey(name))
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var entry storedWatchEntry
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func saveWatchEntry(entry *storedWatchEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return store.Put(watchKey(entry.Name), body)
+}
+
+// Add a repo or replace its rules. Rules that stay keep their fired
+// state so changing the list doesn't resend old alerts
+func (w *watchlist) add(name string, rules []alertRule) (watchEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry, err := loadWatchEntry(name)
+	if err != nil {
+		return watchEntry{}, err
+	}
+	if entry == nil {
+		entry = &storedWatchEntry{watchEntry: watchEntry{Name: name, Stars: -1}}
+	}
+
+	if rules == nil {
+		rules = []alertRule{}
+	}
+	entry.Alerts = rules
+	kept := make(map[string]string)
+	for _, rule := range rules {
+		if day, ok := entry.Fired[rule.String()]; ok {
+			kept[rule.String()] = day
+		}
+	}
+	entry.Fired = kept
+
+	err = saveWatchEntry(entry)
+	if err != nil {
+		return watchEntry{}, err
+	}
+
+	return entry.watchEntry, nil
+}
+
+func (w *watchlist) remove(name string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry, err := loadWatchEntry(name)
+	if err != nil || entry == nil {
+		return false, err
+	}
+
+	return true, store.Delete(watchKey(name))
+}
+
+func (w *watchlist) get(name string) (*watchEntry, error) {
+	entry, err := loadWatchEntry(name)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return &entry.watchEntry, nil
+}
+
+// every entry, sorted by name
+func (w *watchlist) list() ([]watchEntry, error) {
+	stored, err := store.List(watchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]watchEntry, 0, len(stored))
+	for _, body := range stored {
+		var entry storedWatchEntry
+		err = json.Unmarshal(body, &entry)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		entries = append(entries, entry.watchEntry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return watchKey(entries[i].Name) < watchKey(entries[j].Name) })
+	return entries, nil
+}
+
+// Poll every watched repo once and send whatever alerts fire. Repos are
+// looked up one at a time so a long watchlist doesn't hit github in a burst
+func (w *watchlist) poll() {
+	entries, err := w.list()
+	if err != nil {
+		log.Printf("Could not read the watchlist: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		select {
+		case <-w.stopping:
+			return
+		default:
+		}
+
+		stars, err := GetStars(Repo{Name: entry.Name})
+		pending, err := w.record(entry.Name, stars, err, time.Now().UTC())
+		if err != nil {
+			log.Printf("Could not record poll of %s: %v", entry.Name, err)
+			continue
+		}
+
+		for _, p := range pending {
+			err := w.alerts.send(p.alert)
+			if err != nil {
+				// left unfired, the next poll tries again
+				log.Println(err)
+				continue
+			}
+
+			err = w.markFired(entry.Name, p.key, p.day)
+			if err != nil {
+				log.Printf("Alert for %s was sent but could not be marked fired: %v", entry.Name, err)
+			}
+		}
+	}
+}
+
+// Record a poll and check the entry's rules against it, returning the
+// alerts that should go out
+func (w *watchlist) record(name string, stars int, pollErr error, now time.Time) ([]pendingAlert, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// removed while we were polling
+	entry, err := loadWatchEntry(name)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	entry.PolledAt = &now
+	if pollErr != nil {
+		entry.Error = pollErr.Error()
+		return nil, saveWatchEntry(entry)
+	}
+	entry.Error = ""
+
+	previous := entry.Stars
+	entry.Stars = stars
+	entry.Samples = append(entry.Samples, watchSample{Stars: stars, At: now})
+
+	// keep the last sample from before the window as the baseline
+	start := now.Add(-24 * time.Hour)
+	for len(entry.Samples) > 1 && !entry.Samples[1].At.After(start) {
+		entry.Samples = entry.Samples[1:]
+	}
+
+	err = saveWatchEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []pendingAlert
+	day := now.Format("2006-01-02")
+
+	for _, rule := range entry.Alerts {
+		alert := Alert{Repo: entry.Name, Rule: rule.String(), Kind: rule.kind, Threshold: rule.stars, Stars: stars, PreviousStars: previous, Time: now}
+
+		switch rule.kind {
+		case alertMilestone:
+			// a repo already past the milestone when it is added fires
+			// on its first poll
+			if _, fired := entry.Fired[rule.String()]; fired || stars < rule.stars {
+				continue
+			}
+			pending = append(pending, pendingAlert{key: rule.String(), alert: alert})
+
+		case alertDailyGains:
+			baseline := entry.Samples[0]
+			if entry.Fired[rule.String()] == day || stars-baseline.Stars <= rule.stars {
+				continue
+			}
+			alert.PreviousStars = baseline.Stars
+			pending = append(pending, pendingAlert{key: rule.String(), day: day, alert: alert})
+		}
+	}
+
+	return pending, nil
+}
+
+func (w *watchlist) markFired(name string, key string, day string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry, err := loadWatchEntry(name)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	if entry.Fired == nil {
+		entry.Fired = make(map[string]string)
+	}
+	entry.Fired[key] = day
+	return saveWatchEntry(entry)
+}
+
+// poll every interval in the background until stop is called
+func (w *watchlist) start(interval time.Duration) {
+	w.done = make(chan struct{})
+	go w.run(interval)
+}
+
+func (w *watchlist) run(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.poll()
+
+		select {
+		case <-ticker.C:
+		case <-w.stopping:
+			return
+		}
+	}
+}
+
+// Stop polling and wait for a poll that is already going to finish, so
+// nothing is written to the store after it is flushed
+func (w *watchlist) stop(ctx context.Context) error {
+	w.stopOnce.Do(func() { close(w.stopping) })
+
+	// never started, ie in tests
+	if w.done == nil {
+		return nil
+	}
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Struct that represents a POST /watchlist request
+type watchRequest struct {
+	Name   string      `json:"name"`
+	Alerts []alertRule `json:"alerts"`
+}
+
+// HTTP route to list, add and remove watched repos
+//
+//	GET /watchlist                    every entry
+//	POST /watchlist                   add a repo or replace its rules
+//	GET /watchlist/{owner}/{repo}     one entry
+//	DELETE /watchlist/{owner}/{repo}  stop watching a repo
+func watchlistHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path == "/watchlist" {
+		switch r.Method {
+		case "GET":
+			entries, err := watched.list()
+			if err != nil {
+				http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			writeWatchlist(w, http.StatusOK, entries)
+		case "POST":
+			addToWatchlist(w, r)
+		default:
+			http.Error(w, "Method is not supported.", http.StatusNotFound)
+		}
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/watchlist/")
+	if !strings.HasPrefix(r.URL.Path, "/watchlist/") || name == "" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		entry, err := watched.get(name)
+		if err != nil {
+			http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if entry == nil {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+		writeWatchlist(w, http.StatusOK, entry)
+	case "DELETE":
+		ok, err := watched.remove(name)
+		if err != nil {
+			http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !ok {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
+
+func addToWatchlist(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, "Malformed Request.", http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	var req watchRequest
+	err = json.Unmarshal(body, &req)
+
+	if err != nil {
+		// bad rules say what was wrong with them
+		if strings.HasPrefix(err.Error(), "Recieved invalid alert rule") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Malformed Request.", http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	_, err = assembleURL(req.Name)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := watched.add(req.Name, req.Alerts)
+
+	if err != nil {
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	writeWatchlist(w, http.StatusOK, entry)
+}
+
+func writeWatchlist(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+var watched = newWatchlist(newAlertWebhook("", ""))
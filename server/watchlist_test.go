@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to point the watchlist's alerts at a test receiver and collect them
+func alertReceiver(code *int) (*alertWebhook, *[]Alert, func()) {
+	var received []Alert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		json.NewDecoder(r.Body).Decode(&alert)
+		if *code < 300 {
+			received = append(received, alert)
+		}
+		w.WriteHeader(*code)
+	}))
+	return newAlertWebhook(ts.URL, "secret"), &received, ts.Close
+}
+
+// helper to drop the error from record in the middle of an assert
+func pending(alerts []pendingAlert, err error) []pendingAlert {
+	if err != nil {
+		panic(err)
+	}
+	return alerts
+}
+
+func TestWatchlistMilestones(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	code := http.StatusOK
+	hook, received, closeHook := alertReceiver(&code)
+	defer closeHook()
+
+	close := mockGithubAPI(`{"stargazers_count" : 999}`, 200)
+	defer close()
+
+	w := newWatchlist(hook)
+	w.add("rdelpret/cartographer", []alertRule{{kind: alertMilestone, stars: 1000}, {kind: alertMilestone, stars: 10000}})
+
+	w.poll()
+	assert.Empty(t, *received)
+
+	mockGithubAPI(`{"stargazers_count" : 1001}`, 200)
+	w.poll()
+	assert.Len(t, *received, 1)
+	assert.Equal(t, "rdelpret/cartographer", (*received)[0].Repo)
+	assert.Equal(t, "1000", (*received)[0].Rule)
+	assert.Equal(t, 999, (*received)[0].PreviousStars)
+	assert.Equal(t, 1001, (*received)[0].Stars)
+	*received = nil
+
+	// dipping back under and crossing again doesn't fire twice
+	mockGithubAPI(`{"stargazers_count" : 998}`, 200)
+	w.poll()
+	mockGithubAPI(`{"stargazers_count" : 1002}`, 200)
+	w.poll()
+	assert.Empty(t, *received)
+
+	entry, err := w.get("Rdelpret/Cartographer")
+	assert.Nil(t, err)
+	assert.Equal(t, 1002, entry.Stars)
+	assert.NotNil(t, entry.PolledAt)
+}
+
+func TestWatchlistAddedPastMilestone(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	code := http.StatusOK
+	hook, received, closeHook := alertReceiver(&code)
+	defer closeHook()
+
+	close := mockGithubAPI(`{"stargazers_count" : 90000}`, 200)
+	defer close()
+
+	// already past 1k and 10k when it is added, so both fire on the first poll
+	w := newWatchlist(hook)
+	w.add("kubernetes/kubernetes", []alertRule{{kind: alertMilestone, stars: 1000}, {kind: alertMilestone, stars: 10000}, {kind: alertMilestone, stars: 100000}})
+
+	w.poll()
+	assert.Len(t, *received, 2)
+	assert.Equal(t, -1, (*received)[0].PreviousStars)
+
+	w.poll()
+	assert.Len(t, *received, 2)
+}
+
+func TestWatchlistRetriesFailedAlerts(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	code := http.StatusInternalServerError
+	hook, received, closeHook := alertReceiver(&code)
+	defer closeHook()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1500}`, 200)
+	defer close()
+
+	w := newWatchlist(hook)
+	w.add("rdelpret/cartographer", []alertRule{{kind: alertMilestone, stars: 1000}})
+
+	w.poll()
+	assert.Empty(t, *received)
+
+	// still unfired, so the next poll sends it
+	code = http.StatusOK
+	w.poll()
+	assert.Len(t, *received, 1)
+
+	w.poll()
+	assert.Len(t, *received, 1)
+
+	// replacing the rules keeps the ones that already fired
+	w.add("rdelpret/cartographer", []alertRule{{kind: alertMilestone, stars: 1000}, {kind: alertMilestone, stars: 1500}})
+	w.poll()
+	assert.Len(t, *received, 2)
+	assert.Equal(t, "1500", (*received)[1].Rule)
+}
+
+func TestWatchlistKeptInStore(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	code := http.StatusOK
+	hook, received, closeHook := alertReceiver(&code)
+	defer closeHook()
+
+	close := mockGithubAPI(`{"stargazers_count" : 1500}`, 200)
+	defer close()
+
+	w := newWatchlist(hook)
+	w.add("rdelpret/cartographer", []alertRule{{kind: alertMilestone, stars: 1000}})
+	w.poll()
+	assert.Len(t, *received, 1)
+
+	// a restart, or another replica on the same store, sees the entry
+	// and doesn't send the alert again
+	restarted := newWatchlist(hook)
+	entries, err := restarted.list()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 1500, entries[0].Stars)
+
+	restarted.poll()
+	assert.Len(t, *received, 1)
+}
+
+func TestWatchlistStop(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	w := newWatchlist(newAlertWebhook("", ""))
+	assert.Nil(t, w.stop(context.Background()))
+
+	w = newWatchlist(newAlertWebhook("", ""))
+	w.start(time.Hour)
+	assert.Nil(t, w.stop(context.Background()))
+	assert.Nil(t, w.stop(context.Background()))
+}
+
+func TestWatchlistDailyGains(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	w := newWatchlist(newAlertWebhook("", ""))
+	w.add("rdelpret/cartographer", []alertRule{{kind: alertDailyGains, stars: 100}})
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.Empty(t, pending(w.record("rdelpret/cartographer", 500, nil, now.Add(-30*time.Hour))))
+	assert.Empty(t, pending(w.record("rdelpret/cartographer", 550, nil, now.Add(-25*time.Hour))))
+	assert.Empty(t, pending(w.record("rdelpret/cartographer", 600, nil, now.Add(-2*time.Hour))))
+
+	// counts from the last poll a day or more ago
+	assert.Empty(t, pending(w.record("rdelpret/cartographer", 650, nil, now)))
+
+	alerts, err := w.record("rdelpret/cartographer", 651, nil, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, "+100/day", alerts[0].alert.Rule)
+	assert.Equal(t, 550, alerts[0].alert.PreviousStars)
+	assert.Equal(t, 651, alerts[0].alert.Stars)
+
+	// once it is delivered it waits for tomorrow
+	assert.Nil(t, w.markFired("rdelpret/cartographer", alerts[0].key, alerts[0].day))
+	assert.Empty(t, pending(w.record("rdelpret/cartographer", 800, nil, now.Add(2*time.Minute))))
+	assert.Len(t, pending(w.record("rdelpret/cartographer", 1000, nil, now.Add(13*time.Hour))), 1)
+
+	// failed polls keep the last count
+	assert.Empty(t, pending(w.record("rdelpret/cartographer", -1, os.ErrNotExist, now.Add(14*time.Hour))))
+	entry, _ := w.get("rdelpret/cartographer")
+	assert.Equal(t, 1000, entry.Stars)
+	assert.Equal(t, os.ErrNotExist.Error(), entry.Error)
+}
+
+func TestWatchlistHandler(t *testing.T) {
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	defer func() { watched = newWatchlist(newAlertWebhook("", "")) }()
+	watched = newWatchlist(newAlertWebhook("", ""))
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		http.HandlerFunc(watchlistHandler).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := serve("POST", "/watchlist", `{"name": "rdelpret/cartographer", "alerts": ["1k", "10k", "+100/day"]}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"name":"rdelpret/cartographer","alerts":["1000","10000","+100/day"],"stars":-1}`+"\n", recorder.Body.String())
+
+	recorder = serve("GET", "/watchlist", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `[{"name":"rdelpret/cartographer","alerts":["1000","10000","+100/day"],"stars":-1}]`+"\n", recorder.Body.String())
+
+	recorder = serve("GET", "/watchlist/rdelpret/cartographer", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = serve("POST", "/watchlist", `{"name": "rdelpret/cartographer", "alerts": ["lots"]}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Recieved invalid alert rule: lots. Hint: 1k, 10k, 25000 or +100/day\n", recorder.Body.String())
+
+	recorder = serve("POST", "/watchlist", `{"name": "invalid"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Recieved invalid repo name: invalid\n", recorder.Body.String())
+
+	recorder = serve("POST", "/watchlist", `{"name" "invalid"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Malformed Request.\n", recorder.Body.String())
+
+	recorder = serve("DELETE", "/watchlist/rdelpret/cartographer", "")
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	recorder = serve("DELETE", "/watchlist/rdelpret/cartographer", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = serve("PUT", "/watchlist", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	recorder = serve("GET", "/wrongroute", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}
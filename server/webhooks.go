@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ------------------------- OUTBOUND WEBHOOKS -------------------------
+
+const starChangedEvent = "star.changed"
+
+// Event sent to webhook receivers when a repo's star count changes
+type StarEvent struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Repo          string    `json:"repo"`
+	Stars         int       `json:"stars"`
+	PreviousStars int       `json:"previous_stars"`
+	Time          time.Time `json:"time"`
+}
+
+// CloudEvents 1.0 structured mode envelope around a StarEvent
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            StarEvent `json:"data"`
+}
+
+// One attempt at delivering an event, kept for the delivery log
+type Delivery struct {
+	EventID    string    `json:"event_id"`
+	Repo       string    `json:"repo"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+	Duration   string    `json:"duration"`
+}
+
+// An event we gave up on, kept in the store until it is replayed
+type deadLetter struct {
+	Event    StarEvent `json:"event"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+const deadLetterPrefix = "deadletter/"
+
+// how many deliveries we keep around for /webhooks/deliveries
+const deliveryLogSize = 100
+
+type webhookDispatcher struct {
+	url         string
+	secret      string
+	format      string
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	queue       chan StarEvent
+	// closed when the worker has drained the queue after a stop
+	done chan struct{}
+	// cancelled when a stop runs out of time, anything undelivered goes
+	// to the dead letters instead of waiting on retries
+	ctx  context.Context
+	halt context.CancelFunc
+
+	mu         sync.Mutex
+	deliveries []Delivery
+	stopped    bool
+}
+
+func newWebhookDispatcher(url string, secret string, format string) *webhookDispatcher {
+	ctx, halt := context.WithCancel(context.Background())
+	return &webhookDispatcher{
+		url:         url,
+		secret:      secret,
+		format:      format,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 5,
+		backoff:     time.Second,
+		queue:       make(chan StarEvent, 100),
+		ctx:         ctx,
+		halt:        halt,
+	}
+}
+
+// generate a random id for events
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newStarEvent(repo string, previous int, stars int) StarEvent {
+	return StarEvent{
+		ID:            newEventID(),
+		Type:          starChangedEvent,
+		Repo:          repo,
+		Stars:         stars,
+		PreviousStars: previous,
+		Time:          time.Now().UTC(),
+	}
+}
+
+// Hand an event to the background worker. Never blocks a request,
+// if the queue is backed up the event goes straight to the dead letters
+func (d *webhookDispatcher) emit(event StarEvent) {
+
+	// held while sending so stop can't close the queue under us
+	d.mu.Lock()
+	if d.url == "" {
+		d.mu.Unlock()
+		return
+	}
+
+	var err error
+	if d.stopped {
+		err = errWebhooksStopped
+	} else {
+		select {
+		case d.queue <- event:
+		default:
+			err = errors.New("delivery queue full")
+		}
+	}
+	d.mu.Unlock()
+
+	if err != nil {
+		d.deadLetter(event, err)
+	}
+}
+
+// change where events go and how they are signed. Deliveries already
+// being retried keep the settings they started with
+func (d *webhookDispatcher) configure(url string, secret string, format string) {
+	d.mu.Lock()
+	d.url, d.secret, d.format = url, secret, format
+	d.mu.Unlock()
+}
+
+// where events go, how they are signed and what they look like
+func (d *webhookDispatcher) target() (string, string, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.url, d.secret, d.format
+}
+
+// events that show up after a stop or don't make it out before one ends
+var errWebhooksStopped = errors.New("server shutting down")
+
+// start the background worker that drains the queue
+func (d *webhookDispatcher) start() {
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		for event := range d.queue {
+			if d.ctx.Err() != nil {
+				d.deadLetter(event, errWebhooksStopped)
+				continue
+			}
+			d.deliver(event)
+		}
+	}()
+}
+
+// Stop taking events and wait until ctx is done for the queue to drain.
+// Whatever is left after that is dead lettered so it can be replayed
+func (d *webhookDispatcher) stop(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	// never started, ie no WEBHOOK_URL
+	if d.done == nil {
+		return nil
+	}
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		d.halt()
+		<-d.done
+		return ctx.Err()
+	}
+}
+
+// build the request body and content type for an event
+func payload(event StarEvent, format string) ([]byte, string, error) {
+	if format == "cloudevents" {
+		body, err := json.Marshal(cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              event.ID,
+			Source:          "rainbow-road",
+			Type:            "com.rainbow-road." + event.Type,
+			Subject:         event.Repo,
+			Time:            event.Time,
+			DataContentType: "application/json",
+			Data:            event,
+		})
+		return body, "application/cloudevents+json", err
+	}
+
+	body, err := json.Marshal(event)
+	return body, "application/json", err
+}
+
+// HMAC-SHA256 signature of the body in the same sha256=<hex> form github uses
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver an event, retrying with exponential backoff on errors and
+// non-2xx responses. Events that never make it end up in the dead letters
+func (d *webhookDispatcher) deliver(event StarEvent) error {
+	url, secret, format := d.target()
+	body, contentType, err := payload(event, format)
+
+	if err != nil {
+		log.Println(err)
+		d.deadLetter(event, err)
+		return err
+	}
+
+	wait := d.backoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		err = d.send(event, attempt, url, secret, body, contentType)
+		if err == nil {
+			return nil
+		}
+
+		if attempt < d.maxAttempts {
+			select {
+			case <-time.After(wait):
+			case <-d.ctx.Done():
+				d.deadLetter(event, errWebhooksStopped)
+				return errWebhooksStopped
+			}
+			wait *= 2
+		}
+	}
+
+	log.Printf("giving up on webhook delivery %s after %d attempts: %v", event.ID, d.maxAttempts, err)
+	d.deadLetter(event, err)
+	return err
+}
+
+// make a single delivery attempt and record it in the delivery log
+func (d *webhookDispatcher) send(event StarEvent, attempt int, url string, secret string, body []byte, contentType string) error {
+	webhookDeliveriesAll.Inc()
+	start := time.Now()
+	delivery := Delivery{EventID: event.ID, Repo: event.Repo, Attempt: attempt, Time: start.UTC()}
+
+	err := func() error {
+		req, err := http.NewRequestWithContext(d.ctx, "POST", url, bytes.NewBuffer(body))
+
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("User-Agent", "rainbow-road")
+		req.Header.Set("X-Rainbow-Road-Event", event.Type)
+		req.Header.Set("X-Rainbow-Road-Delivery", event.ID)
+
+		// receivers verify this with the shared secret
+		if secret != "" {
+			req.Header.Set("X-Rainbow-Road-Signature-256", signPayload(secret, body))
+		}
+
+		resp, err := d.client.Do(req)
+
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		delivery.StatusCode = resp.StatusCode
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook receiver responded with %d", resp.StatusCode)
+		}
+
+		return nil
+	}()
+
+	delivery.Duration = time.Since(start).String()
+
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		webhookDeliveries2xx.Inc()
+	}
+
+	d.mu.Lock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > deliveryLogSize {
+		d.deliveries = d.deliveries[len(d.deliveries)-deliveryLogSize:]
+	}
+	d.mu.Unlock()
+
+	return err
+}
+
+// persist an event we could not deliver so it can be replayed later
+func (d *webhookDispatcher) deadLetter(event StarEvent, reason error) {
+	webhookDeadLetters.Inc()
+
+	body, err := json.Marshal(deadLetter{Event: event, Error: reason.Error(), FailedAt: time.Now().UTC()})
+
+	if err == nil {
+		err = store.Put(deadLetterPrefix+event.ID, body)
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// copy of the delivery log, oldest first
+func (d *webhookDispatcher) deliveryLog() []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Delivery{}, d.deliveries...)
+}
+
+// all dead letters in the store, oldest first
+func deadLetters() ([]deadLetter, error) {
+	entries, err := store.List(deadLetterPrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]deadLetter, 0, len(entries))
+	for _, body := range entries {
+		var letter deadLetter
+		err = json.Unmarshal(body, &letter)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+
+	return letters, nil
+}
+
+// take every dead letter out of the store and queue it up again
+func (d *webhookDispatcher) replayDeadLetters() (int, error) {
+	letters, err := deadLetters()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, letter := range letters {
+		err = store.Delete(deadLetterPrefix + letter.Event.ID)
+		if err != nil {
+			return 0, err
+		}
+		d.emit(letter.Event)
+	}
+
+	return len(letters), nil
+}
+
+// HTTP route to list recent webhook delivery attempts
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /webhooks/deliveries route
+	if r.URL.Path != "/webhooks/deliveries" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Delivery{"deliveries": webhooks.deliveryLog()})
+}
+
+// HTTP route to list events that could not be delivered
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /webhooks/dead-letters route
+	if r.URL.Path != "/webhooks/dead-letters" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure GET is the only method used
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	letters, err := deadLetters()
+
+	if err != nil {
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]deadLetter{"dead_letters": letters})
+}
+
+// HTTP route to redeliver everything in the dead letter queue
+func replayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Ensure this handler can only be called from /webhooks/dead-letters/replay route
+	if r.URL.Path != "/webhooks/dead-letters/replay" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// Ensure POST is the only method used
+	if r.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	if url, _, _ := webhooks.target(); url == "" {
+		http.Error(w, "Webhooks are not configured.", http.StatusConflict)
+		return
+	}
+
+	replayed, err := webhooks.replayDeadLetters()
+
+	if err != nil {
+		http.Error(w, "Internal Server Error.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"replayed": replayed})
+}
+
+// disabled until main loads the config
+var webhooks = newWebhookDispatcher("", "", "json")
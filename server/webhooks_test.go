@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper to get a dispatcher pointed at a test server that does not wait between retries
+func testDispatcher(url string, format string) *webhookDispatcher {
+	d := newWebhookDispatcher(url, "secret", format)
+	d.backoff = time.Millisecond
+	d.maxAttempts = 3
+	return d
+}
+
+func TestSignPayload(t *testing.T) {
+	// known value from the github webhook docs
+	assert.Equal(t,
+		"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+		signPayload("It's a Secret to Everybody", []byte("Hello, World!")))
+}
+
+func TestDeliver(t *testing.T) {
+
+	var received StarEvent
+	var signature string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-Rainbow-Road-Signature-256")
+		assert.Equal(t, signPayload("secret", body), signature)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	d := testDispatcher(ts.URL, "json")
+	event := newStarEvent("rdelpret/cartographer", 1, 2)
+
+	err := d.deliver(event)
+	assert.Nil(t, err)
+	assert.Equal(t, event.ID, received.ID)
+	assert.Equal(t, 2, received.Stars)
+	assert.Equal(t, 1, received.PreviousStars)
+
+	deliveries := d.deliveryLog()
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, http.StatusNoContent, deliveries[0].StatusCode)
+}
+
+func TestDeliverCloudEvents(t *testing.T) {
+
+	var received cloudEvent
+	var contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer ts.Close()
+
+	d := testDispatcher(ts.URL, "cloudevents")
+	event := newStarEvent("rdelpret/cartographer", 1, 2)
+
+	err := d.deliver(event)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/cloudevents+json", contentType)
+	assert.Equal(t, "1.0", received.SpecVersion)
+	assert.Equal(t, event.ID, received.ID)
+	assert.Equal(t, "com.rainbow-road.star.changed", received.Type)
+	assert.Equal(t, "rdelpret/cartographer", received.Subject)
+	assert.Equal(t, 2, received.Data.Stars)
+}
+
+func TestDeliverRetriesAndDeadLetters(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	d := testDispatcher(ts.URL, "json")
+	event := newStarEvent("rdelpret/cartographer", 1, 2)
+
+	err := d.deliver(event)
+	assert.EqualError(t, err, "webhook receiver responded with 500")
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, d.deliveryLog(), 3)
+
+	letters, err := deadLetters()
+	assert.Nil(t, err)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, event.ID, letters[0].Event.ID)
+
+	// replaying takes it out of the store and queues it again
+	replayed, err := d.replayDeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, event.ID, (<-d.queue).ID)
+
+	letters, _ = deadLetters()
+	assert.Len(t, letters, 0)
+}
+
+func TestWebhookDispatcherStop(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	delivered := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.Header.Get("X-Rainbow-Road-Delivery")
+	}))
+	defer ts.Close()
+
+	// queued events are delivered before stop returns
+	d := testDispatcher(ts.URL, "json")
+	d.start()
+	event := newStarEvent("rdelpret/cartographer", 1, 2)
+	d.emit(event)
+	assert.Nil(t, d.stop(context.Background()))
+	assert.Equal(t, event.ID, <-delivered)
+
+	// anything after that goes to the dead letters
+	late := newStarEvent("rdelpret/cartographer", 2, 3)
+	d.emit(late)
+	letters, _ := deadLetters()
+	assert.Len(t, letters, 1)
+	assert.Equal(t, late.ID, letters[0].Event.ID)
+	assert.Equal(t, "server shutting down", letters[0].Error)
+
+	// out of time, retries are abandoned and dead lettered
+	store = newMemoryStore()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	d = testDispatcher(failing.URL, "json")
+	d.backoff = time.Hour
+	d.start()
+	d.emit(newStarEvent("rdelpret/kfx", 1, 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, d.stop(ctx))
+
+	letters, _ = deadLetters()
+	assert.Len(t, letters, 1)
+	assert.Equal(t, "rdelpret/kfx", letters[0].Event.Repo)
+
+	// never started
+	assert.Nil(t, newWebhookDispatcher("", "", "json").stop(context.Background()))
+}
+
+func TestWebhookHandlers(t *testing.T) {
+
+	store = newMemoryStore()
+	defer func() { store = newMemoryStore() }()
+
+	webhooks = testDispatcher("http://localhost:1", "json")
+	defer func() { webhooks = newWebhookDispatcher("", "", "json") }()
+
+	webhooks.deadLetter(newStarEvent("rdelpret/cartographer", 1, 2), os.ErrDeadlineExceeded)
+
+	// deliveries
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/webhooks/deliveries", nil)
+	http.HandlerFunc(webhookDeliveriesHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "{\"deliveries\":[]}\n", recorder.Body.String())
+
+	// dead letters
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/webhooks/dead-letters", nil)
+	http.HandlerFunc(deadLettersHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var letters map[string][]deadLetter
+	json.NewDecoder(recorder.Body).Decode(&letters)
+	assert.Len(t, letters["dead_letters"], 1)
+
+	// replay
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/webhooks/dead-letters/replay", nil)
+	http.HandlerFunc(replayDeadLettersHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "{\"replayed\":1}\n", recorder.Body.String())
+
+	// Test using wrong HTTP Method
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/webhooks/dead-letters/replay", nil)
+	http.HandlerFunc(replayDeadLettersHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "Method is not supported.\n", recorder.Body.String())
+
+	// Test bad route with this handler
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/wrongroute", nil)
+	http.HandlerFunc(webhookDeliveriesHandler).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 not found.\n", recorder.Body.String())
+}